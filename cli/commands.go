@@ -1,6 +1,11 @@
 package cli
 
-import "github.com/spf13/cobra"
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
 
 // RootCmd is the base of all command-line arguments
 var RootCmd = &cobra.Command{} //nolint:gochecknoglobals
@@ -17,3 +22,27 @@ func AddSubcommand(command string, short string, callable func()) {
 		callable()
 	}})
 }
+
+// AddChildCommand adds a command beneath an existing subcommand, passing along between minArgs and maxArgs
+// positional arguments. Returns the new command so flags can be added to it.
+func AddChildCommand(parent string, use string, short string, minArgs, maxArgs int, callable func([]string) error) *cobra.Command {
+	for _, cmd := range RootCmd.Commands() {
+		if cmd.Name() == parent {
+			child := &cobra.Command{Use: use, Short: short, Args: cobra.RangeArgs(minArgs, maxArgs),
+				RunE: func(_ *cobra.Command, args []string) error {
+					return callable(args)
+				}}
+			cmd.AddCommand(child)
+			return child
+		}
+	}
+	panic(fmt.Sprintf("no parent command `%s` for `%s`", parent, use))
+}
+
+// AddFlag adds a string flag to a command that overrides the config key when it's given
+func AddFlag(cmd *cobra.Command, name string, key string, usage string) {
+	cmd.Flags().String(name, "", usage)
+	if err := viper.BindPFlag(key, cmd.Flags().Lookup(name)); err != nil {
+		panic(err)
+	}
+}
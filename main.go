@@ -8,15 +8,27 @@ import (
 
 	"github.com/ntbloom/raincounter/cli"
 	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
 	"github.com/ntbloom/raincounter/pkg/rainbase"
+	"github.com/ntbloom/raincounter/pkg/rainbase/simulator"
 	"github.com/ntbloom/raincounter/pkg/raincloud"
 )
 
 func main() {
 	cli.Configure()
 	cli.AddSubcommand("rainbase", "shuffle data from sensor to MQTT on the rainbase", rainbase.Start)
+	cli.AddSubcommand("simulate", "emulate a rain gauge on a pseudo-terminal for testing", simulator.Start)
 	cli.AddSubcommand("receiver", "receive data over MQTT on the cloud", raincloud.Receive)
 	cli.AddSubcommand("server", "serve the rest API on the cloud", raincloud.Serve)
+	cli.AddChildCommand("rainbase", "command <name> [sensor]",
+		"send a command (pause, unpause, reset, temperature) to every sensor, or just the one named",
+		1, 2, rainbase.Command)
+	export := cli.AddChildCommand("rainbase", "export",
+		"write the local log to stdout, converting rain to millimeters", 0, 0, rainbase.Export)
+	cli.AddFlag(export, "from", configkey.ExportFrom, "start of the export, as a date or RFC3339 time (default all)")
+	cli.AddFlag(export, "to", configkey.ExportTo, "end of the export, as a date or RFC3339 time (default now)")
+	cli.AddFlag(export, "format", configkey.ExportFormat, "csv or ndjson (default csv)")
+	cli.AddFlag(export, "sensor", configkey.ExportSensor, "only export this sensor (default all)")
 
 	cli.RootCmd.PersistentFlags().StringVar(&config.RegularFile, "config", "", "config file")
 	cobra.OnInitialize(config.Configure)
@@ -23,6 +23,9 @@ type DBWrapper interface {
 	// AddFloatRecord makes a single float entry into the database for a given tag
 	AddFloatRecord(tag int, value float64) (sql.Result, error)
 
+	// AddRainRecord makes a rain entry with the millimeters per tip in effect
+	AddRainRecord(mm float64) (sql.Result, error)
+
 	// Tally runs sql command to count database entries for a given topic
 	Tally(tag int) int
 
@@ -31,7 +34,7 @@ type DBWrapper interface {
 
 	// GetSingleInt returns the first result of any SQL query that gives at least one integer result
 	// simple function for confirming correct value was entered for, say, temperature
-	GetSingleInt(query string) int
+	GetSingleInt(query string, args ...interface{}) int
 }
 
 // MakeRainTallyEntry AddTag a rain event
@@ -42,9 +45,9 @@ func MakeRainTallyEntry(db DBWrapper) {
 	}
 }
 
-// MakeRainValueEntry AddFloatRecord for a rain event
-func MakeRainValueEntry(db DBWrapper, value float64) {
-	_, err := db.AddFloatRecord(tlv.RainValue, value)
+// MakeRainValueEntry AddRainRecord for a rain event with its calibration
+func MakeRainValueEntry(db DBWrapper, mm float64) {
+	_, err := db.AddRainRecord(mm)
 	if err != nil {
 		logrus.Error(err)
 	}
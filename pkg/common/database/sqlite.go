@@ -3,95 +3,169 @@ package database
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
-	_ "modernc.org/sqlite" // Driver for localdb
+	"modernc.org/sqlite" // Driver for localdb
 )
 
 const (
 	foreignKey   = `PRAGMA foreign_keys = ON;`
+	busyTimeout  = `PRAGMA busy_timeout = 5000;` // wait on other writers, e.g. a checkpoint, instead of failing
 	sqliteDriver = "sqlite"
+	writeQueue   = 64 // writes waiting on the writer before callers block
 )
 
-// Connection gets a DB and Conn struct for a sqlite File
+// Connection is a connection borrowed from the pool, for reads
 type Connection struct {
-	Database *sql.DB   // database struct
+	Database *sql.DB   // the shared pool, don't close it
 	Conn     *sql.Conn // connection struct
 }
 
-// Sqlite handles connections to sqlite database
+// Sqlite handles connections to sqlite database. Reads share a pool of connections; writes are queued
+// for a single writer so they never contend with each other.
 type Sqlite struct {
-	File     *os.File // name of the .db file
-	FullPath string   // full POSIX path
-	Driver   string   // sqlite driver
+	FullPath string // full POSIX path
+	Driver   string // sqlite driver
+
+	pool   *sql.DB              // long-lived pool, every connection has foreign keys and a busy timeout
+	writes chan *write          // queue for the writer goroutine
+	stmts  map[string]*sql.Stmt // prepared statements, only touched by the writer
+	done   chan struct{}        // closed when the writer has stopped
+	closed chan struct{}        // closed to stop accepting writes
+	closer sync.Once            // Close is safe to call more than once
+	mu     sync.RWMutex         // guards sending on writes against Close
+}
+
+// a single write waiting on the writer
+type write struct {
+	ctx    context.Context // the write is skipped if this is cancelled before the writer gets to it
+	cmd    string
+	args   []interface{}
+	result chan writeRes
 }
 
-// NewSqlite makes a new connector struct for any sqlite database
+type writeRes struct {
+	res sql.Result
+	err error
+}
+
+// NewSqlite makes a new connector struct for any sqlite database. Unless clobber is set, an existing
+// database is kept and only rebuilt if it fails an integrity check.
 func NewSqlite(fullPath string, clobber bool, schema string) (*Sqlite, error) {
 	if clobber {
-		_ = os.Remove(fullPath)
+		removeFiles(fullPath)
+	}
+	db, err := openSqlite(fullPath)
+	if err == nil && !clobber {
+		if err = db.IntegrityCheck(); err != nil {
+			db.Close()
+		}
+	}
+	if err != nil {
+		if clobber {
+			return nil, err
+		}
+		logrus.Errorf("`%s` is corrupt, moving it aside and starting over: %s", fullPath, err)
+		if err = moveAside(fullPath); err != nil {
+			return nil, err
+		}
+		if db, err = openSqlite(fullPath); err != nil {
+			return nil, err
+		}
 	}
 
-	// connect to the File and open it
-	file, err := os.Create(fullPath)
+	// make the schema if the database is new
+	tables, err := db.countTables()
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	if tables == 0 {
+		if _, err = db.MakeSchema(schema); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
 
-	// make a LocalDB object and make the schema if necessary
-	db := Sqlite{
-		File:     file,
+// OpenSqliteReadOnly opens an existing database without changing anything: no schema, no integrity check
+// and nothing moved aside, so it's safe alongside the process that owns the database
+func OpenSqliteReadOnly(fullPath string) (*Sqlite, error) {
+	if _, err := os.Stat(fullPath); err != nil {
+		return nil, err
+	}
+	uri := url.URL{Scheme: "file", Path: fullPath, RawQuery: "mode=ro"}
+	return newSqlite(fullPath, sql.OpenDB(&connector{driver: &sqlite.Driver{}, name: uri.String()})), nil
+}
+
+// open the pool and start the writer
+func openSqlite(fullPath string) (*Sqlite, error) {
+	pool := sql.OpenDB(&connector{driver: &sqlite.Driver{}, name: fullPath})
+
+	// write-ahead logging is easier on SD cards and lets readers in while we write
+	if _, err := pool.ExecContext(context.Background(), `PRAGMA journal_mode = WAL;`); err != nil {
+		_ = pool.Close()
+		return nil, err
+	}
+	return newSqlite(fullPath, pool), nil
+}
+
+func newSqlite(fullPath string, pool *sql.DB) *Sqlite {
+	db := &Sqlite{
 		FullPath: fullPath,
 		Driver:   sqliteDriver,
+		pool:     pool,
+		writes:   make(chan *write, writeQueue),
+		stmts:    make(map[string]*sql.Stmt),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
 	}
-	if clobber {
-		_, err = db.MakeSchema(schema)
-		if err != nil {
-			return nil, err
+	go db.writer()
+	return db
+}
+
+// Close stops the writer once the queued writes are done, and closes the pool
+func (db *Sqlite) Close() {
+	db.closer.Do(func() {
+		db.mu.Lock()
+		close(db.closed)
+		close(db.writes)
+		db.mu.Unlock()
+		<-db.done
+		if err := db.pool.Close(); err != nil {
+			logrus.Error(err)
 		}
-	}
-	return &db, nil
+	})
 }
 
-// Connect attaches to the sqlite database
+// Connect borrows a connection from the pool. Disconnect gives it back.
 func (db *Sqlite) Connect() (*Connection, error) {
-	// get variables ready
-	var (
-		dbPtr *sql.DB
-		conn  *sql.Conn
-		err   error
-	)
-
 	switch db.Driver {
 	case sqliteDriver:
-		dbPtr, err = sql.Open(sqliteDriver, db.FullPath)
-		if err != nil {
-			logrus.Error(err)
-			return nil, err
-		}
-
-		// make a Conn
-		conn, err = dbPtr.Conn(context.Background())
+		conn, err := db.pool.Conn(context.Background())
 		if err != nil {
 			logrus.Error("unable to get a connection struct")
 			return nil, err
 		}
+		return &Connection{db.pool, conn}, nil
 	default:
 		panic("unsupported")
 	}
-	return &Connection{dbPtr, conn}, nil
 }
 
-// Disconnect closes the connection to the database
+// Disconnect returns the connection to the pool
 func (c *Connection) Disconnect() {
 	if err := c.Conn.Close(); err != nil {
 		logrus.Error(err)
 	}
-	if err := c.Database.Close(); err != nil {
-		logrus.Error(err)
-	}
 }
 
 // MakeSchema creates all of the database tables, etc.
@@ -99,17 +173,176 @@ func (db *Sqlite) MakeSchema(schema string) (sql.Result, error) {
 	return db.EnterData(schema)
 }
 
-// EnterData enters a generic sql INSERT statement
-func (db *Sqlite) EnterData(cmd string) (sql.Result, error) {
-	var c *Connection
-	var err error
+// EnterData runs any sql that doesn't return rows on the writer, binding any args to its placeholders, and
+// waits for the result. Commands with args are prepared once and reused.
+func (db *Sqlite) EnterData(cmd string, args ...interface{}) (sql.Result, error) {
+	return db.EnterDataContext(context.Background(), cmd, args...)
+}
 
-	// enforce foreign keys
-	safeCmd := strings.Join([]string{foreignKey, cmd}, " ")
-	if c, err = db.Connect(); err != nil {
-		return nil, err
+// EnterDataContext is EnterData that stops waiting when ctx is cancelled. A write still in the queue is
+// skipped; one the writer has started is interrupted and rolled back by sqlite.
+func (db *Sqlite) EnterDataContext(ctx context.Context, cmd string, args ...interface{}) (sql.Result, error) {
+	w := &write{ctx: ctx, cmd: cmd, args: args, result: make(chan writeRes, 1)}
+	db.mu.RLock()
+	select {
+	case <-db.closed:
+		db.mu.RUnlock()
+		return nil, fmt.Errorf("`%s` is closed", db.FullPath)
+	default:
+	}
+	select {
+	case db.writes <- w:
+		db.mu.RUnlock()
+	case <-ctx.Done():
+		db.mu.RUnlock()
+		return nil, ctx.Err()
+	}
+	select {
+	case res := <-w.result:
+		return res.res, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// the one goroutine that writes to the database
+func (db *Sqlite) writer() {
+	defer close(db.done)
+	defer func() {
+		for _, stmt := range db.stmts {
+			_ = stmt.Close()
+		}
+	}()
+	for w := range db.writes {
+		if err := w.ctx.Err(); err != nil {
+			w.result <- writeRes{nil, err}
+			continue
+		}
+		res, err := db.exec(w.ctx, w.cmd, w.args)
+		w.result <- writeRes{res, err}
+	}
+}
+
+// run a write, preparing it first if it has placeholders to bind
+func (db *Sqlite) exec(ctx context.Context, cmd string, args []interface{}) (sql.Result, error) {
+	if len(args) == 0 {
+		return db.pool.ExecContext(ctx, cmd)
+	}
+	stmt, ok := db.stmts[cmd]
+	if !ok {
+		var err error
+		if stmt, err = db.pool.PrepareContext(context.Background(), cmd); err != nil {
+			return nil, err
+		}
+		db.stmts[cmd] = stmt
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// IntegrityCheck returns an error if sqlite finds the database is damaged
+func (db *Sqlite) IntegrityCheck() error {
+	c, err := db.Connect()
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect()
+
+	rows, err := c.Conn.QueryContext(context.Background(), `PRAGMA integrity_check;`)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+	problems := make([]string, 0)
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Checkpoint copies the write-ahead log into the database and truncates it
+func (db *Sqlite) Checkpoint(ctx context.Context) error {
+	_, err := db.EnterDataContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE);`)
+	return err
+}
+
+// Vacuum rebuilds the database file to give space from deleted rows back to the filesystem
+func (db *Sqlite) Vacuum(ctx context.Context) error {
+	_, err := db.EnterDataContext(ctx, `VACUUM;`)
+	return err
+}
+
+// count the tables in the database, 0 for a new one
+func (db *Sqlite) countTables() (int, error) {
+	c, err := db.Connect()
+	if err != nil {
+		return -1, err
 	}
 	defer c.Disconnect()
 
-	return c.Conn.ExecContext(context.Background(), safeCmd)
+	var count int
+	row := c.Conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table';`)
+	err = row.Scan(&count)
+	return count, err
+}
+
+// connector opens sqlite connections with the pragmas every connection needs, since they don't persist
+type connector struct {
+	driver *sqlite.Driver
+	name   string
+}
+
+func (c *connector) Connect(_ context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.name)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.Execer) //nolint:staticcheck // the sqlite driver doesn't implement ExecerContext
+	if !ok {
+		_ = conn.Close()
+		return nil, fmt.Errorf("sqlite connection can't run pragmas")
+	}
+	for _, pragma := range []string{foreignKey, busyTimeout} {
+		if _, err = execer.Exec(pragma, nil); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// keep a corrupt database around for a post-mortem, but out of the way
+func moveAside(fullPath string) error {
+	corrupt := fmt.Sprintf("%s.corrupt-%s", fullPath, time.Now().Format("20060102T150405"))
+	if err := os.Rename(fullPath, corrupt); err != nil {
+		return err
+	}
+	removeFiles(fullPath)
+	return nil
+}
+
+// remove a database along with its write-ahead log
+func removeFiles(fullPath string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		_ = os.Remove(fullPath + suffix)
+	}
 }
@@ -0,0 +1,75 @@
+package mqtt
+
+// Configure username/password authentication for brokers that use it
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Username is who the client logs in as. A gateway is its station ID unless mqtt.username says otherwise, so
+// broker ACLs can keep each gateway to its own station's topics; other clients need mqtt.username.
+func Username(stationID string) string {
+	if username := viper.GetString(configkey.MQTTUsername); username != "" {
+		return username
+	}
+	return stationID
+}
+
+// log in with a username and password if there's a password. The password is read again on every
+// connection, so it can be changed without a restart.
+func setCredentials(options *paho.ClientOptions, stationID string, allEncrypted bool) error {
+	password, ok, err := readPassword()
+	if err != nil || !ok {
+		return err
+	}
+	username := Username(stationID)
+	if username == "" {
+		return fmt.Errorf("an mqtt password needs %s to go with it", configkey.MQTTUsername)
+	}
+	if !allEncrypted {
+		logrus.Warning("sending the mqtt password to a broker without encryption")
+	}
+	logrus.Debugf("logging in to mqtt as %s", username)
+
+	var mutex sync.Mutex
+	options.SetCredentialsProvider(func() (string, string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		latest, ok, err := readPassword()
+		switch {
+		case err != nil:
+			logrus.Warnf("using the last mqtt password: %s", err)
+		case ok:
+			password = latest
+		}
+		return username, password
+	})
+	return nil
+}
+
+// the password from the environment variable named by mqtt.password.env, or else from the file at
+// mqtt.password.file. Either keeps it out of the config file.
+func readPassword() (password string, ok bool, err error) {
+	if env := viper.GetString(configkey.MQTTPasswordEnv); env != "" {
+		if password, ok = os.LookupEnv(env); ok {
+			return password, true, nil
+		}
+	}
+	file := viper.GetString(configkey.MQTTPasswordFile)
+	if file == "" {
+		return "", false, nil
+	}
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to read mqtt password: %w", err)
+	}
+	return strings.TrimRight(string(raw), "\r\n"), true, nil
+}
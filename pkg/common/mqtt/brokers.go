@@ -0,0 +1,88 @@
+package mqtt
+
+// Pick the brokers to connect to, in the order to try them
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// the broker the last client in this process connected to
+var activeBroker atomic.Value //nolint:gochecknoglobals
+
+// ActiveBroker is the broker clients from NewConnection last connected to, empty before the first connection
+func ActiveBroker() string {
+	broker, _ := activeBroker.Load().(string)
+	return broker
+}
+
+// brokers to try in order. mqtt.brokers lists them as URLs; without it there's the one broker from
+// mqtt.broker.ip, mqtt.broker.port and mqtt.tls.
+func (c *BrokerConfig) urls() ([]*url.URL, error) {
+	if len(c.brokers) == 0 {
+		scheme := "mqtt"
+		if c.useTLS {
+			scheme = "ssl"
+		}
+		return []*url.URL{withPort(&url.URL{Scheme: scheme, Host: c.broker}, c.port)}, nil
+	}
+	urls := make([]*url.URL, 0, len(c.brokers))
+	for _, raw := range c.brokers {
+		broker, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad mqtt broker `%s`: %w", raw, err)
+		}
+		switch broker.Scheme {
+		case "mqtt", "ssl":
+			broker = withPort(broker, 0)
+		case "ws", "wss":
+		default:
+			return nil, fmt.Errorf("mqtt broker `%s` must be mqtt://, ssl://, ws:// or wss://", raw)
+		}
+		if broker.Hostname() == "" {
+			return nil, fmt.Errorf("mqtt broker `%s` has no host", raw)
+		}
+		urls = append(urls, broker)
+	}
+	return urls, nil
+}
+
+// add the usual port for the scheme if the broker doesn't have one
+func withPort(broker *url.URL, port int) *url.URL {
+	if broker.Port() != "" {
+		return broker
+	}
+	if port == 0 {
+		port = plainPort
+		if encrypted(broker) {
+			port = tlsPort
+		}
+	}
+	broker.Host = net.JoinHostPort(broker.Host, strconv.Itoa(port))
+	return broker
+}
+
+func encrypted(broker *url.URL) bool {
+	return broker.Scheme == "ssl" || broker.Scheme == "wss"
+}
+
+// remember which broker the client is trying, and call it the active one once the client connects
+func trackBroker(options *paho.ClientOptions) {
+	var attempt atomic.Value
+	options.SetConnectionAttemptHandler(func(broker *url.URL, tlsConfig *tls.Config) *tls.Config {
+		attempt.Store(broker.Redacted())
+		return tlsConfig
+	})
+	OnConnect(options, func(_ paho.Client) {
+		broker, _ := attempt.Load().(string)
+		activeBroker.Store(broker)
+		logrus.Infof("connected to mqtt broker at %s", broker)
+	})
+}
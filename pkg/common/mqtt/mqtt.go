@@ -3,6 +3,10 @@ package mqtt
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ntbloom/raincounter/pkg/config/configkey"
@@ -14,12 +18,26 @@ import (
 	paho "github.com/eclipse/paho.mqtt.golang"
 )
 
-const localhost = "127.0.0.1"
-const localport = 1883
+// usual broker ports, for brokers without one
+const (
+	plainPort = 1883
+	tlsPort   = 8883
+)
+
+// times any client in this process has reconnected after losing the broker
+var reconnects uint64 //nolint:gochecknoglobals
+
+// Reconnects counts how many times clients from NewConnection have reconnected to the broker
+func Reconnects() uint64 {
+	return atomic.LoadUint64(&reconnects)
+}
 
 // BrokerConfig configures the mqtt connection
 type BrokerConfig struct {
+	brokers           []string
+	useTLS            bool
 	broker            string
+	serverName        string
 	port              int
 	caCert            string
 	clientCert        string
@@ -30,7 +48,10 @@ type BrokerConfig struct {
 // newBrokerConfig get mqtt configuration details from viper directly
 func newBrokerConfig() *BrokerConfig {
 	return &BrokerConfig{
+		brokers:           viper.GetStringSlice(configkey.MQTTBrokers),
+		useTLS:            viper.GetBool(configkey.MQTTUseTLS),
 		broker:            viper.GetString(configkey.MQTTBrokerIP),
+		serverName:        viper.GetString(configkey.MQTTBrokerName),
 		port:              viper.GetInt(configkey.MQTTBrokerPort),
 		caCert:            viper.GetString(configkey.MQTTCaCert),
 		clientCert:        viper.GetString(configkey.MQTTClientCert),
@@ -39,45 +60,118 @@ func newBrokerConfig() *BrokerConfig {
 	}
 }
 
-// NewConnection creates a new MQTT connection or error
-func NewConnection() (paho.Client, error) {
+// NewConnection creates a new MQTT connection or error. See NewClientOptions for the arguments.
+func NewConnection(clientID, stationID string) (paho.Client, error) {
+	options, err := NewClientOptions(clientID, stationID)
+	if err != nil {
+		return nil, err
+	}
+	return paho.NewClient(options), nil
+}
+
+// NewClientOptions configures a connection for clients that need their own handlers before connecting.
+// clientID is the stable ID the broker keeps a session for, or empty for a throwaway client with a random ID
+// and a clean session. A gateway passes its station ID to announce its presence; the receiver and other
+// clients pass an empty string.
+func NewClientOptions(clientID, stationID string) (*paho.ClientOptions, error) {
 	options := paho.NewClientOptions()
 	config := newBrokerConfig()
 
-	// add broker, authenticate if necessary
-	var scheme string
-	useTLS := viper.GetBool(configkey.MQTTUseTLS)
-	if useTLS {
-		scheme = "ssl"
-	} else {
-		scheme = "mqtt"
+	// add brokers in the order to try them, paho fails over from one to the next
+	brokers, err := config.urls()
+	if err != nil {
+		return nil, err
+	}
+	useTLS, allEncrypted := false, true
+	for _, broker := range brokers {
+		if encrypted(broker) {
+			useTLS = true
+		} else {
+			allEncrypted = false
+			logrus.Warningf("Connecting to MQTT broker at %s without encryption, only do this on a trusted network",
+				broker.Host)
+		}
+		logrus.Debugf("adding MQTT broker at %s", broker.Redacted())
+		options.AddBroker(broker.String())
 	}
-	switch scheme {
-	case "ssl":
+	if useTLS {
 		logrus.Debug("using TLS to connect")
 		// configure tls
-		tlsConfig, err := configureTLSConfig(config.caCert, config.clientCert, config.clientKey)
+		tlsConfig, err := configureTLSConfig(config.caCert, config.clientCert, config.clientKey, config.serverName)
 		if err != nil {
 			return nil, err
 		}
 		options.SetTLSConfig(tlsConfig)
-	case "mqtt":
-		logrus.Warning("Connecting to MQTT broker on localhost:1883 without encryption, for testing only")
-		config.broker = localhost
-		config.port = localport
-	default:
-		panic(fmt.Sprintf("unsupported mqtt scheme: %s", scheme))
 	}
+	if err = setCredentials(options, stationID, allEncrypted); err != nil {
+		return nil, err
+	}
+	trackBroker(options)
 
-	server := fmt.Sprintf("%s://%s:%d", scheme, config.broker, config.port)
-	logrus.Debugf("opening MQTT connection at %s", server)
-	options.AddBroker(server)
+	// keep a session on the broker, so qos 1 messages wait for us while we're away
+	if clientID != "" {
+		if err := setSession(options, clientID); err != nil {
+			return nil, err
+		}
+	}
 
 	// miscellaneous options
 	options.SetConnectTimeout(config.connectionTimeout)
+	options.SetConnectRetryInterval(viper.GetDuration(configkey.MQTTConnectRetryInterval))
+	options.SetAutoReconnect(true)
 	options.SetOrderMatters(false)
 
-	client := paho.NewClient(options)
-	return client,
-		nil
+	// count reconnections, but not the first connection
+	var connected int32
+	OnConnect(options, func(_ paho.Client) {
+		if atomic.SwapInt32(&connected, 1) == 1 {
+			count := atomic.AddUint64(&reconnects, 1)
+			logrus.Infof("reconnected to mqtt broker, %d reconnections so far", count)
+		}
+	})
+	options.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		logrus.Warnf("lost connection to mqtt broker: %s", err)
+	})
+	if stationID != "" {
+		setPresence(options, stationID)
+	}
+	return options, nil
+}
+
+// ClientID is the configured client ID, or fallback if there isn't one
+func ClientID(fallback string) string {
+	if id := viper.GetString(configkey.MQTTClientID); id != "" {
+		return id
+	}
+	return fallback
+}
+
+// OnConnect adds a handler to run every time the client connects, after any that are set already
+func OnConnect(options *paho.ClientOptions, handler paho.OnConnectHandler) {
+	previous := options.OnConnect
+	options.SetOnConnectHandler(func(client paho.Client) {
+		if previous != nil {
+			previous(client)
+		}
+		handler(client)
+	})
+}
+
+// use a stable client ID with a session the broker keeps, and a file store so messages in flight survive a
+// restart on our side too
+func setSession(options *paho.ClientOptions, clientID string) error {
+	options.SetClientID(clientID)
+	options.SetCleanSession(viper.GetBool(configkey.MQTTCleanSession))
+	dir := viper.GetString(configkey.MQTTSessionStore)
+	if dir == "" {
+		return nil
+	}
+	// one directory per client, since a gateway and a receiver can share a host
+	dir = filepath.Join(dir, strings.ReplaceAll(clientID, string(filepath.Separator), "_"))
+	if err := os.MkdirAll(dir, 0o750); err != nil { //nolint:gomnd
+		return fmt.Errorf("unable to make mqtt session store: %w", err)
+	}
+	logrus.Debugf("keeping mqtt session for %s in %s", clientID, dir)
+	options.SetStore(paho.NewFileStore(dir))
+	return nil
 }
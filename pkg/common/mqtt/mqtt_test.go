@@ -1,20 +1,28 @@
 package mqtt_test
 
 import (
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/spf13/viper"
 
 	"github.com/ntbloom/raincounter/pkg/common/mqtt"
 
 	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/sirupsen/logrus"
 )
 
 // reusable mqtt function
 func pahoFixture(t *testing.T) paho.Client {
 	config.Configure()
-	client, err := mqtt.NewConnection()
+	client, err := mqtt.NewConnection("", "")
 	if err != nil {
 		t.Fail()
 	}
@@ -34,3 +42,159 @@ func TestMQTTConnection(t *testing.T) {
 	}
 	client.Publish("hello", 0, false, "world")
 }
+
+// station topics come back apart the way they went together
+func TestStationTopics(t *testing.T) {
+	full := mqtt.StationTopic("home", mqtt.RainTopic)
+	if full != "station/home/measurement/rain" {
+		t.Errorf("unexpected topic %s", full)
+	}
+	station, topic, err := mqtt.ParseStationTopic(full)
+	if err != nil || station != "home" || topic != mqtt.RainTopic {
+		t.Errorf("bad parse of %s: %s, %s, %v", full, station, topic, err)
+	}
+	if wildcard := mqtt.AllStations(mqtt.RainTopic); wildcard != "station/+/measurement/rain" {
+		t.Errorf("unexpected wildcard %s", wildcard)
+	}
+	for _, bad := range []string{mqtt.RainTopic, "station//measurement/rain", "station/home", "hello"} {
+		if _, _, err := mqtt.ParseStationTopic(bad); err == nil {
+			t.Errorf("expected an error parsing %s", bad)
+		}
+	}
+}
+
+// a client with an ID keeps its session on the broker and its messages in flight on disk
+func TestPersistentSession(t *testing.T) {
+	config.Configure()
+	store := t.TempDir()
+	viper.Set(configkey.MQTTSessionStore, store)
+
+	options, err := mqtt.NewClientOptions(mqtt.ClientID("rainbase-home"), "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.ClientID != "rainbase-home" || options.CleanSession {
+		t.Errorf("expected a persistent session for rainbase-home, got %s (clean: %t)", options.ClientID, options.CleanSession)
+	}
+	if _, err = os.Stat(filepath.Join(store, "rainbase-home")); err != nil {
+		t.Errorf("session store wasn't made: %s", err)
+	}
+
+	throwaway, err := mqtt.NewClientOptions("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throwaway.ClientID != "" || !throwaway.CleanSession {
+		t.Errorf("expected a clean session with a random ID, got %s (clean: %t)", throwaway.ClientID, throwaway.CleanSession)
+	}
+}
+
+// gateways log in as their station with a password from a file or the environment, to whatever broker is
+// configured
+func TestCredentials(t *testing.T) {
+	config.Configure()
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set(configkey.MQTTBrokerIP, "192.168.1.5")
+	viper.Set(configkey.MQTTPasswordFile, file)
+	viper.Set(configkey.MQTTPasswordEnv, "RAINCOUNTER_TEST_MQTT_PASSWORD")
+	defer func() {
+		viper.Set(configkey.MQTTBrokerIP, "127.0.0.1")
+		viper.Set(configkey.MQTTPasswordFile, "")
+	}()
+
+	options, err := mqtt.NewClientOptions("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker := options.Servers[0].String(); broker != "mqtt://192.168.1.5:1883" {
+		t.Errorf("expected the configured broker without TLS, got %s", broker)
+	}
+	if username, password := options.CredentialsProvider(); username != "home" || password != "from-file" {
+		t.Errorf("expected to log in as home with the password file, got %s/%s", username, password)
+	}
+	os.Setenv("RAINCOUNTER_TEST_MQTT_PASSWORD", "from-env")
+	defer os.Unsetenv("RAINCOUNTER_TEST_MQTT_PASSWORD")
+	if _, password := options.CredentialsProvider(); password != "from-env" {
+		t.Errorf("expected the password from the environment, got %s", password)
+	}
+
+	// anything that isn't a gateway has to say who it is
+	if _, err = mqtt.NewClientOptions("", ""); err == nil {
+		t.Error("expected an error for a password without a username")
+	}
+}
+
+// brokers are tried in the order they're listed, and the one we end up on is reported
+func TestBrokerFailover(t *testing.T) {
+	config.Configure()
+	defer viper.Set(configkey.MQTTBrokers, []string{})
+
+	viper.Set(configkey.MQTTBrokers, []string{"mqtt://primary.example.com", "ws://192.168.1.10:9001/mqtt", "ftp://nope"})
+	if _, err := mqtt.NewClientOptions("", ""); err == nil {
+		t.Error("expected an error for an ftp broker")
+	}
+
+	// the primary is down, the fallback is up
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := "mqtt://" + down.Addr().String()
+	down.Close()
+	fallback := fakeBroker(t)
+	viper.Set(configkey.MQTTBrokers, []string{primary, fallback, "mqtt://192.168.1.10"})
+
+	options, err := mqtt.NewClientOptions("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := make([]string, 0)
+	for _, server := range options.Servers {
+		servers = append(servers, server.String())
+	}
+	if len(servers) != 3 || servers[0] != primary || servers[2] != "mqtt://192.168.1.10:1883" {
+		t.Errorf("brokers out of order or missing their port: %v", servers)
+	}
+
+	client := paho.NewClient(options)
+	if token := client.Connect(); !token.WaitTimeout(time.Second*5) || token.Error() != nil {
+		t.Fatalf("didn't fail over: %v", token.Error())
+	}
+	defer client.Disconnect(0)
+	// paho runs the connect handlers in the background
+	deadline := time.Now().Add(time.Second)
+	for mqtt.ActiveBroker() != fallback && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if active := mqtt.ActiveBroker(); active != fallback {
+		t.Errorf("expected to be on %s, got %s", fallback, active)
+	}
+}
+
+// just enough of a broker to accept a connection, returning its address
+func fakeBroker(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err = packets.ReadPacket(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			_ = connack.Write(conn)
+		}
+	}()
+	return "mqtt://" + listener.Addr().String()
+}
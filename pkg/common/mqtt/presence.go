@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// presence is retained and must arrive, whatever qos the measurements use
+const presenceQos = 1
+
+// Presence is the retained message on a gateway's PresenceTopic. The gateway says it's online when it connects
+// and offline when it shuts down, and the broker says it's offline for it if the connection drops.
+type Presence struct {
+	StationID string
+	Online    bool
+	Timestamp time.Time // when the gateway said it, or zero for the last will, which the server has to stamp
+}
+
+func presencePayload(stationID string, online bool, timestamp time.Time) []byte {
+	payload, err := json.Marshal(Presence{StationID: stationID, Online: online, Timestamp: timestamp})
+	if err != nil {
+		// a struct of strings, bools and times always marshals
+		panic(err)
+	}
+	return payload
+}
+
+// setPresence makes the client announce itself as the gateway for stationID: online after every connection,
+// and offline through its last will. The will is written once and sent whenever the broker gives up on us,
+// so it has no time of its own.
+func setPresence(options *paho.ClientOptions, stationID string) {
+	topic := StationTopic(stationID, PresenceTopic)
+	options.SetBinaryWill(topic, presencePayload(stationID, false, time.Time{}), presenceQos, true)
+	OnConnect(options, func(client paho.Client) {
+		logrus.Debugf("announcing %s online", stationID)
+		client.Publish(topic, presenceQos, true, presencePayload(stationID, true, time.Now()))
+	})
+}
+
+// PublishOffline says the gateway is going away on purpose. The broker only sends the last will when the
+// connection drops, so call it before disconnecting.
+func PublishOffline(client paho.Client, stationID string) paho.Token {
+	payload := presencePayload(stationID, false, time.Now())
+	return client.Publish(StationTopic(stationID, PresenceTopic), presenceQos, true, payload)
+}
@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
@@ -21,8 +22,22 @@ type SampleMessage struct {
 // SampleCelsius is a random temperature value picked for no reason
 var SampleCelsius = 23
 
+// a message ID that won't collide with other samples
+func sampleID(timestamp time.Time) string {
+	return fmt.Sprintf("sample-%d", timestamp.UnixNano())
+}
+
+// scope a sample topic to the configured station
+func sampleTopic(topic string) string {
+	return StationTopic(viper.GetString(configkey.StationID), topic)
+}
+
 func genericEventMessage(tag, value int, event string, timestamp time.Time) map[string]interface{} {
 	return map[string]interface{}{
+		"StationID": viper.GetString(configkey.StationID),
+		"SensorID":  viper.GetString(configkey.SensorID),
+		"MessageID": sampleID(timestamp),
+		"Sequence":  1,
 		"Tag":       tag,
 		"Value":     value,
 		"Event":     event,
@@ -33,8 +48,32 @@ func genericEventMessage(tag, value int, event string, timestamp time.Time) map[
 // SampleRain is a test mqtt message for a rain event
 func SampleRain(timestamp time.Time) SampleMessage {
 	return SampleMessage{
-		Topic:     RainTopic,
-		Msg:       map[string]interface{}{"Millimeters": viper.GetFloat64(configkey.SensorRainMm), "Timestamp": timestamp},
+		Topic: sampleTopic(RainTopic),
+		Msg: map[string]interface{}{
+			"StationID":   viper.GetString(configkey.StationID),
+			"SensorID":    viper.GetString(configkey.SensorID),
+			"MessageID":   sampleID(timestamp),
+			"Sequence":    1,
+			"Millimeters": viper.GetFloat64(configkey.SensorRainMm),
+			"Timestamp":   timestamp,
+		},
+		Timestamp: timestamp,
+	}
+}
+
+// SampleRainRate is a test mqtt message for the rain rate, as if it had tipped every 30 seconds
+func SampleRainRate(timestamp time.Time) SampleMessage {
+	rate := viper.GetFloat64(configkey.SensorRainMm) * 120 //nolint:gomnd
+	return SampleMessage{
+		Topic: sampleTopic(RainRateTopic),
+		Msg: map[string]interface{}{
+			"StationID":   viper.GetString(configkey.StationID),
+			"SensorID":    viper.GetString(configkey.SensorID),
+			"MmPerHour1":  rate,
+			"MmPerHour5":  rate,
+			"MmPerHour15": rate,
+			"Timestamp":   timestamp,
+		},
 		Timestamp: timestamp,
 	}
 }
@@ -42,8 +81,16 @@ func SampleRain(timestamp time.Time) SampleMessage {
 // SampleTemp is a test mqtt message for a temperature measurement in C
 func SampleTemp(timestamp time.Time) SampleMessage {
 	return SampleMessage{
-		Topic:     TemperatureTopic,
-		Msg:       map[string]interface{}{"TempC": SampleCelsius, "Timestamp": timestamp},
+		Topic: sampleTopic(TemperatureTopic),
+		Msg: map[string]interface{}{
+			"StationID": viper.GetString(configkey.StationID),
+			"SensorID":  viper.GetString(configkey.SensorID),
+			"MessageID": sampleID(timestamp),
+			"Sequence":  1,
+			"TempC":     SampleCelsius,
+			"Quality":   "good",
+			"Timestamp": timestamp,
+		},
 		Timestamp: timestamp,
 	}
 }
@@ -52,7 +99,7 @@ func SampleTemp(timestamp time.Time) SampleMessage {
 func SampleSensorPause(timestamp time.Time) SampleMessage {
 	msg := genericEventMessage(tlv.Pause, tlv.PauseValue, SensorPauseEvent, timestamp)
 	return SampleMessage{
-		Topic:     SensorEventTopic,
+		Topic:     sampleTopic(SensorEventTopic),
 		Msg:       msg,
 		Timestamp: timestamp,
 	}
@@ -62,7 +109,7 @@ func SampleSensorPause(timestamp time.Time) SampleMessage {
 func SampleSensorUnpause(timestamp time.Time) SampleMessage {
 	msg := genericEventMessage(tlv.Unpause, tlv.UnpauseValue, SensorUnpauseEvent, timestamp)
 	return SampleMessage{
-		Topic:     SensorEventTopic,
+		Topic:     sampleTopic(SensorEventTopic),
 		Msg:       msg,
 		Timestamp: timestamp,
 	}
@@ -72,7 +119,7 @@ func SampleSensorUnpause(timestamp time.Time) SampleMessage {
 func SampleSensorSoftReset(timestamp time.Time) SampleMessage {
 	msg := genericEventMessage(tlv.SoftReset, tlv.SoftResetValue, SensorSoftResetEvent, timestamp)
 	return SampleMessage{
-		Topic:     SensorEventTopic,
+		Topic:     sampleTopic(SensorEventTopic),
 		Msg:       msg,
 		Timestamp: timestamp,
 	}
@@ -82,7 +129,7 @@ func SampleSensorSoftReset(timestamp time.Time) SampleMessage {
 func SampleSensorHardReset(timestamp time.Time) SampleMessage {
 	msg := genericEventMessage(tlv.HardReset, tlv.HardResetValue, SensorHardResetEvent, timestamp)
 	return SampleMessage{
-		Topic:     SensorEventTopic,
+		Topic:     sampleTopic(SensorEventTopic),
 		Msg:       msg,
 		Timestamp: timestamp,
 	}
@@ -91,8 +138,16 @@ func SampleSensorHardReset(timestamp time.Time) SampleMessage {
 // SampleSensorStatus is a test mqtt message for a sensor status message
 func SampleSensorStatus(timestamp time.Time) SampleMessage {
 	return SampleMessage{
-		Topic:     SensorStatusTopic,
-		Msg:       map[string]interface{}{"OK": true, "Timestamp": timestamp},
+		Topic: sampleTopic(SensorStatusTopic),
+		Msg: map[string]interface{}{
+			"StationID":     viper.GetString(configkey.StationID),
+			"SensorID":      viper.GetString(configkey.SensorID),
+			"OK":            true,
+			"State":         "up",
+			"Reason":        "",
+			"LastPacketAge": 1.5,
+			"Timestamp":     timestamp,
+		},
 		Timestamp: timestamp,
 	}
 }
@@ -100,8 +155,44 @@ func SampleSensorStatus(timestamp time.Time) SampleMessage {
 // SampleGatewayStatus is a test mqtt message for a gateway status message
 func SampleGatewayStatus(timestamp time.Time) SampleMessage {
 	return SampleMessage{
-		Topic:     GatewayStatusTopic,
-		Msg:       map[string]interface{}{"OK": true, "Timestamp": timestamp},
+		Topic: sampleTopic(GatewayStatusTopic),
+		Msg: map[string]interface{}{
+			"StationID":      viper.GetString(configkey.StationID),
+			"OK":             true,
+			"Uptime":         3600.5,
+			"DiskFree":       uint64(8 << 30),
+			"CPUTempC":       48.3,
+			"Load1":          0.12,
+			"Load5":          0.08,
+			"Load15":         0.05,
+			"MQTTReconnects": uint64(1),
+			"MQTTBroker":     "ssl://127.0.0.1:8883",
+			"CertExpires":    timestamp.Add(time.Hour * 24 * 365),
+			"Version":        "dev",
+			"Timestamp":      timestamp,
+		},
+		Timestamp: timestamp,
+	}
+}
+
+// SamplePresence is a test mqtt message for a gateway coming online or going offline
+func SamplePresence(online bool, timestamp time.Time) SampleMessage {
+	return SampleMessage{
+		Topic: sampleTopic(PresenceTopic),
+		Msg: map[string]interface{}{
+			"StationID": viper.GetString(configkey.StationID),
+			"Online":    online,
+			"Timestamp": timestamp,
+		},
+		Timestamp: timestamp,
+	}
+}
+
+// SampleSensorCommand is a test mqtt message asking the gateway to pause the sensor
+func SampleSensorCommand(timestamp time.Time) SampleMessage {
+	return SampleMessage{
+		Topic:     sampleTopic(SensorCommandTopic),
+		Msg:       map[string]interface{}{"Command": "pause", "Timestamp": timestamp},
 		Timestamp: timestamp,
 	}
 }
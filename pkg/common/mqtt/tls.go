@@ -5,13 +5,23 @@ package mqtt
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
-// get a new config for ssl
-func configureTLSConfig(caCertFile, clientCertFile, clientKeyFile string) (*tls.Config, error) {
+// the client certificate in use by this process, nil without TLS
+var clientCerts *clientCert //nolint:gochecknoglobals
+
+// get a new config for ssl. The broker is verified against the CA, by serverName if it's set and by the
+// broker address otherwise.
+func configureTLSConfig(caCertFile, clientCertFile, clientKeyFile, serverName string) (*tls.Config, error) {
 	// import CA from file
 	certpool := x509.NewCertPool()
 	ca, err := ioutil.ReadFile(caCertFile)
@@ -19,20 +29,124 @@ func configureTLSConfig(caCertFile, clientCertFile, clientKeyFile string) (*tls.
 		logrus.Errorf("problem reading CA file at %s: %s", caCertFile, err)
 		return nil, err
 	}
-	certpool.AppendCertsFromPEM(ca)
+	if !certpool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in CA file at %s", caCertFile)
+	}
 
 	// match client cert and key
-	cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
-	if err != nil {
+	certs := &clientCert{certFile: clientCertFile, keyFile: clientKeyFile}
+	if err = certs.load(); err != nil {
 		logrus.Errorf("problem with cert/key pair: %s", err)
 		return nil, err
 	}
+	clientCerts = certs
+	CheckClientCert()
 
 	return &tls.Config{
-		RootCAs:            certpool,
-		ClientAuth:         tls.RequireAndVerifyClientCert,
-		ClientCAs:          nil,
-		InsecureSkipVerify: true, //nolint:gosec
-		Certificates:       []tls.Certificate{cert},
+		RootCAs:              certpool,
+		ServerName:           serverName,
+		MinVersion:           tls.VersionTLS12,
+		GetClientCertificate: certs.get,
 	}, nil
 }
+
+// ClientCertExpiry is when the client certificate on disk expires, or false if we aren't using TLS
+func ClientCertExpiry() (time.Time, bool) {
+	if clientCerts == nil {
+		return time.Time{}, false
+	}
+	clientCerts.refresh()
+	return clientCerts.expiry(), true
+}
+
+// CheckClientCert warns if the client certificate is close to expiring, so it gets rotated before the broker
+// turns us away
+func CheckClientCert() {
+	expires, ok := ClientCertExpiry()
+	if !ok {
+		return
+	}
+	left := time.Until(expires)
+	switch {
+	case left <= 0:
+		logrus.Errorf("mqtt client certificate expired at %s", expires)
+	case left < viper.GetDuration(configkey.MQTTCertExpiryWarning):
+		logrus.Warnf("mqtt client certificate expires at %s, in %s", expires, left.Round(time.Hour))
+	}
+}
+
+// clientCert is the certificate and key the client presents, read again whenever either file changes. New
+// files are picked up on the next handshake, so rotating them doesn't need a restart.
+type clientCert struct {
+	certFile string
+	keyFile  string
+	sync.Mutex
+	cert     *tls.Certificate
+	modified [2]time.Time // modification times of the files the certificate was read from
+}
+
+// offer the current certificate to the broker
+func (c *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.refresh()
+	c.Lock()
+	defer c.Unlock()
+	return c.cert, nil
+}
+
+// load the files again if they've changed. A pair that doesn't match, which can happen halfway through
+// copying new files in, keeps the old certificate until the next try.
+func (c *clientCert) refresh() {
+	modified, err := c.stat()
+	if err != nil {
+		logrus.Warnf("keeping the old mqtt client certificate: %s", err)
+		return
+	}
+	c.Lock()
+	changed := modified != c.modified
+	c.Unlock()
+	if !changed {
+		return
+	}
+	if err = c.load(); err != nil {
+		logrus.Warnf("keeping the old mqtt client certificate: %s", err)
+		return
+	}
+	logrus.Infof("reloaded mqtt client certificate from %s, expires %s", c.certFile, c.expiry())
+}
+
+func (c *clientCert) load() error {
+	modified, err := c.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.cert = &cert
+	c.modified = modified
+	return nil
+}
+
+func (c *clientCert) stat() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
+
+func (c *clientCert) expiry() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.cert.Leaf.NotAfter
+}
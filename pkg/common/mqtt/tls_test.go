@@ -0,0 +1,176 @@
+package mqtt_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/ntbloom/raincounter/pkg/common/mqtt"
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+)
+
+// the broker is verified against the CA and the configured name, and a new client certificate is picked up
+// without a restart
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, nil, nil, "raincounter ca", time.Hour)
+	broker, brokerKey := newCert(t, ca, caKey, "broker.raincounter", time.Hour)
+	client, clientKey := newCert(t, ca, caKey, "home", time.Hour*24)
+	files := map[string]string{
+		"ca.pem":     writePEM(t, dir, "ca.pem", ca, nil),
+		"client.crt": writePEM(t, dir, "client.crt", client, nil),
+		"client.key": writePEM(t, dir, "client.key", nil, clientKey),
+	}
+
+	config.Configure()
+	viper.Set(configkey.MQTTUseTLS, true)
+	viper.Set(configkey.MQTTCaCert, files["ca.pem"])
+	viper.Set(configkey.MQTTClientCert, files["client.crt"])
+	viper.Set(configkey.MQTTClientKey, files["client.key"])
+	viper.Set(configkey.MQTTBrokerName, "broker.raincounter")
+	defer viper.Set(configkey.MQTTUseTLS, false)
+
+	options, err := mqtt.NewClientOptions("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.TLSConfig.InsecureSkipVerify {
+		t.Fatal("broker certificate isn't verified")
+	}
+
+	// a broker with a certificate from our CA
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{broker.Raw}, PrivateKey: brokerKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	handshake := func(config *tls.Config) (*x509.Certificate, error) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0], nil
+	}
+
+	if _, err = handshake(options.TLSConfig); err != nil {
+		t.Fatalf("expected to verify the broker: %s", err)
+	}
+	wrongName := options.TLSConfig.Clone()
+	wrongName.ServerName = "elsewhere"
+	if _, err = handshake(wrongName); err == nil {
+		t.Error("connected to a broker with the wrong name")
+	}
+
+	// rotate the client certificate
+	expires, ok := mqtt.ClientCertExpiry()
+	if !ok || !expires.Equal(client.NotAfter) {
+		t.Errorf("expected the certificate to expire at %s, got %s", client.NotAfter, expires)
+	}
+	rotated, rotatedKey := newCert(t, ca, caKey, "home", time.Hour*48)
+	writePEM(t, dir, "client.crt", rotated, nil)
+	writePEM(t, dir, "client.key", nil, rotatedKey)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{files["client.crt"], files["client.key"]} {
+		if err = os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expires, _ = mqtt.ClientCertExpiry(); !expires.Equal(rotated.NotAfter) {
+		t.Errorf("expected the rotated certificate to expire at %s, got %s", rotated.NotAfter, expires)
+	}
+	presented, err := options.TLSConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil || presented.Leaf.SerialNumber.Cmp(rotated.SerialNumber) != 0 {
+		t.Errorf("expected the rotated certificate to be presented, got %v", err)
+	}
+}
+
+// make a certificate signed by parent, or self-signed if parent is nil
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string,
+	valid time.Duration) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(valid).Truncate(time.Second),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write a certificate or a key as PEM, returning the file name
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	block := &pem.Block{}
+	if cert != nil {
+		block.Type, block.Bytes = "CERTIFICATE", cert.Raw
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Type, block.Bytes = "EC PRIVATE KEY", der
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
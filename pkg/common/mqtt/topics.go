@@ -1,12 +1,21 @@
 package mqtt
 
+import (
+	"fmt"
+	"strings"
+)
+
 // mqtt topics for events, measurements, status
 const (
 	GatewayStatusTopic = "status/gateway"
 	SensorStatusTopic  = "status/sensor"
+	PresenceTopic      = "status/presence"
+	SensorLinkTopic    = "status/link"
 	TemperatureTopic   = "measurement/temperature"
 	RainTopic          = "measurement/rain"
+	RainRateTopic      = "measurement/rainrate"
 	SensorEventTopic   = "sensor/event"
+	SensorCommandTopic = "sensor/command"
 )
 
 // mqtt event tags
@@ -16,3 +25,25 @@ const (
 	SensorSoftResetEvent = "sensorSoftReset"
 	SensorHardResetEvent = "sensorHardReset"
 )
+
+// every topic is published under the station it came from, e.g. station/home/measurement/rain
+const stationPrefix = "station"
+
+// StationTopic scopes one of the topics above to a single station
+func StationTopic(stationID, topic string) string {
+	return fmt.Sprintf("%s/%s/%s", stationPrefix, stationID, topic)
+}
+
+// AllStations is a wildcard subscription to one of the topics above for every station
+func AllStations(topic string) string {
+	return StationTopic("+", topic)
+}
+
+// ParseStationTopic splits a topic from StationTopic back into the station ID and the unscoped topic
+func ParseStationTopic(full string) (stationID string, topic string, err error) {
+	parts := strings.SplitN(full, "/", 3) //nolint:gomnd
+	if len(parts) != 3 || parts[0] != stationPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("topic `%s` isn't scoped to a station", full)
+	}
+	return parts[1], parts[2], nil
+}
@@ -10,30 +10,81 @@ const (
 	USBConnectionPort    = "usb.connection.port"
 	USBConnectionTimeout = "usb.connection.timeout"
 
-	MQTTBrokerIP          = "mqtt.broker.ip"
-	MQTTBrokerPort        = "mqtt.broker.port"
-	MQTTCaCert            = "mqtt.certs.ca"
-	MQTTUseTLS            = "mqtt.tls"
-	MQTTClientCert        = "mqtt.certs.client"
-	MQTTClientKey         = "mqtt.certs.key"
-	MQTTConnectionTimeout = "mqtt.connection.timeout"
-	MQTTQuiescence        = "mqtt.connection.quiescence"
-	MQTTQos               = "mqtt.qos"
+	MQTTBrokers              = "mqtt.brokers"
+	MQTTBrokerIP             = "mqtt.broker.ip"
+	MQTTBrokerPort           = "mqtt.broker.port"
+	MQTTBrokerName           = "mqtt.broker.name"
+	MQTTCaCert               = "mqtt.certs.ca"
+	MQTTUseTLS               = "mqtt.tls"
+	MQTTClientCert           = "mqtt.certs.client"
+	MQTTClientKey            = "mqtt.certs.key"
+	MQTTCertExpiryWarning    = "mqtt.certs.expiry.warning"
+	MQTTConnectionTimeout    = "mqtt.connection.timeout"
+	MQTTConnectRetryInterval = "mqtt.connection.retry.interval"
+	MQTTQuiescence           = "mqtt.connection.quiescence"
+	MQTTQos                  = "mqtt.qos"
+	MQTTClientID             = "mqtt.client.id"
+	MQTTUsername             = "mqtt.username"
+	MQTTPasswordFile         = "mqtt.password.file"
+	MQTTPasswordEnv          = "mqtt.password.env"
+	MQTTCleanSession         = "mqtt.session.clean"
+	MQTTSessionStore         = "mqtt.session.store"
 
-	SensorRainMm        = "sensor.mm"
-	AssetStatusDuration = "asset.status.duration"
+	StationID = "station.id"
 
-	DatabaseLocalFile = "database.local.file"
+	SensorRainMm              = "sensor.mm"
+	SensorID                  = "sensor.id"
+	Sensors                   = "sensors"
+	SensorTemperatureInterval = "sensor.temperature.interval"
+	SensorStaleIntervals      = "sensor.stale.intervals"
+	SensorDownIntervals       = "sensor.down.intervals"
+	FilterTipInterval         = "filter.tip.interval"
+	FilterTipRateMax          = "filter.tip.rate.max"
+	FilterTipRateWindow       = "filter.tip.rate.window"
+	FilterTemperatureWindow   = "filter.temperature.window"
+	FilterTemperatureRateMax  = "filter.temperature.rate.max"
+	FilterTemperatureMin      = "filter.temperature.min"
+	FilterTemperatureMax      = "filter.temperature.max"
+	AssetStatusDuration       = "asset.status.duration"
+
+	DatabaseLocalFile        = "database.local.file"
+	DatabaseLocalPersist     = "database.local.persist"
+	DatabaseLocalRetention   = "database.local.retention.days"
+	DatabaseLocalMaintenance = "database.local.maintenance.interval"
+	DatabaseLocalVacuum      = "database.local.vacuum.interval"
+
+	GatewayThermalZone = "gateway.thermal.zone"
 
 	PGDatabaseName        = "database.remote.name"
 	PGPassword            = "database.remote.password"
 	PGConnectionTimeout   = "database.remote.connection.timeout"
 	PGConnectionRetryWait = "database.remote.connection.retry.wait"
 
-	MessengerStatusInterval = "messenger.status.interval"
+	MessengerStatusInterval    = "messenger.status.interval"
+	MessengerOutboxInterval    = "messenger.outbox.interval"
+	MessengerPublishTimeout    = "messenger.publish.timeout"
+	MessengerRateInterval      = "messenger.rate.interval"
+	MessengerTelemetryInterval = "messenger.telemetry.interval"
 
 	MainLoopDuration = "main.loop.duration"
 
+	SupervisorBackoffMin = "supervisor.backoff.min"
+	SupervisorBackoffMax = "supervisor.backoff.max"
+
+	DiagnosticsAddress = "diagnostics.address"
+
+	ExportFrom   = "export.from"
+	ExportTo     = "export.to"
+	ExportFormat = "export.format"
+	ExportSensor = "export.sensor"
+
+	SimulateLink                = "simulate.link"
+	SimulateFraming             = "simulate.framing"
+	SimulateStormProfile        = "simulate.storm.profile"
+	SimulateTemperatureInterval = "simulate.temperature.interval"
+	SimulateTemperatureBase     = "simulate.temperature.base"
+	SimulateEventInterval       = "simulate.event.interval"
+
 	RestIP      = "rest.ip.address"
 	RestPort    = "rest.ip.port"
 	RestScheme  = "rest.scheme"
@@ -41,6 +92,7 @@ const (
 
 	WebEntrypoint    = "web.entrypoint"
 	WebDirectory     = "web.directory"
+	WebStation       = "web.station"
 	WebServerAddress = ":8080"
 )
 
@@ -8,33 +8,86 @@ import (
 )
 
 var defaultConfig = map[string]interface{}{ //nolint:gochecknoglobals
-	configkey.Loglevel:                logrus.InfoLevel,
-	configkey.USBPacketLengthMax:      7, //nolint:gomnd
-	configkey.USBConnectionPort:       "/dev/ttyACM99",
-	configkey.USBConnectionTimeout:    time.Second * 10, //nolint:gomnd
-	configkey.MQTTUseTLS:              true,
-	configkey.MQTTBrokerIP:            "127.0.0.1",
-	configkey.MQTTBrokerPort:          "8883",
-	configkey.MQTTCaCert:              "/etc/raincounter/ssl/client/ca.pem",
-	configkey.MQTTClientCert:          "/etc/raincounter/ssl/client/client.crt",
-	configkey.MQTTClientKey:           "/etc/raincounter/ssl/client/client.key",
-	configkey.MQTTConnectionTimeout:   time.Second * 5,   //nolint:gomnd
-	configkey.MQTTQuiescence:          1000,              //nolint:gomnd
-	configkey.MQTTQos:                 1,                 //nolint:gomnd
-	configkey.SensorRainMm:            0.2794,            //nolint:gomnd
-	configkey.AssetStatusDuration:     time.Second * 300, //nolint:gomnd
-	configkey.DatabaseLocalFile:       "/etc/raincounter/rainbase.db",
-	configkey.PGDatabaseName:          "raincounter",
-	configkey.PGPassword:              "password",
-	configkey.PGConnectionTimeout:     time.Second * 10,       //nolint:gomnd
-	configkey.PGConnectionRetryWait:   time.Millisecond * 500, //nolint:gomnd
-	configkey.MessengerStatusInterval: time.Second * 10,       //nolint:gomnd
-	configkey.MainLoopDuration:        time.Second * -10,      //nolint:gomnd
-	configkey.RestScheme:              "http",
-	configkey.RestIP:                  "127.0.0.1",
-	configkey.RestPort:                8080, //nolint:gomnd
-	configkey.RestVersion:             "v1.0",
-	configkey.WebEntrypoint:           "/etc/raincounter/src/index.html",
-	configkey.WebDirectory:            "/etc/raincounter/src",
-	configkey.WebServerAddress:        "localhost:8080",
+	configkey.Loglevel:                    logrus.InfoLevel,
+	configkey.USBPacketLengthMax:          15, //nolint:gomnd
+	configkey.USBConnectionPort:           "/dev/ttyACM99",
+	configkey.USBConnectionTimeout:        time.Second * 10, //nolint:gomnd
+	configkey.MQTTUseTLS:                  true,
+	configkey.MQTTBrokers:                 []string{},
+	configkey.MQTTBrokerIP:                "127.0.0.1",
+	configkey.MQTTBrokerPort:              0,
+	configkey.MQTTBrokerName:              "",
+	configkey.MQTTCaCert:                  "/etc/raincounter/ssl/client/ca.pem",
+	configkey.MQTTClientCert:              "/etc/raincounter/ssl/client/client.crt",
+	configkey.MQTTClientKey:               "/etc/raincounter/ssl/client/client.key",
+	configkey.MQTTConnectionTimeout:       time.Second * 5, //nolint:gomnd
+	configkey.MQTTQuiescence:              1000,            //nolint:gomnd
+	configkey.MQTTQos:                     1,               //nolint:gomnd
+	configkey.MQTTClientID:                "",
+	configkey.MQTTUsername:                "",
+	configkey.MQTTPasswordFile:            "",
+	configkey.MQTTPasswordEnv:             "RAINCOUNTER_MQTT_PASSWORD",
+	configkey.MQTTCleanSession:            false,
+	configkey.MQTTSessionStore:            "/etc/raincounter/mqtt",
+	configkey.MQTTCertExpiryWarning:       time.Hour * 24 * 30, //nolint:gomnd
+	configkey.MQTTConnectRetryInterval:    time.Second * 10,    //nolint:gomnd
+	configkey.StationID:                   "default",
+	configkey.SensorID:                    "raingauge",
+	configkey.SensorRainMm:                0.2794,            //nolint:gomnd
+	configkey.SensorTemperatureInterval:   time.Second * 3,   //nolint:gomnd
+	configkey.SensorStaleIntervals:        3,                 //nolint:gomnd
+	configkey.SensorDownIntervals:         10,                //nolint:gomnd
+	configkey.AssetStatusDuration:         time.Second * 300, //nolint:gomnd
+	configkey.FilterTipInterval:           time.Second / 4,   //nolint:gomnd
+	configkey.FilterTipRateMax:            500,               //nolint:gomnd
+	configkey.FilterTipRateWindow:         time.Minute,
+	configkey.FilterTemperatureWindow:     5,   //nolint:gomnd
+	configkey.FilterTemperatureRateMax:    2.0, //nolint:gomnd
+	configkey.FilterTemperatureMin:        -40, //nolint:gomnd
+	configkey.FilterTemperatureMax:        60,  //nolint:gomnd
+	configkey.GatewayThermalZone:          "/sys/class/thermal/thermal_zone0/temp",
+	configkey.DatabaseLocalFile:           "/etc/raincounter/rainbase.db",
+	configkey.DatabaseLocalPersist:        true,
+	configkey.DatabaseLocalRetention:      7, //nolint:gomnd
+	configkey.DatabaseLocalMaintenance:    time.Hour,
+	configkey.DatabaseLocalVacuum:         time.Hour * 24, //nolint:gomnd
+	configkey.PGDatabaseName:              "raincounter",
+	configkey.PGPassword:                  "password",
+	configkey.PGConnectionTimeout:         time.Second * 10,       //nolint:gomnd
+	configkey.PGConnectionRetryWait:       time.Millisecond * 500, //nolint:gomnd
+	configkey.MessengerStatusInterval:     time.Second * 10,       //nolint:gomnd
+	configkey.MessengerOutboxInterval:     time.Second * 10,       //nolint:gomnd
+	configkey.MessengerPublishTimeout:     time.Second * 30,       //nolint:gomnd
+	configkey.MainLoopDuration:            time.Second * -10,      //nolint:gomnd
+	configkey.MessengerRateInterval:       time.Minute,
+	configkey.MessengerTelemetryInterval:  time.Minute * 5, //nolint:gomnd
+	configkey.SupervisorBackoffMin:        time.Second,
+	configkey.SupervisorBackoffMax:        time.Minute,
+	configkey.DiagnosticsAddress:          "",
+	configkey.ExportFrom:                  "",
+	configkey.ExportTo:                    "",
+	configkey.ExportFormat:                "csv",
+	configkey.ExportSensor:                "",
+	configkey.SimulateLink:                "",
+	configkey.SimulateFraming:             1,
+	configkey.SimulateStormProfile:        defaultStormProfile,
+	configkey.SimulateTemperatureInterval: time.Second * 3,  //nolint:gomnd
+	configkey.SimulateTemperatureBase:     20,               //nolint:gomnd
+	configkey.SimulateEventInterval:       time.Minute * 30, //nolint:gomnd
+	configkey.RestScheme:                  "http",
+	configkey.RestIP:                      "127.0.0.1",
+	configkey.RestPort:                    8080, //nolint:gomnd
+	configkey.RestVersion:                 "v1.0",
+	configkey.WebEntrypoint:               "/etc/raincounter/src/index.html",
+	configkey.WebDirectory:                "/etc/raincounter/src",
+	configkey.WebStation:                  "",
+	configkey.WebServerAddress:            "localhost:8080",
+}
+
+// a dry spell, a steady rain, a downpour and a tail-off
+var defaultStormProfile = []map[string]interface{}{ //nolint:gochecknoglobals
+	{"duration": "10m", "rate": 0},
+	{"duration": "20m", "rate": 5},
+	{"duration": "5m", "rate": 40},
+	{"duration": "15m", "rate": 2},
 }
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/spf13/viper"
+)
+
+// Sensor is a single rain gauge attached to the rainbase
+type Sensor struct {
+	ID   string  // unique name for the gauge, sent with every measurement
+	Port string  // serial port the gauge is plugged into
+	Mm   float64 // millimeters of rain per tip of the bucket
+}
+
+// IDs end up in SQL and MQTT topics, so keep them simple
+var validID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`) //nolint:gochecknoglobals
+
+// StationID reads the name this rainbase publishes under, shared by all of its sensors
+func StationID() (string, error) {
+	id := viper.GetString(configkey.StationID)
+	if !validID.MatchString(id) {
+		return "", fmt.Errorf("station ID `%s` must be letters, numbers, dashes or underscores", id)
+	}
+	return id, nil
+}
+
+// Sensors reads the list of gauges from config, falling back to a single gauge on usb.connection.port
+func Sensors() ([]Sensor, error) {
+	var sensors []Sensor
+	if viper.IsSet(configkey.Sensors) {
+		if err := viper.UnmarshalKey(configkey.Sensors, &sensors); err != nil {
+			return nil, fmt.Errorf("bad `%s` config: %s", configkey.Sensors, err)
+		}
+	} else {
+		sensors = []Sensor{{
+			ID:   viper.GetString(configkey.SensorID),
+			Port: viper.GetString(configkey.USBConnectionPort),
+			Mm:   viper.GetFloat64(configkey.SensorRainMm),
+		}}
+	}
+	if len(sensors) == 0 {
+		return nil, fmt.Errorf("no sensors configured in `%s`", configkey.Sensors)
+	}
+
+	seen := make(map[string]bool)
+	for i := range sensors {
+		sensor := &sensors[i]
+		if !validID.MatchString(sensor.ID) {
+			return nil, fmt.Errorf("sensor ID `%s` must be letters, numbers, dashes or underscores", sensor.ID)
+		}
+		if seen[sensor.ID] {
+			return nil, fmt.Errorf("sensor ID `%s` is used more than once", sensor.ID)
+		}
+		seen[sensor.ID] = true
+		if sensor.Port == "" {
+			return nil, fmt.Errorf("sensor `%s` has no port", sensor.ID)
+		}
+		// calibration is optional per sensor
+		if sensor.Mm == 0 {
+			sensor.Mm = viper.GetFloat64(configkey.SensorRainMm)
+		}
+		if sensor.Mm < 0 {
+			return nil, fmt.Errorf("sensor `%s` has negative calibration %f", sensor.ID, sensor.Mm)
+		}
+	}
+	return sensors, nil
+}
@@ -0,0 +1,5 @@
+package config
+
+// Version of the software, set at build time with
+// -ldflags "-X github.com/ntbloom/raincounter/pkg/config.Version=..."
+var Version = "dev" //nolint:gochecknoglobals
@@ -0,0 +1,117 @@
+// Package diagnostics serves the health of the rainbase over HTTP, so it can be checked on site without SSH
+package diagnostics
+
+import (
+	_ "embed" // status page template
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed status.html
+var statusPage string //nolint:gochecknoglobals
+
+var statusTemplate = template.Must(template.New("status").Parse(statusPage)) //nolint:gochecknoglobals
+
+// Status is everything the diagnostics page shows
+type Status struct {
+	StationID string
+	Version   string
+	Uptime    float64 // seconds the rainbase has been running
+	MQTT      MQTTStatus
+	Sensors   []SensorStatus
+	Timestamp time.Time
+}
+
+// MQTTStatus is the state of the connection to the broker
+type MQTTStatus struct {
+	Connected     bool
+	Broker        string // broker we last connected to
+	Reconnects    uint64
+	OutboxPending int // messages waiting for the broker to acknowledge them
+}
+
+// SensorStatus is the state of one gauge and its serial port
+type SensorStatus struct {
+	ID            string
+	Port          string
+	PortOK        bool // whether the port exists
+	State         string
+	Reason        string
+	LastPacket    *time.Time // nil if no packet since startup
+	LastPacketAge float64    // seconds, -1 if no packet since startup
+	LastTag       int
+	FramingErrors uint64
+	SequenceGaps  uint64
+	TipsToday     int
+	RainTodayMm   float64
+}
+
+// Server is an optional HTTP listener with the rainbase status as JSON and as a small HTML page
+type Server struct {
+	server  *http.Server
+	collect func() Status // snapshot of the rainbase, called on every request
+}
+
+// NewServer makes a Server listening on address. Call Start to serve.
+func NewServer(address string, collect func() Status) *Server {
+	mux := http.NewServeMux()
+	s := &Server{
+		server: &http.Server{
+			Addr:              address,
+			Handler:           mux,
+			ReadHeaderTimeout: time.Second * 5, //nolint:gomnd
+		},
+		collect: collect,
+	}
+	mux.HandleFunc("/status.json", s.serveJSON)
+	mux.HandleFunc("/", s.serveHTML)
+	return s
+}
+
+// Handler routes requests to the status pages
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Start listens in the background until Stop is called
+func (s *Server) Start() {
+	logrus.Infof("serving diagnostics on %s", s.server.Addr)
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("diagnostics server stopped: %s", err)
+		}
+	}()
+}
+
+// Stop closes the listener
+func (s *Server) Stop() {
+	logrus.Info("stopping diagnostics server")
+	if err := s.server.Close(); err != nil {
+		logrus.Errorf("problem closing diagnostics server: %s", err)
+	}
+}
+
+func (s *Server) serveJSON(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.collect()); err != nil {
+		logrus.Errorf("error writing diagnostics: %s", err)
+	}
+}
+
+func (s *Server) serveHTML(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, s.collect()); err != nil {
+		logrus.Errorf("error writing diagnostics page: %s", err)
+	}
+}
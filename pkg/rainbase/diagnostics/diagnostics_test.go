@@ -0,0 +1,69 @@
+package diagnostics_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/rainbase/diagnostics"
+)
+
+func sampleStatus() diagnostics.Status {
+	last := time.Now().Add(time.Second * -2)
+	return diagnostics.Status{
+		StationID: "home",
+		Version:   "dev",
+		Uptime:    60,
+		MQTT:      diagnostics.MQTTStatus{Connected: true, Reconnects: 1, OutboxPending: 3},
+		Sensors: []diagnostics.SensorStatus{
+			{ID: "north", Port: "/dev/ttyACM0", PortOK: true, State: "up", LastPacket: &last, LastPacketAge: 2, TipsToday: 4, RainTodayMm: 1.1176},
+			{ID: "south", Port: "/dev/ttyACM1", State: "down", Reason: "port `/dev/ttyACM1` is missing", LastPacketAge: -1},
+		},
+		Timestamp: time.Now(),
+	}
+}
+
+// the json page has everything the collector reported
+func TestStatusJSON(t *testing.T) {
+	handler := diagnostics.NewServer("", sampleStatus).Handler()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status.json", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", recorder.Code)
+	}
+	var status diagnostics.Status
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.StationID != "home" || !status.MQTT.Connected || status.MQTT.OutboxPending != 3 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if len(status.Sensors) != 2 || status.Sensors[0].TipsToday != 4 || status.Sensors[1].LastPacket != nil {
+		t.Errorf("unexpected sensors %+v", status.Sensors)
+	}
+}
+
+// the html page renders every sensor, and nothing else is served
+func TestStatusPage(t *testing.T) {
+	handler := diagnostics.NewServer("", sampleStatus).Handler()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", recorder.Code)
+	}
+	page := recorder.Body.String()
+	for _, expected := range []string{"rainbase home", "north", "1.12 mm (4 tips)", "south", "is missing", "connected"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected `%s` on the status page", expected)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown page, got %d", recorder.Code)
+	}
+}
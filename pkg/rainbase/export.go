@@ -0,0 +1,64 @@
+package rainbase
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/ntbloom/raincounter/pkg/rainbase/localdb"
+	"github.com/spf13/viper"
+)
+
+// Export writes the local log to stdout, for getting data off the rainbase when the cloud is out of reach
+func Export(_ []string) error {
+	from, err := parseExportTime(viper.GetString(configkey.ExportFrom), time.Time{})
+	if err != nil {
+		return err
+	}
+	to, err := parseExportTime(viper.GetString(configkey.ExportTo), time.Now())
+	if err != nil {
+		return err
+	}
+	if !to.After(from) {
+		return fmt.Errorf("export ends at %s, before it starts at %s", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+
+	// tips are converted with the calibration of each sensor
+	sensors, err := config.Sensors()
+	if err != nil {
+		return err
+	}
+	mmPerTip := make(map[string]float64)
+	for _, sensor := range sensors {
+		mmPerTip[sensor.ID] = sensor.Mm
+	}
+
+	// read the database as it is, the rainbase may be running and it's the one that looks after it
+	db, err := localdb.OpenReadOnly(viper.GetString(configkey.DatabaseLocalFile))
+	if err != nil {
+		return fmt.Errorf("unable to open the local database to export: %w", err)
+	}
+	defer db.Close()
+	if sensor := viper.GetString(configkey.ExportSensor); sensor != "" {
+		db = db.ForSensor(sensor)
+	}
+	format := viper.GetString(configkey.ExportFormat)
+	return db.Export(os.Stdout, format, from, to, mmPerTip, viper.GetFloat64(configkey.SensorRainMm))
+}
+
+// read a date in local time or an RFC3339 timestamp, or use a fallback if it's empty
+func parseExportTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if stamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return stamp, nil
+	}
+	stamp, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time `%s`, expected a date like 2006-01-02 or an RFC3339 time", value)
+	}
+	return stamp, nil
+}
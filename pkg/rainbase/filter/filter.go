@@ -0,0 +1,150 @@
+// Package filter sits between the serial port and the messenger, dropping or flagging packets that
+// can't be real
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+	"github.com/spf13/viper"
+)
+
+// temperature quality, published with every temperature that isn't dropped
+const (
+	QualityGood     = "good"         // the median of recent readings
+	QualityLimited  = "rate-limited" // moving faster than the air can, so held back
+	QualityRejected = "rejected"     // out of bounds, so dropped
+)
+
+// Reading is a packet after it's been through the filter
+type Reading struct {
+	Packet  *tlv.TLV
+	Time    time.Time // when the packet arrived
+	Value   float64   // the value to record and publish, smoothed for temperature
+	Quality string    // how far to trust a temperature, empty for anything else
+	Drop    bool      // not real, so only keep it for the audit
+	Flag    string    // why the reading was dropped or is suspect, empty if it's fine
+}
+
+// Filter checks the packets from one sensor
+type Filter struct {
+	tips  *tips
+	temps *temperatures
+}
+
+// New makes a filter for a sensor, configured from viper
+func New(sensor config.Sensor) *Filter {
+	return &Filter{
+		tips: &tips{
+			minInterval: viper.GetDuration(configkey.FilterTipInterval),
+			maxRate:     viper.GetFloat64(configkey.FilterTipRateMax),
+			window:      viper.GetDuration(configkey.FilterTipRateWindow),
+			mmPerTip:    sensor.Mm,
+		},
+		temps: &temperatures{
+			size:    viper.GetInt(configkey.FilterTemperatureWindow),
+			maxRate: viper.GetFloat64(configkey.FilterTemperatureRateMax),
+			minC:    viper.GetFloat64(configkey.FilterTemperatureMin),
+			maxC:    viper.GetFloat64(configkey.FilterTemperatureMax),
+		},
+	}
+}
+
+// Apply decides what to do with a packet that arrived at now
+func (f *Filter) Apply(packet *tlv.TLV, now time.Time) Reading {
+	reading := Reading{Packet: packet, Time: now, Value: float64(packet.Value)}
+	switch packet.Tag {
+	case tlv.Rain:
+		reading.Drop, reading.Flag = f.tips.check(now)
+	case tlv.Temperature:
+		reading.Value, reading.Quality, reading.Drop, reading.Flag = f.temps.check(float64(packet.Value), now)
+	}
+	return reading
+}
+
+// tips drops reed switch bounces and flags rain coming down faster than the bucket can really tip
+type tips struct {
+	minInterval time.Duration // tips closer together than this are bounces, 0 to keep them all
+	maxRate     float64       // mm/h the bucket can physically measure, 0 for no limit
+	window      time.Duration // how far back to look when working out the rate
+	mmPerTip    float64
+	accepted    []time.Time // tips that weren't bounces, within the window
+}
+
+func (t *tips) check(now time.Time) (drop bool, flag string) {
+	if n := len(t.accepted); n > 0 && t.minInterval > 0 && now.Sub(t.accepted[n-1]) < t.minInterval {
+		return true, fmt.Sprintf("bounce %s after the last tip", now.Sub(t.accepted[n-1]).Round(time.Millisecond))
+	}
+
+	// forget tips that have left the window
+	kept := t.accepted[:0]
+	for _, tip := range t.accepted {
+		if now.Sub(tip) < t.window {
+			kept = append(kept, tip)
+		}
+	}
+	t.accepted = append(kept, now)
+
+	if t.maxRate <= 0 || t.window <= 0 {
+		return false, ""
+	}
+	rate := float64(len(t.accepted)) * t.mmPerTip / t.window.Hours()
+	if rate > t.maxRate {
+		return false, fmt.Sprintf("rate %.0f mm/h is above the %.0f mm/h the bucket can measure", rate, t.maxRate)
+	}
+	return false, ""
+}
+
+// temperatures smooths out a loose wire: readings out of bounds are dropped, the rest are the median
+// of the last few, and the result can only move so fast
+type temperatures struct {
+	size     int       // how many readings to take the median of, 1 for none
+	maxRate  float64   // degrees C per minute the temperature can change, 0 for no limit
+	minC     float64   // coldest believable reading
+	maxC     float64   // warmest believable reading
+	window   []float64 // recent readings within bounds
+	last     float64   // last temperature we gave out
+	lastTime time.Time // when we gave it out, zero if we haven't
+}
+
+func (t *temperatures) check(raw float64, now time.Time) (value float64, quality string, drop bool, flag string) {
+	if raw < t.minC || raw > t.maxC {
+		// don't publish it at all, the last good temperature still stands
+		return raw, QualityRejected, true, fmt.Sprintf("%.1fC is outside %.1fC to %.1fC", raw, t.minC, t.maxC)
+	}
+
+	t.window = append(t.window, raw)
+	if len(t.window) > t.size && t.size > 0 {
+		t.window = t.window[len(t.window)-t.size:]
+	}
+	value, quality = median(t.window), QualityGood
+
+	if !t.lastTime.IsZero() && t.maxRate > 0 {
+		limit := t.maxRate * now.Sub(t.lastTime).Minutes()
+		switch {
+		case value > t.last+limit:
+			flag = fmt.Sprintf("%.1fC rose faster than %.1fC/min", value, t.maxRate)
+			value, quality = t.last+limit, QualityLimited
+		case value < t.last-limit:
+			flag = fmt.Sprintf("%.1fC fell faster than %.1fC/min", value, t.maxRate)
+			value, quality = t.last-limit, QualityLimited
+		}
+	}
+	t.last, t.lastTime = value, now
+	return value, quality, false, flag
+}
+
+// the middle of some numbers, or the mean of the middle two
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2 //nolint:gomnd
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2 //nolint:gomnd
+	}
+	return sorted[mid]
+}
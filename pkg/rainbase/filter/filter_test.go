@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+)
+
+// bounces are dropped, and a rate the bucket can't manage is flagged
+func TestTipFilter(t *testing.T) {
+	f := &Filter{tips: &tips{
+		minInterval: time.Millisecond * 250,
+		maxRate:     100,
+		window:      time.Minute,
+		mmPerTip:    0.5,
+	}}
+	rain := &tlv.TLV{Tag: tlv.Rain, Value: tlv.RainValue}
+	start := time.Now()
+
+	if reading := f.Apply(rain, start); reading.Drop || reading.Flag != "" {
+		t.Errorf("first tip should be fine, got %+v", reading)
+	}
+	if reading := f.Apply(rain, start.Add(time.Millisecond*20)); !reading.Drop {
+		t.Error("expected a bounce 20ms later to be dropped")
+	}
+	if reading := f.Apply(rain, start.Add(time.Second)); reading.Drop || reading.Flag != "" {
+		t.Errorf("second tip should be fine, got %+v", reading)
+	}
+
+	// 100 mm/h over a minute is 3.33 tips of 0.5mm
+	flagged := false
+	for i := 2; i < 5; i++ {
+		reading := f.Apply(rain, start.Add(time.Second*time.Duration(i)))
+		if reading.Drop {
+			t.Errorf("tip %d shouldn't be dropped", i)
+		}
+		flagged = reading.Flag != ""
+	}
+	if !flagged {
+		t.Error("expected 5 tips in a minute to be flagged")
+	}
+
+	// once the storm has passed the rate is fine again
+	if reading := f.Apply(rain, start.Add(time.Minute*5)); reading.Flag != "" {
+		t.Errorf("expected a lone tip to be fine, got %s", reading.Flag)
+	}
+
+	// events go straight through
+	pause := &tlv.TLV{Tag: tlv.Pause, Value: tlv.PauseValue}
+	if reading := f.Apply(pause, start.Add(time.Minute*5)); reading.Drop || reading.Flag != "" {
+		t.Errorf("events shouldn't be filtered, got %+v", reading)
+	}
+}
+
+// spikes from a loose wire are smoothed, limited or thrown out
+func TestTemperatureFilter(t *testing.T) {
+	f := &Filter{temps: &temperatures{size: 3, maxRate: 2, minC: -40, maxC: 60}}
+	start := time.Now()
+	apply := func(tempC int, after time.Duration) Reading {
+		return f.Apply(&tlv.TLV{Tag: tlv.Temperature, Value: tempC}, start.Add(after))
+	}
+
+	// nothing to go on yet, so an impossible first reading is dropped
+	if reading := apply(125, 0); !reading.Drop || reading.Quality != QualityRejected {
+		t.Errorf("expected out of bounds first reading to be dropped, got %+v", reading)
+	}
+	if reading := apply(20, time.Second); reading.Value != 20 || reading.Quality != QualityGood {
+		t.Errorf("expected a good 20C, got %+v", reading)
+	}
+
+	// a spike inside the bounds is outvoted by the median, then held to the rate limit
+	apply(20, time.Minute)
+	if reading := apply(55, time.Minute*2); reading.Value != 20 || reading.Quality != QualityGood {
+		t.Errorf("expected the median to hide a single spike, got %+v", reading)
+	}
+	if reading := apply(30, time.Minute*3); reading.Value != 22 || reading.Quality != QualityLimited || reading.Flag == "" {
+		t.Errorf("expected a jump to 30C to be limited to 22C, got %+v", reading)
+	}
+	if reading := apply(30, time.Minute*4); reading.Value != 24 || reading.Quality != QualityLimited {
+		t.Errorf("expected 24C a minute later, got %+v", reading)
+	}
+
+	// out of bounds is dropped without disturbing the good readings
+	if reading := apply(-80, time.Minute*5); !reading.Drop || reading.Quality != QualityRejected || reading.Flag == "" {
+		t.Errorf("expected out of bounds reading to be dropped, got %+v", reading)
+	}
+	if reading := apply(30, time.Minute*6); reading.Value != 28 || reading.Quality != QualityLimited {
+		t.Errorf("expected 28C two minutes after the last good reading, got %+v", reading)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	for _, check := range []struct {
+		values []float64
+		median float64
+	}{
+		{[]float64{3}, 3},
+		{[]float64{3, 1, 2}, 2},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	} {
+		if actual := median(check.values); actual != check.median {
+			t.Errorf("expected median %f of %v, got %f", check.median, check.values, actual)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package localdb
+
+// Get the log back out of the rainbase in a readable form, for when the cloud is out of reach
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+)
+
+// export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// Export writes the log entries from one time up to another as csv or ndjson. Rain tips keep the calibration
+// they were recorded with; older tips without one use mmPerTip for their sensor, or defaultMm.
+func (db *LocalDB) Export(w io.Writer, format string, from, to time.Time, mmPerTip map[string]float64, defaultMm float64) error {
+	if format != ExportCSV && format != ExportNDJSON {
+		return fmt.Errorf("unsupported export format `%s`, expected %s or %s", format, ExportCSV, ExportNDJSON)
+	}
+	records, err := db.Records(from, to)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		if records[i].Tag != tlv.Rain || records[i].Millimeters != nil {
+			continue
+		}
+		mm, ok := mmPerTip[records[i].Sensor]
+		if !ok {
+			mm = defaultMm
+		}
+		records[i].Millimeters = &mm
+	}
+	if format == ExportNDJSON {
+		return writeNDJSON(w, records)
+	}
+	return writeCSV(w, records)
+}
+
+func writeNDJSON(w io.Writer, records []Record) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, records []Record) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"timestamp", "sensor", "tag", "name", "value", "millimeters"}); err != nil {
+		return err
+	}
+	for _, record := range records {
+		mm := ""
+		if record.Millimeters != nil {
+			mm = strconv.FormatFloat(*record.Millimeters, 'f', -1, 64)
+		}
+		row := []string{
+			record.Timestamp.Format(time.RFC3339),
+			record.Sensor,
+			strconv.Itoa(record.Tag),
+			record.Name,
+			strconv.FormatFloat(record.Value, 'f', -1, 64),
+			mm,
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
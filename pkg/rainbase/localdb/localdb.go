@@ -7,13 +7,15 @@ import (
 	"time"
 
 	"github.com/ntbloom/raincounter/pkg/common/database"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
 
 	"github.com/sirupsen/logrus"
 	_ "modernc.org/sqlite" // Driver for localdb
 )
 
 type LocalDB struct {
-	lite *database.Sqlite
+	lite   *database.Sqlite
+	sensor string // records are written and read for this sensor only, or all sensors if empty
 }
 
 func NewLocalDB(fulPath string, clobber bool) (*LocalDB, error) {
@@ -22,7 +24,94 @@ func NewLocalDB(fulPath string, clobber bool) (*LocalDB, error) {
 		logrus.Error(err)
 		return nil, err
 	}
-	return &LocalDB{lite}, nil
+	db := &LocalDB{lite, ""}
+	if err = db.migrate(); err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenReadOnly opens an existing database just for reading, e.g. to export it while the rainbase is running.
+// Nothing is created or migrated, so it has to be at the current schema already.
+func OpenReadOnly(fullPath string) (*LocalDB, error) {
+	lite, err := database.OpenSqliteReadOnly(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &LocalDB{lite, ""}
+	if version := db.GetSingleInt(`PRAGMA user_version;`); version != schemaVersion {
+		db.Close()
+		return nil, fmt.Errorf("`%s` is at schema version %d, not %d; run the rainbase once to upgrade it",
+			fullPath, version, schemaVersion)
+	}
+	return db, nil
+}
+
+// bring a database kept from an older version up to the current schema
+func (db *LocalDB) migrate() error {
+	version := db.GetSingleInt(`PRAGMA user_version;`)
+	if version < 0 {
+		return fmt.Errorf("unable to read the schema version")
+	}
+	if version < 1 {
+		// the sensor and the outbox came before the schema had a version, so a database without one may have
+		// them already
+		if !db.hasColumn("log", "sensor") {
+			logrus.Info("adding sensors to the local database")
+			if _, err := db.lite.EnterData(`ALTER TABLE log ADD COLUMN sensor TEXT NOT NULL DEFAULT '';`); err != nil {
+				return err
+			}
+		}
+		if !db.hasTable("outbox") {
+			logrus.Info("adding the outbox to the local database")
+			if _, err := db.lite.EnterData(outboxTable); err != nil {
+				return err
+			}
+		}
+	}
+	if version < 2 { //nolint:gomnd
+		// values were INTEGER, but sqlite keeps REALs in an INTEGER column as long as they aren't whole
+		logrus.Info("adding rain calibration to the local database")
+		if _, err := db.lite.EnterData(`ALTER TABLE log ADD COLUMN mm REAL;`); err != nil {
+			return err
+		}
+	}
+	if version < 3 { //nolint:gomnd
+		logrus.Info("adding the filter audit to the local database")
+		if _, err := db.lite.EnterData(filteredTable); err != nil {
+			return err
+		}
+	}
+	if version < 4 { //nolint:gomnd
+		logrus.Info("adding raw temperature to the local database")
+		if _, err := db.lite.EnterData(`ALTER TABLE log ADD COLUMN raw REAL; ALTER TABLE log ADD COLUMN quality TEXT;`); err != nil {
+			return err
+		}
+	}
+	if version != schemaVersion {
+		_, err := db.lite.EnterData(fmt.Sprintf(`PRAGMA user_version = %d;`, schemaVersion))
+		return err
+	}
+	return nil
+}
+
+func (db *LocalDB) hasTable(table string) bool {
+	return db.GetSingleInt(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, table) > 0
+}
+
+func (db *LocalDB) hasColumn(table, column string) bool {
+	return db.GetSingleInt(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;`, table, column) > 0
+}
+
+// Close finishes any queued writes and closes the database
+func (db *LocalDB) Close() {
+	db.lite.Close()
+}
+
+// ForSensor gives a view of the same database that records and reads entries for a single sensor
+func (db *LocalDB) ForSensor(id string) *LocalDB {
+	return &LocalDB{db.lite, id}
 }
 
 func (db *LocalDB) MakeSchema() (sql.Result, error) {
@@ -35,32 +124,71 @@ func (db *LocalDB) EnterData(cmd string) (sql.Result, error) {
 
 func (db *LocalDB) AddIntRecord(tag, value int) (sql.Result, error) {
 	timestamp := time.Now().Format(time.RFC3339)
-	cmd := fmt.Sprintf("INSERT INTO log (tag, value, timestamp) VALUES (%d, %d, \"%s\");", tag, value, timestamp)
-	return db.lite.EnterData(cmd)
+	cmd := `INSERT INTO log (sensor, tag, value, timestamp) VALUES (?, ?, ?, ?);`
+	return db.lite.EnterData(cmd, db.sensor, tag, value, timestamp)
 }
 
+// AddFloatRecord makes an entry with a real value, e.g. a fractional temperature
 func (db *LocalDB) AddFloatRecord(tag int, value float64) (sql.Result, error) {
-	panic("float not implemented on the rainbase")
+	timestamp := time.Now().Format(time.RFC3339)
+	cmd := `INSERT INTO log (sensor, tag, value, timestamp) VALUES (?, ?, ?, ?);`
+	return db.lite.EnterData(cmd, db.sensor, tag, value, timestamp)
+}
+
+// AddRainRecord makes an entry for a tip of the bucket along with the millimeters per tip at the time,
+// so totals stay right if the calibration changes later
+func (db *LocalDB) AddRainRecord(mm float64) (sql.Result, error) {
+	timestamp := time.Now().Format(time.RFC3339)
+	cmd := `INSERT INTO log (sensor, tag, value, mm, timestamp) VALUES (?, ?, ?, ?, ?);`
+	return db.lite.EnterData(cmd, db.sensor, tlv.Rain, tlv.RainValue, mm, timestamp)
+}
+
+// AddTemperatureRecord makes a temperature entry with the filtered value, the raw reading it came from and
+// how far to trust it
+func (db *LocalDB) AddTemperatureRecord(value, raw float64, quality string) (sql.Result, error) {
+	timestamp := time.Now().Format(time.RFC3339)
+	cmd := `INSERT INTO log (sensor, tag, value, raw, quality, timestamp) VALUES (?, ?, ?, ?, ?, ?);`
+	return db.lite.EnterData(cmd, db.sensor, tlv.Temperature, value, raw, quality, timestamp)
+}
+
+// AddFiltered keeps a record of a packet the filter dropped or flagged, and why
+func (db *LocalDB) AddFiltered(tag int, value float64, reason string, dropped bool) (sql.Result, error) {
+	timestamp := time.Now().Format(time.RFC3339)
+	cmd := `INSERT INTO filtered (sensor, tag, value, reason, dropped, timestamp) VALUES (?, ?, ?, ?, ?, ?);`
+	return db.lite.EnterData(cmd, db.sensor, tag, value, reason, dropped, timestamp)
 }
 
+// Tally counts the records for a tag, or -1 on error
 func (db *LocalDB) Tally(tag int) int {
-	query := fmt.Sprintf("SELECT COUNT(*) FROM log WHERE tag = %d;", tag)
-	return db.GetSingleInt(query)
+	query := `SELECT COUNT(*) FROM log WHERE tag = ? AND ` + sensorClause + `;`
+	return db.GetSingleInt(query, tag, db.sensor, db.sensor)
+}
+
+// TallySince counts the records for a tag from a time onward, e.g. tips of the bucket today
+func (db *LocalDB) TallySince(tag int, since time.Time) int {
+	query := `SELECT COUNT(*) FROM log WHERE tag = ? AND datetime(timestamp) >= datetime(?) AND ` + sensorClause + `;`
+	return db.GetSingleInt(query, tag, since.Format(time.RFC3339), db.sensor, db.sensor)
 }
 
+// GetLastRecord gets the value of the newest record for a tag, or -1 if there isn't one
 func (db *LocalDB) GetLastRecord(tag int) int {
-	cmd := fmt.Sprintf(`SELECT value FROM log WHERE tag = %d ORDER BY id DESC LIMIT 1;`, tag)
-	return db.GetSingleInt(cmd)
+	query := `SELECT value FROM log WHERE tag = ? AND ` + sensorClause + ` ORDER BY id DESC LIMIT 1;`
+	return db.GetSingleInt(query, tag, db.sensor, db.sensor)
 }
 
-func (db *LocalDB) GetSingleInt(query string) int {
+// GetSingleInt returns the first integer from a query, binding args to its placeholders, or -1 on error or
+// if there are no results
+func (db *LocalDB) GetSingleInt(query string, args ...interface{}) int {
 	var rows *sql.Rows
 	var err error
 
-	c, _ := db.lite.Connect() // don't handle the error, just return -1
+	c, err := db.lite.Connect()
+	if err != nil {
+		return -1
+	}
 	defer c.Disconnect()
 
-	if rows, err = c.Conn.QueryContext(context.Background(), query); err != nil {
+	if rows, err = c.Conn.QueryContext(context.Background(), query, args...); err != nil {
 		return -1
 	}
 	closed := func() {
@@ -78,7 +206,10 @@ func (db *LocalDB) GetSingleInt(query string) int {
 		}
 		results = append(results, val)
 	}
-
+	if len(results) == 0 {
+		logrus.Debugf("no results for `%s`", query)
+		return -1
+	}
 	return results[0]
 }
 
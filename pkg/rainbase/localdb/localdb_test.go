@@ -1,12 +1,21 @@
 package localdb_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"math"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/ntbloom/raincounter/pkg/rainbase/localdb"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
 
 	"github.com/ntbloom/raincounter/pkg/common/database"
 
@@ -164,3 +173,434 @@ func TestSqliteTemperatureEntries(t *testing.T) {
 	db := sqliteConnectionFixture()
 	testTemperatureEntries(db, t)
 }
+
+// messages stay in the outbox until they're marked delivered, and come back out in order
+func TestSqliteOutbox(t *testing.T) {
+	db := sqliteConnectionFixture()
+	topics := []string{"first", "second", "third"}
+	ids := make([]int64, 0)
+	for _, topic := range topics {
+		id, err := db.AddOutboxEntry(topic, 1, false, []byte(`{"Timestamp":"2021-09-20T22:16:34-04:00"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.MarkDelivered(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.GetUndelivered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || db.OutboxPending() != 2 {
+		t.Fatalf("expected 2 undelivered entries, got %d", len(entries))
+	}
+	if entries[0].Topic != topics[0] || entries[1].Topic != topics[2] {
+		logrus.Errorf("outbox out of order: %+v", entries)
+		t.Fail()
+	}
+	if entries[0].Qos != 1 || entries[0].Retained {
+		t.Fail()
+	}
+}
+
+// each sensor only sees its own records, while the shared view sees them all
+func TestSqliteSensors(t *testing.T) {
+	db := sqliteConnectionFixture()
+	north, south := db.ForSensor("north"), db.ForSensor("south")
+	for i := 0; i < 3; i++ {
+		database.MakeRainTallyEntry(north)
+	}
+	database.MakeRainTallyEntry(south)
+	database.MakeTemperatureEntry(north, 12)
+	database.MakeTemperatureEntry(south, 15)
+
+	if tally := database.GetRainEntries(north); tally != 3 {
+		logrus.Errorf("expected 3 entries for north, got %d", tally)
+		t.Fail()
+	}
+	if tally := database.GetRainEntries(south); tally != 1 {
+		logrus.Errorf("expected 1 entry for south, got %d", tally)
+		t.Fail()
+	}
+	if tally := database.GetRainEntries(db); tally != 4 {
+		logrus.Errorf("expected 4 entries in total, got %d", tally)
+		t.Fail()
+	}
+	if tally := north.TallySince(tlv.Rain, time.Now().Add(-time.Hour)); tally != 3 {
+		logrus.Errorf("expected 3 entries for north in the last hour, got %d", tally)
+		t.Fail()
+	}
+	if tally := north.TallySince(tlv.Rain, time.Now().Add(time.Hour)); tally != 0 {
+		logrus.Errorf("expected no entries for north in the future, got %d", tally)
+		t.Fail()
+	}
+	if temp := database.GetLastTemperatureEntry(north); temp != 12 {
+		logrus.Errorf("expected 12C for north, got %d", temp)
+		t.Fail()
+	}
+}
+
+// without clobber, records survive a restart
+func TestSqlitePersists(t *testing.T) {
+	sqliteFile := filepath.Join(t.TempDir(), "rainbase.db")
+	db, err := localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.MakeRainTallyEntry(db)
+
+	db, err = localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tally := database.GetRainEntries(db); tally != 1 {
+		t.Errorf("expected rain to survive reopening, got %d entries", tally)
+	}
+	if err = db.IntegrityCheck(); err != nil {
+		t.Error(err)
+	}
+}
+
+// a corrupt database is moved aside and replaced with an empty one
+func TestSqliteCorruptRebuild(t *testing.T) {
+	dir := t.TempDir()
+	sqliteFile := filepath.Join(dir, "rainbase.db")
+	if err := os.WriteFile(sqliteFile, []byte("this is not a sqlite database, not even close"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tally := database.GetRainEntries(db); tally != 0 {
+		t.Errorf("expected a fresh database, got %d entries", tally)
+	}
+	corrupt, _ := filepath.Glob(sqliteFile + ".corrupt-*")
+	if len(corrupt) != 1 {
+		t.Errorf("expected the corrupt database to be kept, found %v", corrupt)
+	}
+}
+
+// pruning drops old temperature and delivered messages but keeps rain and anything undelivered
+func TestSqlitePrune(t *testing.T) {
+	db := sqliteConnectionFixture()
+	database.MakeRainTallyEntry(db)
+	database.MakePauseEntry(db)
+	database.MakeTemperatureEntry(db, 20)
+	sent, _ := db.AddOutboxEntry("sent", 1, false, []byte("{}"))
+	_, _ = db.AddOutboxEntry("waiting", 1, false, []byte("{}"))
+	if err := db.MarkDelivered(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is old enough yet
+	if deleted, err := db.Prune(context.Background(), time.Now().Add(-time.Hour)); err != nil || deleted != 0 {
+		t.Errorf("expected nothing pruned, got %d: %v", deleted, err)
+	}
+	if deleted, err := db.Prune(context.Background(), time.Now().Add(time.Hour)); err != nil || deleted != 2 {
+		t.Errorf("expected 2 rows pruned, got %d: %v", deleted, err)
+	}
+	if database.GetRainEntries(db) != 1 || database.GetPauseEntries(db) != 1 || db.OutboxPending() != 1 {
+		t.Error("pruned something that should have been kept")
+	}
+	if db.Tally(tlv.Temperature) != 0 {
+		t.Error("old temperature wasn't pruned")
+	}
+	if err := db.Maintain(context.Background(), time.Hour, true); err != nil {
+		t.Error(err)
+	}
+
+	// shutting down skips maintenance that hasn't started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Maintain(ctx, time.Hour, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected maintenance to be cancelled, got %v", err)
+	}
+}
+
+// exports have readable tag names and rain in millimeters from each sensor's calibration
+func TestSqliteExport(t *testing.T) {
+	db := sqliteConnectionFixture()
+	north, south := db.ForSensor("north"), db.ForSensor("south")
+	database.MakeRainTallyEntry(north)
+	database.MakeRainTallyEntry(south)
+	database.MakeTemperatureEntry(north, 21)
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	mmPerTip := map[string]float64{"north": 0.2, "south": 0.5}
+
+	var out bytes.Buffer
+	if err := db.Export(&out, localdb.ExportCSV, from, to, mmPerTip, 0.3); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("expected a header and 3 rows, got %v", rows)
+	}
+	if rows[1][1] != "north" || rows[1][3] != "rain event" || rows[1][5] != "0.2" || rows[2][5] != "0.5" {
+		t.Errorf("bad rain rows %v", rows[1:3])
+	}
+	if rows[3][3] != "temperature" || rows[3][4] != "21" || rows[3][5] != "" {
+		t.Errorf("bad temperature row %v", rows[3])
+	}
+
+	out.Reset()
+	if err = south.Export(&out, localdb.ExportNDJSON, from, to, mmPerTip, 0.3); err != nil {
+		t.Fatal(err)
+	}
+	var record localdb.Record
+	if err = json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Sensor != "south" || record.Millimeters == nil || *record.Millimeters != 0.5 {
+		t.Errorf("bad ndjson record %+v", record)
+	}
+
+	// nothing in the future, and only known formats
+	if records, _ := db.Records(to, to.Add(time.Hour)); len(records) != 0 {
+		t.Errorf("expected no future records, got %d", len(records))
+	}
+	if err = db.Export(&out, "xml", from, to, mmPerTip, 0.3); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+// a read-only database sees what the rainbase writes, but never changes the file or makes a new one
+func TestSqliteReadOnly(t *testing.T) {
+	sqliteFile := filepath.Join(t.TempDir(), "rainbase.db")
+	if _, err := localdb.OpenReadOnly(sqliteFile); err == nil {
+		t.Error("expected an error for a database that doesn't exist")
+	}
+	if _, err := os.Stat(sqliteFile); !os.IsNotExist(err) {
+		t.Errorf("opening read-only made a database: %v", err)
+	}
+
+	db, err := localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database.MakeRainTallyEntry(db)
+	reader, err := localdb.OpenReadOnly(sqliteFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if tally := database.GetRainEntries(reader); tally != 1 {
+		t.Errorf("expected to read the rain entry, got %d", tally)
+	}
+	if _, err = reader.AddIntRecord(tlv.Rain, tlv.RainValue); err == nil {
+		t.Error("wrote to a read-only database")
+	}
+}
+
+// typed queries over a range of time, with errors when there's nothing to answer with
+func TestSqliteQueries(t *testing.T) {
+	db := sqliteConnectionFixture()
+	if _, err := db.EnterData(`INSERT INTO log (sensor, tag, value, timestamp) VALUES
+		('north', 0, 1, '2021-09-20T10:05:00Z'),
+		('north', 0, 1, '2021-09-20T10:40:00Z'),
+		('north', 0, 1, '2021-09-20T12:10:00Z'),
+		('south', 0, 1, '2021-09-20T12:15:00Z'),
+		('north', 1, 18, '2021-09-20T10:00:00Z'),
+		('north', 1, 25, '2021-09-20T13:00:00Z'),
+		('north', 4, 5, '2021-09-20T11:00:00Z');`); err != nil {
+		t.Fatal(err)
+	}
+	north := db.ForSensor("north")
+	from := time.Date(2021, 9, 20, 10, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour * 3)
+
+	if tips, err := north.TipsBetween(from, to); err != nil || tips != 3 {
+		t.Errorf("expected 3 tips for north, got %d: %v", tips, err)
+	}
+	if tips, err := db.TipsBetween(from, from.Add(time.Hour)); err != nil || tips != 2 {
+		t.Errorf("expected 2 tips in the first hour, got %d: %v", tips, err)
+	}
+
+	buckets, err := north.RainBuckets(from, to, localdb.Hourly, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 3 || buckets[0].Tips != 2 || buckets[1].Tips != 0 || buckets[2].Millimeters != 0.5 {
+		t.Errorf("bad hourly buckets %+v", buckets)
+	}
+	buckets, err = db.RainBuckets(from, to, localdb.Daily, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Tips != 4 || !buckets[0].Start.Equal(from.Add(time.Hour*-10)) {
+		t.Errorf("bad daily buckets %+v", buckets)
+	}
+
+	temps, err := north.TemperatureRange(from, to.Add(time.Hour))
+	if err != nil || temps.MinC != 18 || temps.MaxC != 25 || temps.Count != 2 {
+		t.Errorf("bad temperature range %+v: %v", temps, err)
+	}
+	if _, err = db.ForSensor("south").TemperatureRange(from, to); !errors.Is(err, localdb.ErrNoRecords) {
+		t.Errorf("expected no temperature for south, got %v", err)
+	}
+
+	events, err := db.Events(from, to)
+	if err != nil || len(events) != 1 || events[0].Name != "pause" {
+		t.Errorf("bad event history %+v: %v", events, err)
+	}
+	if last, err := north.LastRecord(tlv.Temperature); err != nil || last.Value != 25 {
+		t.Errorf("bad last temperature %+v: %v", last, err)
+	}
+	if _, err = north.LastRecord(tlv.HardReset); !errors.Is(err, localdb.ErrNoRecords) {
+		t.Errorf("expected no hard resets, got %v", err)
+	}
+	if north.GetLastRecord(tlv.HardReset) != -1 {
+		t.Error("expected -1 for a missing record instead of a panic")
+	}
+}
+
+// rain keeps the calibration it was recorded with, and temperature can be fractional
+func TestSqliteCalibratedValues(t *testing.T) {
+	db := sqliteConnectionFixture()
+	database.MakeRainValueEntry(db, 0.2794)
+	database.MakeRainValueEntry(db, 0.3)
+	database.MakeRainTallyEntry(db) // from before calibration was recorded
+	if _, err := db.AddFloatRecord(tlv.Temperature, 21.5); err != nil {
+		t.Fatal(err)
+	}
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	mm, err := db.RainBetween(from, to, 1)
+	if err != nil || math.Abs(mm-1.5794) > 1e-9 {
+		t.Errorf("expected 1.5794 mm, got %f: %v", mm, err)
+	}
+	if tips := database.GetRainEntries(db); tips != 3 {
+		t.Errorf("expected 3 tips, got %d", tips)
+	}
+	temps, err := db.TemperatureRange(from, to)
+	if err != nil || temps.MaxC != 21.5 {
+		t.Errorf("expected 21.5C, got %+v: %v", temps, err)
+	}
+
+	// the filtered temperature is the value, the raw reading is kept alongside
+	if _, err = db.AddTemperatureRecord(22.25, 85, "rate-limited"); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := db.LastRecord(tlv.Temperature); err != nil || last.Value != 22.25 {
+		t.Errorf("expected filtered 22.25C, got %+v: %v", last, err)
+	}
+	if raw := db.GetSingleInt(`SELECT raw FROM log WHERE quality = ?;`, "rate-limited"); raw != 85 {
+		t.Errorf("expected raw 85C, got %d", raw)
+	}
+}
+
+// a database kept from before calibration and the filter audit gets brought up to date
+func TestSqliteMigration(t *testing.T) {
+	sqliteFile := filepath.Join(t.TempDir(), "rainbase.db")
+	db, err := localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.MakeRainTallyEntry(db)
+	if _, err = db.EnterData(`ALTER TABLE log DROP COLUMN mm; ALTER TABLE log DROP COLUMN raw; ALTER TABLE log DROP COLUMN quality;
+		DROP TABLE filtered; PRAGMA user_version = 0;`); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := db.GetSingleInt(`PRAGMA user_version;`); version != 4 {
+		t.Errorf("expected schema version 4, got %d", version)
+	}
+	database.MakeRainValueEntry(db, 0.5)
+	if mm, err := db.RainBetween(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 0.25); err != nil || mm != 0.75 {
+		t.Errorf("expected 0.75 mm, got %f: %v", mm, err)
+	}
+}
+
+// a database from before the schema had a version, with no sensors and no outbox, is brought up to date
+func TestSqliteMigrationFromUnversioned(t *testing.T) {
+	sqliteFile := filepath.Join(t.TempDir(), "rainbase.db")
+	lite, err := database.NewSqlite(sqliteFile, true, unversionedSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lite.EnterData(`INSERT INTO log (tag, value, timestamp) VALUES (0, 1, ?);`,
+		time.Now().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	lite.Close()
+
+	db, err := localdb.NewLocalDB(sqliteFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version := db.GetSingleInt(`PRAGMA user_version;`); version != 4 {
+		t.Errorf("expected schema version 4, got %d", version)
+	}
+	if _, err = db.ForSensor("north").AddRainRecord(0.2794); err != nil {
+		t.Errorf("unable to log rain: %s", err)
+	}
+	if _, err = db.AddOutboxEntry("test", 1, false, []byte("{}")); err != nil {
+		t.Errorf("unable to use the outbox: %s", err)
+	}
+	if tally := database.GetRainEntries(db); tally != 2 {
+		t.Errorf("expected the old tip to be kept alongside the new one, got %d", tally)
+	}
+}
+
+// the schema before it had a version
+const unversionedSchema = `
+BEGIN TRANSACTION;
+CREATE TABLE mappings (
+	id INTEGER PRIMARY KEY,
+	longname TEXT
+);
+INSERT INTO mappings (id, longname)
+VALUES (0, "rain event"), (1, "temperature"), (2, "soft reset event"), (3, "hard reset event"), (4, "pause"),
+	(5, "unpause"), (6, NULL), (7, NULL);
+CREATE TABLE log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tag INTEGER NOT NULL,
+	value INTEGER NOT NULL,
+	timestamp TEXT NOT NULL,
+	FOREIGN KEY (tag) REFERENCES mappings(id)
+);
+COMMIT;
+`
+
+// a storm's worth of writes from many goroutines all land, and reads carry on meanwhile
+func TestSqliteConcurrentWrites(t *testing.T) {
+	db := sqliteConnectionFixture()
+	count := 500
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := db.AddRainRecord(0.2794); err != nil {
+				errs <- err
+			}
+			_ = db.Tally(tlv.Rain)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if tally := database.GetRainEntries(db); tally != count {
+		t.Errorf("expected %d tips, got %d", count, tally)
+	}
+
+	// nothing gets written once it's closed
+	db.Close()
+	if _, err := db.AddRainRecord(0.2794); err == nil {
+		t.Error("expected an error writing to a closed database")
+	}
+}
@@ -0,0 +1,82 @@
+package localdb
+
+// Durable outbox for messages waiting on the MQTT broker
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OutboxEntry is a single message stored in the outbox
+type OutboxEntry struct {
+	ID       int64  // primary key of the outbox row
+	Topic    string // mqtt topic
+	Qos      byte   // mqtt qos
+	Retained bool   // mqtt retained flag
+	Payload  []byte // raw payload, including the original gateway timestamp
+}
+
+// AddOutboxEntry stores a message in the outbox before it is published and returns its ID
+func (db *LocalDB) AddOutboxEntry(topic string, qos byte, retained bool, payload []byte) (int64, error) {
+	timestamp := time.Now().Format(time.RFC3339)
+	res, err := db.lite.EnterData(
+		`INSERT INTO outbox (topic, qos, retained, payload, timestamp) VALUES (?, ?, ?, ?, ?);`,
+		topic, int(qos), retained, string(payload), timestamp,
+	)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// MarkDelivered flags an outbox entry as acknowledged by the broker
+func (db *LocalDB) MarkDelivered(id int64) error {
+	timestamp := time.Now().Format(time.RFC3339)
+	_, err := db.lite.EnterData(`UPDATE outbox SET delivered = ? WHERE id = ?;`, timestamp, id)
+	return err
+}
+
+// OutboxPending counts the outbox entries not yet acknowledged by the broker
+func (db *LocalDB) OutboxPending() int {
+	return db.GetSingleInt(`SELECT COUNT(*) FROM outbox WHERE delivered IS NULL;`)
+}
+
+// GetUndelivered returns every outbox entry not yet acknowledged by the broker, oldest first
+func (db *LocalDB) GetUndelivered() ([]OutboxEntry, error) {
+	var rows *sql.Rows
+	var err error
+
+	c, err := db.lite.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Disconnect()
+
+	query := `SELECT id, topic, qos, retained, payload FROM outbox WHERE delivered IS NULL ORDER BY id;`
+	if rows, err = c.Conn.QueryContext(context.Background(), query); err != nil {
+		return nil, err
+	}
+	closed := func() {
+		if err = rows.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	defer closed()
+
+	entries := make([]OutboxEntry, 0)
+	for rows.Next() {
+		var entry OutboxEntry
+		var qos int
+		var payload string
+		if err = rows.Scan(&entry.ID, &entry.Topic, &qos, &entry.Retained, &payload); err != nil {
+			return nil, err
+		}
+		entry.Qos = byte(qos)
+		entry.Payload = []byte(payload)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,239 @@
+package localdb
+
+// Typed queries over a range of time, for answering questions like "how much rain fell here today"
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+	"github.com/sirupsen/logrus"
+)
+
+// restricts a query to the view's sensor, or none if it's empty. Bind db.sensor twice.
+const sensorClause = `(? = '' OR sensor = ?)`
+
+// restricts a query to timestamps from one time up to another. Bind the two times as RFC3339.
+const timeClause = `datetime(timestamp) >= datetime(?) AND datetime(timestamp) < datetime(?)`
+
+// ErrNoRecords means there's nothing in the log to answer a query
+var ErrNoRecords = errors.New("no records")
+
+// Bucket is how finely RainBuckets splits up a range of time
+type Bucket int
+
+// bucket sizes, starting on the hour or at midnight in the location of the range
+const (
+	Hourly Bucket = iota
+	Daily
+)
+
+// Record is a single row of the log, with the tag's name from mappings
+type Record struct {
+	ID          int64
+	Sensor      string
+	Tag         int
+	Name        string
+	Value       float64
+	Millimeters *float64 `json:",omitempty"` // rain only, the calibration of the sensor for the tip
+	Timestamp   time.Time
+}
+
+// RainBucket is the rain that fell from Start up to the next bucket
+type RainBucket struct {
+	Start       time.Time
+	Tips        int
+	Millimeters float64
+}
+
+// TemperatureRange is the coldest and warmest it got over a range of time
+type TemperatureRange struct {
+	MinC  float64
+	MaxC  float64
+	Count int // how many readings there were
+}
+
+// Records returns the log entries from one time up to another, oldest first
+func (db *LocalDB) Records(from, to time.Time) ([]Record, error) {
+	return db.records(from, to)
+}
+
+// Events returns the pauses, unpauses and resets from one time up to another, oldest first
+func (db *LocalDB) Events(from, to time.Time) ([]Record, error) {
+	return db.records(from, to, tlv.SoftReset, tlv.HardReset, tlv.Pause, tlv.Unpause)
+}
+
+// LastRecord returns the newest entry for a tag, or ErrNoRecords if there isn't one
+func (db *LocalDB) LastRecord(tag int) (*Record, error) {
+	records, err := db.query(`WHERE log.tag = ? AND `+sensorClause+` ORDER BY log.id DESC LIMIT 1`,
+		tag, db.sensor, db.sensor)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no entries for tag %d: %w", tag, ErrNoRecords)
+	}
+	return &records[0], nil
+}
+
+// TipsBetween counts the tips of the bucket from one time up to another
+func (db *LocalDB) TipsBetween(from, to time.Time) (int, error) {
+	c, err := db.lite.Connect()
+	if err != nil {
+		return -1, err
+	}
+	defer c.Disconnect()
+
+	var tips int
+	row := c.Conn.QueryRowContext(context.Background(),
+		`SELECT COUNT(*) FROM log WHERE tag = ? AND `+timeClause+` AND `+sensorClause+`;`,
+		tlv.Rain, from.Format(time.RFC3339), to.Format(time.RFC3339), db.sensor, db.sensor)
+	err = row.Scan(&tips)
+	return tips, err
+}
+
+// RainBetween totals the millimeters of rain from one time up to another. Tips from before the calibration
+// was recorded count as defaultMm.
+func (db *LocalDB) RainBetween(from, to time.Time, defaultMm float64) (float64, error) {
+	c, err := db.lite.Connect()
+	if err != nil {
+		return -1, err
+	}
+	defer c.Disconnect()
+
+	var mm float64
+	row := c.Conn.QueryRowContext(context.Background(),
+		`SELECT COALESCE(SUM(COALESCE(mm, ?)), 0) FROM log WHERE tag = ? AND `+timeClause+` AND `+sensorClause+`;`,
+		defaultMm, tlv.Rain, from.Format(time.RFC3339), to.Format(time.RFC3339), db.sensor, db.sensor)
+	err = row.Scan(&mm)
+	return mm, err
+}
+
+// RainBuckets splits the rain from one time up to another into hours or days, including the dry ones. Tips
+// from before the calibration was recorded count as defaultMm.
+func (db *LocalDB) RainBuckets(from, to time.Time, size Bucket, defaultMm float64) ([]RainBucket, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("range ends at %s, before it starts at %s", to, from)
+	}
+	tips, err := db.records(from, to, tlv.Rain)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]RainBucket, 0)
+	for start := bucketStart(from, size); start.Before(to); start = nextBucket(start, size) {
+		buckets = append(buckets, RainBucket{Start: start})
+	}
+	i := 0
+	for _, tip := range tips {
+		start := bucketStart(tip.Timestamp.In(from.Location()), size)
+		for i < len(buckets)-1 && buckets[i].Start.Before(start) {
+			i++
+		}
+		buckets[i].Tips++
+		if tip.Millimeters != nil {
+			buckets[i].Millimeters += *tip.Millimeters
+		} else {
+			buckets[i].Millimeters += defaultMm
+		}
+	}
+	return buckets, nil
+}
+
+// TemperatureRange finds the coldest and warmest readings from one time up to another, or ErrNoRecords if
+// there weren't any
+func (db *LocalDB) TemperatureRange(from, to time.Time) (*TemperatureRange, error) {
+	c, err := db.lite.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Disconnect()
+
+	var minC, maxC sql.NullFloat64
+	var count int
+	row := c.Conn.QueryRowContext(context.Background(),
+		`SELECT MIN(value), MAX(value), COUNT(*) FROM log WHERE tag = ? AND `+timeClause+` AND `+sensorClause+`;`,
+		tlv.Temperature, from.Format(time.RFC3339), to.Format(time.RFC3339), db.sensor, db.sensor)
+	if err = row.Scan(&minC, &maxC, &count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no temperature from %s to %s: %w", from, to, ErrNoRecords)
+	}
+	return &TemperatureRange{MinC: minC.Float64, MaxC: maxC.Float64, Count: count}, nil
+}
+
+// entries from one time up to another, for the given tags or all of them
+func (db *LocalDB) records(from, to time.Time, tags ...int) ([]Record, error) {
+	where := `WHERE ` + timeClause + ` AND ` + sensorClause
+	args := []interface{}{from.Format(time.RFC3339), to.Format(time.RFC3339), db.sensor, db.sensor}
+	if len(tags) > 0 {
+		where += ` AND log.tag IN (?` + strings.Repeat(`, ?`, len(tags)-1) + `)`
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+	}
+	return db.query(where+` ORDER BY log.id`, args...)
+}
+
+// select log entries joined to their names, after a WHERE/ORDER BY clause with bound args
+func (db *LocalDB) query(clause string, args ...interface{}) ([]Record, error) {
+	var rows *sql.Rows
+	var err error
+
+	c, err := db.lite.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Disconnect()
+
+	query := `SELECT log.id, log.sensor, log.tag, COALESCE(mappings.longname, ''), log.value, log.mm, log.timestamp
+FROM log LEFT JOIN mappings ON mappings.id = log.tag ` + clause + `;`
+	if rows, err = c.Conn.QueryContext(context.Background(), query, args...); err != nil {
+		return nil, err
+	}
+	closed := func() {
+		if err = rows.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	defer closed()
+
+	records := make([]Record, 0)
+	for rows.Next() {
+		var record Record
+		var timestamp string
+		var mm sql.NullFloat64
+		if err = rows.Scan(&record.ID, &record.Sensor, &record.Tag, &record.Name, &record.Value, &mm, &timestamp); err != nil {
+			return nil, err
+		}
+		if mm.Valid {
+			record.Millimeters = &mm.Float64
+		}
+		if record.Timestamp, err = time.Parse(time.RFC3339, timestamp); err != nil {
+			return nil, fmt.Errorf("bad timestamp on log entry %d: %s", record.ID, err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// the start of the hour or day a time falls in
+func bucketStart(t time.Time, size Bucket) time.Time {
+	if size == Daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// the start of the following hour or day, which isn't always 24 hours away
+func nextBucket(start time.Time, size Bucket) time.Time {
+	if size == Daily {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.Add(time.Hour)
+}
@@ -0,0 +1,61 @@
+package localdb
+
+// Keep the log from growing forever on the SD card
+
+import (
+	"context"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+	"github.com/sirupsen/logrus"
+)
+
+// Prune deletes temperature records, delivered outbox entries and the filter audit from before a cutoff. Rain and
+// sensor events are kept for good. Returns how many rows were deleted.
+func (db *LocalDB) Prune(ctx context.Context, before time.Time) (int64, error) {
+	cutoff := before.Format(time.RFC3339)
+	temps, err := db.lite.EnterDataContext(ctx,
+		`DELETE FROM log WHERE tag = ? AND datetime(timestamp) < datetime(?);`, tlv.Temperature, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	sent, err := db.lite.EnterDataContext(ctx,
+		`DELETE FROM outbox WHERE delivered IS NOT NULL AND datetime(timestamp) < datetime(?);`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	audit, err := db.lite.EnterDataContext(ctx, `DELETE FROM filtered WHERE datetime(timestamp) < datetime(?);`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := temps.RowsAffected()
+	deletedSent, _ := sent.RowsAffected()
+	deletedAudit, _ := audit.RowsAffected()
+	deleted += deletedSent + deletedAudit
+	return deleted, nil
+}
+
+// Maintain prunes records older than retention, or none if retention isn't positive, then
+// checkpoints the write-ahead log and optionally vacuums. Cancelling ctx stops it between steps.
+func (db *LocalDB) Maintain(ctx context.Context, retention time.Duration, vacuum bool) error {
+	if retention > 0 {
+		deleted, err := db.Prune(ctx, time.Now().Add(-retention))
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("pruned %d rows older than %s from the local database", deleted, retention)
+	}
+	if err := db.lite.Checkpoint(ctx); err != nil {
+		return err
+	}
+	if vacuum {
+		logrus.Debug("vacuuming the local database")
+		return db.lite.Vacuum(ctx)
+	}
+	return nil
+}
+
+// IntegrityCheck returns an error if the database file is damaged
+func (db *LocalDB) IntegrityCheck() error {
+	return db.lite.IntegrityCheck()
+}
@@ -2,6 +2,9 @@ package localdb
 
 // Schema for logging data in rainbase, should work for both postgresql and localdb
 
+// bump when the schema changes, and teach migrate how to get there
+const schemaVersion = 4
+
 const (
 	//nolint
 	localDbSchema = `
@@ -27,12 +30,47 @@ VALUES
 DROP TABLE IF EXISTS log;
 CREATE TABLE log (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sensor TEXT NOT NULL DEFAULT '',
 	tag INTEGER NOT NULL,
-	value INTEGER NOT NULL,
+	value REAL NOT NULL,
+	mm REAL, --calibration in effect for a rain tip, NULL for everything else
+	raw REAL, --temperature as the sensor sent it, before filtering into value
+	quality TEXT, --how far to trust a filtered temperature
 	timestamp TEXT NOT NULL, --created by go
 	FOREIGN KEY (tag) REFERENCES mappings(id)
 );
 
+DROP TABLE IF EXISTS outbox;
+` + outboxTable + `
+DROP TABLE IF EXISTS filtered;
+` + filteredTable + `
+PRAGMA user_version = 4;
 COMMIT;
+`
+
+	// messages waiting for the broker, added in version 1
+	outboxTable = `
+CREATE TABLE outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic TEXT NOT NULL,
+	qos INTEGER NOT NULL,
+	retained INTEGER NOT NULL,
+	payload TEXT NOT NULL,
+	timestamp TEXT NOT NULL, --created by go
+	delivered TEXT --created by go once the broker acknowledges the message
+);
+`
+
+	// audit of packets the filter dropped or flagged, added in version 3
+	filteredTable = `
+CREATE TABLE filtered (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	sensor TEXT NOT NULL DEFAULT '',
+	tag INTEGER NOT NULL,
+	value REAL NOT NULL,
+	reason TEXT NOT NULL,
+	dropped INTEGER NOT NULL, --1 if the packet was thrown away, 0 if it was kept but flagged
+	timestamp TEXT NOT NULL --created by go
+);
 `
 )
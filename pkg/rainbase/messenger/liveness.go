@@ -0,0 +1,115 @@
+package messenger
+
+// Work out whether a sensor is alive from when we last heard from it
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+	"github.com/spf13/viper"
+)
+
+// sensor health states, reported in SensorStatus
+const (
+	SensorUp    = "up"    // packets are arriving on schedule
+	SensorStale = "stale" // a few temperature readings are overdue
+	SensorDown  = "down"  // the port is gone or the sensor has been quiet too long
+)
+
+// sensorState is what the Messenger keeps track of for each sensor
+type sensorState struct {
+	sensor     config.Sensor
+	commands   chan *tlv.TLV // commands to write to the sensor
+	registered time.Time     // when the serial connection was made
+	lastPacket time.Time     // when the last packet was decoded, zero if never
+	lastTag    int           // tag of the last packet, 0 if never
+	paused     bool          // whether the sensor said it paused, and so stopped sending temperature
+	rate       *rainRate     // recent tips, for the rain rate
+	reported   string        // state in the last status message, empty if none yet
+}
+
+func newSensorState(sensor config.Sensor) *sensorState {
+	return &sensorState{
+		sensor:     sensor,
+		commands:   make(chan *tlv.TLV, 1),
+		registered: time.Now(),
+		rate:       newRainRate(sensor.Mm),
+	}
+}
+
+// record a packet from the sensor, caller holds the Messenger lock
+func (s *sensorState) heard(tag int, now time.Time) {
+	s.lastPacket = now
+	s.lastTag = tag
+	switch tag {
+	case tlv.Pause:
+		s.paused = true
+	case tlv.Unpause, tlv.HardReset, tlv.SoftReset:
+		s.paused = false
+	}
+}
+
+// SensorReport is a snapshot of one sensor's health, for local diagnostics
+type SensorReport struct {
+	Sensor        config.Sensor
+	State         string
+	Reason        string
+	LastPacket    time.Time // zero if never
+	LastPacketAge float64   // seconds, -1 if never
+	LastTag       int       // 0 if never
+}
+
+// snapshot the sensor for a report, caller holds the Messenger lock
+func (s *sensorState) report(now time.Time) SensorReport {
+	state, reason, age := s.health(now)
+	return SensorReport{
+		Sensor:        s.sensor,
+		State:         state,
+		Reason:        reason,
+		LastPacket:    s.lastPacket,
+		LastPacketAge: age,
+		LastTag:       s.lastTag,
+	}
+}
+
+// decide whether the sensor is up, stale or down, and why. The age is seconds since the last packet,
+// or -1 if there hasn't been one. Caller holds the Messenger lock.
+func (s *sensorState) health(now time.Time) (state string, reason string, age float64) {
+	age = -1
+	since := s.registered
+	if !s.lastPacket.IsZero() {
+		since = s.lastPacket
+		age = now.Sub(s.lastPacket).Seconds()
+	}
+	quiet := now.Sub(since).Round(time.Second)
+
+	if _, err := os.Stat(s.sensor.Port); err != nil {
+		return SensorDown, fmt.Sprintf("port `%s` is missing", s.sensor.Port), age
+	}
+	if s.paused {
+		return SensorUp, "paused", age
+	}
+
+	// the sensor sends temperature on a schedule, so silence means something is wrong
+	interval := viper.GetDuration(configkey.SensorTemperatureInterval)
+	staleAfter := interval * time.Duration(viper.GetInt(configkey.SensorStaleIntervals))
+	downAfter := interval * time.Duration(viper.GetInt(configkey.SensorDownIntervals))
+	heard := "no packets"
+	if s.lastPacket.IsZero() {
+		heard = "no packets since startup"
+	}
+	switch {
+	case quiet > downAfter:
+		return SensorDown, fmt.Sprintf("%s for %s", heard, quiet), age
+	case quiet > staleAfter:
+		return SensorStale, fmt.Sprintf("%s for %s", heard, quiet), age
+	case s.lastPacket.IsZero():
+		return SensorUp, "waiting for first packet", age
+	default:
+		return SensorUp, "", age
+	}
+}
@@ -0,0 +1,62 @@
+package messenger
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+)
+
+// a sensor goes from up to stale to down as temperature readings stop arriving
+func TestSensorHealth(t *testing.T) {
+	config.Configure()
+	port, err := os.CreateTemp("", "raingauge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(port.Name()) }()
+	_ = port.Close()
+
+	start := time.Now()
+	state := newSensorState(config.Sensor{ID: "test", Port: port.Name()})
+	state.registered = start
+
+	for _, check := range []struct {
+		heard  time.Duration // when the last packet arrived, or negative for never
+		paused bool
+		after  time.Duration
+		state  string
+	}{
+		{-1, false, time.Second, SensorUp},
+		{-1, false, time.Minute, SensorDown},
+		{0, false, time.Second, SensorUp},
+		{0, false, time.Second * 10, SensorStale},
+		{0, false, time.Minute, SensorDown},
+		{0, true, time.Minute, SensorUp},
+	} {
+		state.lastPacket = time.Time{}
+		state.paused = false
+		if check.heard >= 0 {
+			state.heard(tlv.Temperature, start.Add(check.heard))
+			if check.paused {
+				state.heard(tlv.Pause, start.Add(check.heard))
+			}
+		}
+		actual, reason, age := state.health(start.Add(check.after))
+		if actual != check.state {
+			t.Errorf("expected %s after %s, got %s (%s)", check.state, check.after, actual, reason)
+		}
+		if check.heard < 0 && age != -1 {
+			t.Errorf("expected no packet age, got %f", age)
+		}
+	}
+
+	// no port means no sensor, no matter what it last said
+	_ = os.Remove(port.Name())
+	state.heard(tlv.Temperature, start)
+	if actual, _, _ := state.health(start); actual != SensorDown {
+		t.Errorf("expected missing port to be down, got %s", actual)
+	}
+}
@@ -4,11 +4,14 @@ package messenger
 
 import (
 	"encoding/json"
+	"math"
 	"time"
 
 	"github.com/ntbloom/raincounter/pkg/common/database"
 	"github.com/ntbloom/raincounter/pkg/common/mqtt"
+	"github.com/ntbloom/raincounter/pkg/config"
 	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/ntbloom/raincounter/pkg/rainbase/filter"
 	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -31,6 +34,10 @@ func process(p Payload) ([]byte, error) {
 
 // SensorEvent gives static message about what's happening to the sensor
 type SensorEvent struct {
+	StationID string    // station the gateway belongs to
+	SensorID  string    // which sensor the event happened to
+	MessageID string    // unique to this message, so the server can ignore redeliveries
+	Sequence  uint64    // counts messages from 1 since the gateway started
 	Tag       int       // tag code for the event
 	Value     int       // value, generally 1
 	Event     string    //  human readable event, matches 1-to-1 with Tag
@@ -39,26 +46,81 @@ type SensorEvent struct {
 
 // TemperatureEvent sends current temperature in Celsius
 type TemperatureEvent struct {
-	TempC     int       // tempC value
+	StationID string    // station the gateway belongs to
+	SensorID  string    // which sensor took the measurement
+	MessageID string    // unique to this message, so the server can ignore redeliveries
+	Sequence  uint64    // counts messages from 1 since the gateway started
+	TempC     int       // tempC value, after filtering
+	Quality   string    // how far to trust TempC, see filter.QualityGood
 	Timestamp time.Time // timestamp when temp was recorded on the gateway
 }
 
 // RainEvent sends message about rain event
 type RainEvent struct {
+	StationID   string    // station the gateway belongs to
+	SensorID    string    // which sensor measured the rain
+	MessageID   string    // unique to this message, so the server can ignore redeliveries
+	Sequence    uint64    // counts messages from 1 since the gateway started
 	Millimeters float64   // amount of rain in millimeters
+	Flag        string    // why the tip is suspect, empty if it isn't
 	Timestamp   time.Time // timestamp when rain was measured on the gateway
 }
 
-// GatewayStatus sends "OK" message at regular intervals
+// RainRate sends the rolling rain rate at a sensor, in millimeters per hour
+type RainRate struct {
+	StationID   string    // station the gateway belongs to
+	SensorID    string    // which sensor measured the rain
+	MmPerHour1  float64   // rate over the last minute
+	MmPerHour5  float64   // rate over the last 5 minutes
+	MmPerHour15 float64   // rate over the last 15 minutes
+	Timestamp   time.Time // time the rate was calculated on the gateway
+}
+
+// GatewayStatus sends "OK" message at regular intervals, along with telemetry about the machine. Telemetry
+// the machine can't provide is nil.
 type GatewayStatus struct {
-	OK        bool      // generic message
-	Timestamp time.Time // time message was sent by the gateway
+	StationID      string     // station the gateway belongs to
+	OK             bool       // generic message
+	Uptime         *float64   // seconds the rainbase has been running
+	SystemUptime   *float64   // seconds since the machine booted
+	DiskFree       *uint64    // bytes free on the filesystem holding the local database
+	CPUTempC       *float64   // CPU temperature in Celsius
+	Load1          *float64   // 1 minute load average
+	Load5          *float64   // 5 minute load average
+	Load15         *float64   // 15 minute load average
+	MQTTReconnects *uint64    // times the mqtt connection has been reestablished
+	MQTTBroker     *string    // broker the gateway is connected to
+	CertExpires    *time.Time // when the mqtt client certificate expires, nil without TLS
+	Version        string     // software version
+	Timestamp      time.Time  // time message was sent by the gateway
 }
 
-// SensorStatus sends "OK" if sensor is reachable, else "Bad"
+// SensorStatus reports whether the sensor is up, stale or down based on when it was last heard from
 type SensorStatus struct {
-	OK        bool      // generic message
-	Timestamp time.Time // time message was sent by the gateway
+	StationID     string    // station the gateway belongs to
+	SensorID      string    // which sensor the status is for
+	OK            bool      // whether the sensor is up
+	State         string    // SensorUp, SensorStale or SensorDown
+	Reason        string    // why the sensor is in that state, empty if there's nothing to add
+	LastPacketAge float64   // seconds since the last packet was decoded, -1 if there hasn't been one
+	Timestamp     time.Time // time message was sent by the gateway
+}
+
+// LinkStatus reports packets lost or mangled on the serial link between the sensor and gateway
+type LinkStatus struct {
+	StationID     string    // station the gateway belongs to
+	SensorID      string    // which sensor's serial link
+	Missed        int       // v2 packets lost just before the one that revealed the gap
+	SequenceGaps  uint64    // total v2 packets lost since the gateway started
+	FramingErrors uint64    // total lines from the sensor that couldn't be decoded
+	Timestamp     time.Time // time the gap was detected on the gateway
+}
+
+// SensorCommand asks the gateway to send a command to the sensor
+type SensorCommand struct {
+	SensorID  string    // which sensor to send the command to, or all of them if empty
+	Command   string    // name of the command, e.g. "pause"
+	Timestamp time.Time // time the command was issued
 }
 
 // Process turn static value into mqtt payload
@@ -76,6 +138,11 @@ func (r *RainEvent) Process() ([]byte, error) {
 	return process(r)
 }
 
+// Process turn rain rate into mqtt payload
+func (r *RainRate) Process() ([]byte, error) {
+	return process(r)
+}
+
 // Process turn gateway status message into mqtt payload
 func (gs *GatewayStatus) Process() ([]byte, error) {
 	return process(gs)
@@ -86,71 +153,88 @@ func (ss *SensorStatus) Process() ([]byte, error) {
 	return process(ss)
 }
 
+// Process turn link status into mqtt payload
+func (ls *LinkStatus) Process() ([]byte, error) {
+	return process(ls)
+}
+
+// Process turn sensor command into mqtt payload
+func (sc *SensorCommand) Process() ([]byte, error) {
+	return process(sc)
+}
+
 type Message struct {
 	topic    string
 	retained bool
 	qos      byte
 	payload  []byte
+	outboxID int64 // row in the local outbox, 0 if the message hasn't been stored
 }
 
-// NewMessage makes a new message from a tlv packet mqtt topic and logs the entry to the postgresql in the background
-func (m *Messenger) NewMessage(packet *tlv.TLV) (*Message, error) {
-	now := time.Now()
+// NewMessage makes a new message from a filtered tlv packet and logs the entry to the local database. Packets
+// the filter dropped only go in the audit, and give a nil Message.
+func (m *Messenger) NewMessage(sensor config.Sensor, reading filter.Reading) (*Message, error) {
+	packet, now := reading.Packet, reading.Time
+	m.heard(sensor.ID, packet.Tag, now)
+	db := m.db.ForSensor(sensor.ID)
 	var event Payload
 	var topic string
 
+	if reading.Drop || reading.Flag != "" {
+		logrus.Infof("sensor `%s` tag %d: %s", sensor.ID, packet.Tag, reading.Flag)
+		if _, err := db.AddFiltered(packet.Tag, float64(packet.Value), reading.Flag, reading.Drop); err != nil {
+			logrus.Errorf("unable to audit filtered packet: %s", err)
+		}
+	}
+	if reading.Drop {
+		return nil, nil
+	}
+
+	id, sequence := m.nextID()
 	switch packet.Tag {
 	case tlv.Rain:
 		topic = mqtt.RainTopic
 		event = &RainEvent{
-			viper.GetFloat64(configkey.SensorRainMm),
-			now,
+			StationID:   m.station,
+			SensorID:    sensor.ID,
+			MessageID:   id,
+			Sequence:    sequence,
+			Millimeters: sensor.Mm,
+			Flag:        reading.Flag,
+			Timestamp:   now,
 		}
-		go database.MakeRainTallyEntry(m.db)
+		database.MakeRainValueEntry(db, sensor.Mm)
+		m.tipped(sensor.ID, now)
 	case tlv.Temperature:
 		topic = mqtt.TemperatureTopic
-		tempC := packet.Value
 		event = &TemperatureEvent{
-			tempC,
-			now,
+			StationID: m.station,
+			SensorID:  sensor.ID,
+			MessageID: id,
+			Sequence:  sequence,
+			TempC:     int(math.Round(reading.Value)),
+			Quality:   reading.Quality,
+			Timestamp: now,
+		}
+		if _, err := db.AddTemperatureRecord(reading.Value, float64(packet.Value), reading.Quality); err != nil {
+			logrus.Error(err)
 		}
-		go database.MakeTemperatureEntry(m.db, tempC)
 	case tlv.SoftReset:
 		topic = mqtt.SensorEventTopic
-		event = &SensorEvent{
-			tlv.SoftReset,
-			tlv.SoftResetValue,
-			mqtt.SensorSoftResetEvent,
-			now,
-		}
-		go database.MakeSoftResetEntry(m.db)
+		event = m.newSensorEvent(sensor.ID, id, sequence, tlv.SoftReset, tlv.SoftResetValue, mqtt.SensorSoftResetEvent, now)
+		database.MakeSoftResetEntry(db)
 	case tlv.HardReset:
 		topic = mqtt.SensorEventTopic
-		event = &SensorEvent{
-			tlv.SoftReset,
-			tlv.SoftResetValue,
-			mqtt.SensorHardResetEvent,
-			now,
-		}
-		go database.MakeHardResetEntry(m.db)
+		event = m.newSensorEvent(sensor.ID, id, sequence, tlv.HardReset, tlv.HardResetValue, mqtt.SensorHardResetEvent, now)
+		database.MakeHardResetEntry(db)
 	case tlv.Pause:
 		topic = mqtt.SensorEventTopic
-		event = &SensorEvent{
-			tlv.HardReset,
-			tlv.HardResetValue,
-			mqtt.SensorPauseEvent,
-			now,
-		}
-		go database.MakePauseEntry(m.db)
+		event = m.newSensorEvent(sensor.ID, id, sequence, tlv.Pause, tlv.PauseValue, mqtt.SensorPauseEvent, now)
+		database.MakePauseEntry(db)
 	case tlv.Unpause:
 		topic = mqtt.SensorEventTopic
-		event = &SensorEvent{
-			tlv.Unpause,
-			tlv.UnpauseValue,
-			mqtt.SensorUnpauseEvent,
-			now,
-		}
-		go database.MakeUnpauseEntry(m.db)
+		event = m.newSensorEvent(sensor.ID, id, sequence, tlv.Unpause, tlv.UnpauseValue, mqtt.SensorUnpauseEvent, now)
+		database.MakeUnpauseEntry(db)
 	default:
 		logrus.Errorf("unsupported tag %d", packet.Tag)
 		return nil, nil
@@ -161,7 +245,7 @@ func (m *Messenger) NewMessage(packet *tlv.TLV) (*Message, error) {
 		return nil, err
 	}
 	msg := Message{
-		topic:    topic,
+		topic:    m.topic(topic),
 		retained: false,
 		qos:      byte(viper.GetInt(configkey.MQTTQos)),
 		payload:  payload,
@@ -169,3 +253,61 @@ func (m *Messenger) NewMessage(packet *tlv.TLV) (*Message, error) {
 	logrus.Tracef("sending message, topic=%s, payload=%s", topic, payload)
 	return &msg, nil
 }
+
+func (m *Messenger) newSensorEvent(sensorID, id string, sequence uint64, tag, value int, event string, now time.Time) *SensorEvent {
+	return &SensorEvent{
+		StationID: m.station,
+		SensorID:  sensorID,
+		MessageID: id,
+		Sequence:  sequence,
+		Tag:       tag,
+		Value:     value,
+		Event:     event,
+		Timestamp: now,
+	}
+}
+
+// newRainRateMessage makes a message with the rain rate at a sensor
+func (m *Messenger) newRainRateMessage(sensorID string, rates [len(rateWindows)]float64, now time.Time) (*Message, error) {
+	rr := RainRate{
+		StationID:   m.station,
+		SensorID:    sensorID,
+		MmPerHour1:  rates[0],
+		MmPerHour5:  rates[1],
+		MmPerHour15: rates[2],
+		Timestamp:   now,
+	}
+	payload, err := rr.Process()
+	if err != nil {
+		return nil, err
+	}
+	// a rate is stale by the next one, so there's no point holding it in the outbox
+	return &Message{
+		topic:    m.topic(mqtt.RainRateTopic),
+		retained: false,
+		qos:      0,
+		payload:  payload,
+	}, nil
+}
+
+// NewLinkStatusMessage makes a message reporting lost packets on the serial link
+func (m *Messenger) NewLinkStatusMessage(sensorID string, missed int, sequenceGaps, framingErrors uint64) (*Message, error) {
+	ls := LinkStatus{
+		StationID:     m.station,
+		SensorID:      sensorID,
+		Missed:        missed,
+		SequenceGaps:  sequenceGaps,
+		FramingErrors: framingErrors,
+		Timestamp:     time.Now(),
+	}
+	payload, err := ls.Process()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		topic:    m.topic(mqtt.SensorLinkTopic),
+		retained: false,
+		qos:      byte(viper.GetInt(configkey.MQTTQos)),
+		payload:  payload,
+	}, nil
+}
@@ -2,130 +2,502 @@
 package messenger
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/ntbloom/raincounter/pkg/common/mqtt"
+	"github.com/ntbloom/raincounter/pkg/config"
 	"github.com/ntbloom/raincounter/pkg/config/configkey"
 	"github.com/ntbloom/raincounter/pkg/rainbase/localdb"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// random bytes in the boot ID that starts every message ID
+const bootIDLen = 8
+
 // Messenger receives Message from serial port, publishes to paho and stores locally
 type Messenger struct {
-	client paho.Client      // MQTT Client object
-	db     *localdb.LocalDB // DBWrapper connector
-	state  chan uint8       // What is the Messenger supposed to do?
-	Data   chan *Message    // Actual data packets
+	client      paho.Client        // MQTT Client object
+	station     string             // station ID that scopes every topic we publish
+	boot        string             // random for each run, so message IDs don't repeat after a restart
+	sequence    uint64             // last message sequence number handed out
+	started     time.Time          // when the messenger was made, for uptime
+	db          *localdb.LocalDB   // DBWrapper connector
+	Data        chan *Message      // Actual data packets
+	sensors     []*sensorState     // every sensor with a serial connection
+	inflight    map[int64]struct{} // outbox rows waiting on a publish token
+	backlog     int32              // set while older outbox rows may still need sending
+	reconnected chan struct{}      // the client connected, so the outbox can go out
+	tidying     int32              // set while database maintenance is running
+	dialing     int32              // set while connecting to the broker
+	pending     sync.WaitGroup     // background work that shutdown waits on
+	sync.Mutex
 }
 
-// NewMessenger gets a new messenger
+// NewMessenger gets a new messenger. It connects to the broker when started.
 func NewMessenger(client paho.Client, db *localdb.LocalDB) (*Messenger, error) {
-	state := make(chan uint8, 1)
-	data := make(chan *Message, 1)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("unable to connect to MQTT: %s", token.Error())
+	station, err := config.StationID()
+	if err != nil {
+		return nil, err
 	}
-	return &Messenger{client, db, state, data}, nil
+	boot := make([]byte, bootIDLen)
+	if _, err = rand.Read(boot); err != nil {
+		return nil, err
+	}
+	data := make(chan *Message, 1)
+	return &Messenger{
+		client:      client,
+		station:     station,
+		boot:        hex.EncodeToString(boot),
+		started:     time.Now(),
+		db:          db,
+		Data:        data,
+		sensors:     make([]*sensorState, 0),
+		inflight:    make(map[int64]struct{}),
+		backlog:     1, // rows left from the last run
+		reconnected: make(chan struct{}, 1),
+		Mutex:       sync.Mutex{},
+	}, nil
 }
 
-// Start waits for packet to publish or to receive signal interrupt
-func (m *Messenger) Start() {
-	defer m.client.Disconnect(viper.GetUint(configkey.MQTTQuiescence))
+// Start publishes packets until ctx is cancelled, then drains: whatever is waiting on Data is published, and
+// the broker gets a chance to acknowledge it before we disconnect. It keeps trying to reach the broker in the
+// background, and until it does everything waits in the outbox.
+func (m *Messenger) Start(ctx context.Context) error {
+	defer m.disconnect()
+	m.background(m.connect)
 
-	// configure status messages
+	// configure status messages and outbox replay
 	statusTimer := time.NewTicker(viper.GetDuration(configkey.MessengerStatusInterval))
+	defer statusTimer.Stop()
+	telemetryTimer := time.NewTicker(viper.GetDuration(configkey.MessengerTelemetryInterval))
+	defer telemetryTimer.Stop()
+	outboxTimer := time.NewTicker(viper.GetDuration(configkey.MessengerOutboxInterval))
+	defer outboxTimer.Stop()
+	rateTimer := time.NewTicker(viper.GetDuration(configkey.MessengerRateInterval))
+	defer rateTimer.Stop()
+	m.replay()
+
+	// keep the local database from growing forever
+	maintenanceTimer := time.NewTicker(viper.GetDuration(configkey.DatabaseLocalMaintenance))
+	defer maintenanceTimer.Stop()
+	vacuumTimer := time.NewTicker(viper.GetDuration(configkey.DatabaseLocalVacuum))
+	defer vacuumTimer.Stop()
+	m.background(func() { m.tidy(ctx, false) })
 
-	// loop until signal
+	// loop until cancelled
 	for {
 		select {
-		case state := <-m.state:
-			switch state {
-			case configkey.Kill:
-				// program is exiting
-				logrus.Debug("received `Closed` signal on messenger.state channel")
-				statusTimer.Stop()
-				return
-			default:
-				continue
-			}
+		case <-ctx.Done():
+			logrus.Debug("messenger context cancelled, draining")
+			m.drain()
+			return nil
 		case msg := <-m.Data:
 			logrus.Tracef("received Message from serial port: %s", msg.payload)
 			m.publish(msg)
 		case <-statusTimer.C:
+			m.sendSensorStatus(false)
+		case <-telemetryTimer.C:
 			logrus.Tracef("requesting status message")
 			m.sendStatus()
+		case <-outboxTimer.C:
+			m.background(m.connect)
+			m.replay()
+		case <-m.reconnected:
+			m.replay()
+		case <-rateTimer.C:
+			m.sendRainRates()
+		case <-maintenanceTimer.C:
+			m.background(func() { m.tidy(ctx, false) })
+			mqtt.CheckClientCert()
+		case <-vacuumTimer.C:
+			m.background(func() { m.tidy(ctx, true) })
+		}
+	}
+}
+
+// connect to the broker and listen for remote commands to the sensor, unless we're connected already. The
+// client reconnects by itself once it has connected the first time.
+func (m *Messenger) connect() {
+	if m.client.IsConnected() || !atomic.CompareAndSwapInt32(&m.dialing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.dialing, 0)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		logrus.Errorf("unable to connect to MQTT, holding messages in the outbox: %s", token.Error())
+		return
+	}
+	qos := byte(viper.GetInt(configkey.MQTTQos))
+	commandTopic := m.topic(mqtt.SensorCommandTopic)
+	if token := m.client.Subscribe(commandTopic, qos, m.handleCommand); token.Wait() && token.Error() != nil {
+		logrus.Errorf("unable to subscribe to %s: %s", commandTopic, token.Error())
+	}
+}
+
+// OnConnect runs on every connection to the broker. The outbox goes out from the main loop, before anything
+// new.
+func (m *Messenger) OnConnect(paho.Client) {
+	select {
+	case m.reconnected <- struct{}{}:
+	default:
+	}
+}
+
+// say we're going offline, so the server doesn't wait for the broker to notice, then disconnect
+func (m *Messenger) disconnect() {
+	if m.client.IsConnectionOpen() {
+		token := mqtt.PublishOffline(m.client, m.station)
+		if !token.WaitTimeout(viper.GetDuration(configkey.MQTTConnectionTimeout)) || token.Error() != nil {
+			logrus.Warnf("unable to announce %s offline: %v", m.station, token.Error())
+		}
+	}
+	m.client.Disconnect(viper.GetUint(configkey.MQTTQuiescence))
+}
+
+// publish whatever is left on Data, then wait for acknowledgements and maintenance to finish. Anything the
+// broker doesn't acknowledge in time stays in the outbox for next time.
+func (m *Messenger) drain() {
+	for {
+		select {
+		case msg := <-m.Data:
+			m.publish(msg)
+		default:
+			m.pending.Wait()
+			return
 		}
 	}
 }
 
-// Stop kills the main loop
-func (m *Messenger) Stop() {
-	logrus.Info("stopping messenger and closing paho connection")
-	m.state <- configkey.Kill
+// run f in the background, where drain will wait for it
+func (m *Messenger) background(f func()) {
+	m.pending.Add(1)
+	go func() {
+		defer m.pending.Done()
+		f()
+	}()
+}
+
+// Register adds a sensor to status reporting and returns the channel its commands arrive on
+func (m *Messenger) Register(sensor config.Sensor) <-chan *tlv.TLV {
+	m.Lock()
+	defer m.Unlock()
+	state := newSensorState(sensor)
+	m.sensors = append(m.sensors, state)
+	return state.commands
+}
+
+// SensorReports describes every registered sensor as of now
+func (m *Messenger) SensorReports() []SensorReport {
+	now := time.Now()
+	m.Lock()
+	defer m.Unlock()
+	reports := make([]SensorReport, 0, len(m.sensors))
+	for _, state := range m.sensors {
+		reports = append(reports, state.report(now))
+	}
+	return reports
+}
+
+// Connected is whether the MQTT connection is currently up
+func (m *Messenger) Connected() bool {
+	return m.client.IsConnectionOpen()
+}
+
+// StationID is the station every topic is scoped to
+func (m *Messenger) StationID() string {
+	return m.station
 }
 
-// publish sends a Message over MQTT
+// Started is when the messenger was made
+func (m *Messenger) Started() time.Time {
+	return m.started
+}
+
+// next message ID and sequence number. IDs are only unique within the station, which is in every topic.
+func (m *Messenger) nextID() (string, uint64) {
+	m.Lock()
+	m.sequence++
+	sequence := m.sequence
+	m.Unlock()
+	return fmt.Sprintf("%s-%d", m.boot, sequence), sequence
+}
+
+// scope a topic to this station
+func (m *Messenger) topic(topic string) string {
+	return mqtt.StationTopic(m.station, topic)
+}
+
+// publish sends a Message over MQTT. Messages with qos > 0 go through the outbox first so
+// they survive a broker outage; qos 0 messages are fire-and-forget. While older outbox rows are
+// waiting, new ones go out behind them so everything arrives in the order it was recorded.
 func (m *Messenger) publish(msg *Message) {
+	if msg.qos > 0 && msg.outboxID == 0 {
+		id, err := m.db.AddOutboxEntry(msg.topic, msg.qos, msg.retained, msg.payload)
+		if err != nil {
+			logrus.Errorf("unable to store message in outbox, publishing anyway: %s", err)
+		} else {
+			msg.outboxID = id
+			if atomic.LoadInt32(&m.backlog) == 1 {
+				m.replay()
+				return
+			}
+		}
+	}
+	m.send(msg)
+}
+
+// send a message if the broker is there, returning whether it went
+func (m *Messenger) send(msg *Message) bool {
+	if !m.client.IsConnectionOpen() {
+		logrus.Debugf("mqtt connection down, holding topic=%s in outbox", msg.topic)
+		if msg.outboxID > 0 {
+			atomic.StoreInt32(&m.backlog, 1)
+		}
+		return false
+	}
 	logrus.Tracef("sending Message over MQTT: %s", msg.payload)
 	logrus.Debugf("publishing topic=%s, msg=%s", msg.topic, msg.payload)
-	m.client.Publish(msg.topic, msg.qos, msg.retained, msg.payload)
+	token := m.client.Publish(msg.topic, msg.qos, msg.retained, msg.payload)
+	if msg.outboxID > 0 {
+		m.track(msg.outboxID, token)
+	}
+	return true
+}
+
+// track waits for the broker to acknowledge an outbox entry, then marks it delivered
+func (m *Messenger) track(id int64, token paho.Token) {
+	m.Lock()
+	m.inflight[id] = struct{}{}
+	m.Unlock()
+
+	m.background(func() {
+		defer func() {
+			m.Lock()
+			delete(m.inflight, id)
+			m.Unlock()
+		}()
+		if !token.WaitTimeout(viper.GetDuration(configkey.MessengerPublishTimeout)) {
+			logrus.Debugf("no acknowledgement for outbox entry %d, will replay", id)
+			atomic.StoreInt32(&m.backlog, 1)
+			return
+		}
+		if err := token.Error(); err != nil {
+			logrus.Debugf("outbox entry %d not delivered, will replay: %s", id, err)
+			atomic.StoreInt32(&m.backlog, 1)
+			return
+		}
+		if err := m.db.MarkDelivered(id); err != nil {
+			logrus.Errorf("unable to mark outbox entry %d delivered: %s", id, err)
+		}
+	})
 }
 
-// sendStatus sends a status message about the gateway and sensor at regular interval
+// replay publishes undelivered outbox entries in the order they were recorded, and once they've all gone
+// new messages can skip the outbox read. It only runs from the main loop, so nothing new is published
+// while it's going.
+func (m *Messenger) replay() {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+	// anything that fails from here on sets the backlog again
+	atomic.StoreInt32(&m.backlog, 0)
+	entries, err := m.db.GetUndelivered()
+	if err != nil {
+		logrus.Errorf("unable to read outbox: %s", err)
+		atomic.StoreInt32(&m.backlog, 1)
+		return
+	}
+	for _, entry := range entries {
+		m.Lock()
+		_, waiting := m.inflight[entry.ID]
+		m.Unlock()
+		if waiting {
+			continue
+		}
+		logrus.Debugf("replaying outbox entry %d on topic=%s", entry.ID, entry.Topic)
+		sent := m.send(&Message{
+			topic:    entry.Topic,
+			retained: entry.Retained,
+			qos:      entry.Qos,
+			payload:  entry.Payload,
+			outboxID: entry.ID,
+		})
+		if !sent {
+			return
+		}
+	}
+}
+
+// tidy prunes old records from the local database and compacts it, skipping if it's already running
+func (m *Messenger) tidy(ctx context.Context, vacuum bool) {
+	if !atomic.CompareAndSwapInt32(&m.tidying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.tidying, 0)
+	retention := time.Hour * 24 * time.Duration(viper.GetInt(configkey.DatabaseLocalRetention))
+	if err := m.db.Maintain(ctx, retention, vacuum); err != nil && ctx.Err() == nil {
+		logrus.Errorf("local database maintenance failed: %s", err)
+	}
+}
+
+// handleCommand forwards a command received over MQTT to the serial port
+func (m *Messenger) handleCommand(_ paho.Client, message paho.Message) {
+	var sc SensorCommand
+	if err := json.Unmarshal(message.Payload(), &sc); err != nil {
+		logrus.Errorf("skipping message on %s: %s", message.Topic(), err)
+		return
+	}
+	cmd, err := tlv.NewCommand(sc.Command)
+	if err != nil {
+		logrus.Errorf("skipping message on %s: %s", message.Topic(), err)
+		return
+	}
+	logrus.Infof("received `%s` command for sensor `%s` issued at %s", sc.Command, sc.SensorID, sc.Timestamp)
+	sent := false
+	for _, state := range m.registered() {
+		if sc.SensorID == "" || sc.SensorID == state.sensor.ID {
+			// don't hold up the mqtt client if the sensor hasn't taken the last command yet
+			select {
+			case state.commands <- cmd:
+			default:
+				logrus.Errorf("dropping `%s` command, sensor `%s` is still busy with the last one",
+					sc.Command, state.sensor.ID)
+			}
+			sent = true
+		}
+	}
+	if !sent {
+		logrus.Errorf("no sensor `%s` for `%s` command", sc.SensorID, sc.Command)
+	}
+}
+
+// note that a sensor sent a packet, so we know it's alive
+func (m *Messenger) heard(sensorID string, tag int, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	for _, state := range m.sensors {
+		if state.sensor.ID == sensorID {
+			state.heard(tag, now)
+			return
+		}
+	}
+}
+
+// note that a sensor's gauge tipped, for the rain rate
+func (m *Messenger) tipped(sensorID string, now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	for _, state := range m.sensors {
+		if state.sensor.ID == sensorID {
+			state.rate.tip(now)
+			return
+		}
+	}
+}
+
+// copy of the registered sensors, safe to range over without holding the lock
+func (m *Messenger) registered() []*sensorState {
+	m.Lock()
+	defer m.Unlock()
+	return append([]*sensorState{}, m.sensors...)
+}
+
+// sendStatus sends a status message about the gateway and every sensor at regular interval
 func (m *Messenger) sendStatus() {
 	// assume if this code is running that the gateway is up
-	gwStatus, _ := gatewayStatusMessage()
+	gwStatus, _ := m.gatewayStatusMessage()
 	m.publish(gwStatus)
+	m.sendSensorStatus(true)
+}
 
-	sensorStatus, _ := sensorStatusMessage()
-	m.publish(sensorStatus)
+// sendSensorStatus sends a status message for each sensor whose state has changed since the last one, or for
+// every sensor if refresh is set
+func (m *Messenger) sendSensorStatus(refresh bool) {
+	for _, state := range m.registered() {
+		sensorStatus, changed, _ := m.sensorStatusMessage(state)
+		if refresh || changed {
+			m.publish(sensorStatus)
+		}
+	}
+}
+
+// sendRainRates sends the rain rate for every sensor where it's raining, and once more when it stops
+func (m *Messenger) sendRainRates() {
+	now := time.Now()
+	for _, state := range m.registered() {
+		m.Lock()
+		rates := state.rate.rates(now)
+		raining := rates[len(rates)-1] > 0
+		send := raining || state.rate.reported
+		state.rate.reported = raining
+		m.Unlock()
+		if !send {
+			continue
+		}
+		msg, err := m.newRainRateMessage(state.sensor.ID, rates, now)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		m.publish(msg)
+	}
 }
 
 // get a status message about how the gateway is doing
-func gatewayStatusMessage() (*Message, error) {
+func (m *Messenger) gatewayStatusMessage() (*Message, error) {
 	gs := GatewayStatus{
+		StationID: m.station,
 		OK:        true,
 		Timestamp: time.Now(),
 	}
+	m.addTelemetry(&gs)
 	msg, err := gs.Process()
 	if err != nil {
 		return nil, err
 	}
 	return &Message{
-		topic:    mqtt.GatewayStatusTopic,
+		topic:    m.topic(mqtt.GatewayStatusTopic),
 		retained: false,
 		qos:      0,
 		payload:  msg,
 	}, nil
 }
 
-// get a status message about how the sensor is doing
-func sensorStatusMessage() (*Message, error) {
-	var up bool
-	port := viper.GetString(configkey.USBConnectionPort)
-	_, err := os.Stat(port)
-	if err != nil {
-		up = false
-	} else {
-		up = true
-	}
+// get a status message about how the sensor is doing, and whether that's changed since the last one
+func (m *Messenger) sensorStatusMessage(sensor *sensorState) (*Message, bool, error) {
+	now := time.Now()
+	m.Lock()
+	state, reason, age := sensor.health(now)
+	changed := state != sensor.reported
+	sensor.reported = state
+	m.Unlock()
 	ss := SensorStatus{
-		OK:        up,
-		Timestamp: time.Now(),
+		StationID:     m.station,
+		SensorID:      sensor.sensor.ID,
+		OK:            state == SensorUp,
+		State:         state,
+		Reason:        reason,
+		LastPacketAge: age,
+		Timestamp:     now,
 	}
 	msg, err := ss.Process()
 	if err != nil {
-		return nil, err
+		return nil, changed, err
 	}
 	return &Message{
-		topic:    mqtt.SensorStatusTopic,
+		topic:    m.topic(mqtt.SensorStatusTopic),
 		retained: false,
 		qos:      0,
 		payload:  msg,
-	}, nil
+	}, changed, nil
 }
@@ -0,0 +1,129 @@
+package messenger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/rainbase/localdb"
+)
+
+// message IDs count up, and don't repeat when the gateway restarts
+func TestMessageIDs(t *testing.T) {
+	config.Configure()
+	first, err := NewMessenger(paho.NewClient(paho.NewClientOptions()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, sequence := first.nextID()
+	nextID, nextSequence := first.nextID()
+	if sequence != 1 || nextSequence != 2 || id == nextID {
+		t.Errorf("expected IDs to count up from 1, got %s (%d) then %s (%d)", id, sequence, nextID, nextSequence)
+	}
+
+	restarted, err := NewMessenger(paho.NewClient(paho.NewClientOptions()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := restarted.nextID(); again == id {
+		t.Errorf("message ID %s repeated after a restart", id)
+	}
+}
+
+// messages held while the broker was away go out before anything new, even once it's back
+func TestOutboxOrder(t *testing.T) {
+	config.Configure()
+	db, err := localdb.NewLocalDB(filepath.Join(t.TempDir(), "outbox.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	client := &fakeClient{}
+	msgr, err := NewMessenger(client, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := func(payload string) *Message {
+		return &Message{topic: "test", qos: 1, payload: []byte(payload)}
+	}
+
+	msgr.publish(message("first"))
+	msgr.publish(message("second"))
+	if len(client.published) != 0 {
+		t.Fatalf("published %v without a broker", client.published)
+	}
+
+	// the broker comes back, and something new arrives before the replay
+	client.connected = true
+	msgr.publish(message("third"))
+	msgr.replay()
+	msgr.publish(message("fourth"))
+	expected := []string{"first", "second", "third", "fourth"}
+	if strings.Join(client.published, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, client.published)
+	}
+}
+
+// sensor status goes out when the state changes, and for everything on a refresh
+func TestSensorStatusChanges(t *testing.T) {
+	config.Configure()
+	port := filepath.Join(t.TempDir(), "ttyACM0")
+	if err := os.WriteFile(port, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client := &fakeClient{connected: true}
+	msgr, err := NewMessenger(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgr.Register(config.Sensor{ID: "raingauge", Port: port})
+
+	sent := func(refresh bool) int {
+		before := len(client.published)
+		msgr.sendSensorStatus(refresh)
+		return len(client.published) - before
+	}
+	if n := sent(false); n != 1 {
+		t.Errorf("expected the first status to go out, sent %d", n)
+	}
+	if n := sent(false); n != 0 {
+		t.Errorf("expected nothing while the sensor is still up, sent %d", n)
+	}
+	if err = os.Remove(port); err != nil {
+		t.Fatal(err)
+	}
+	if n := sent(false); n != 1 {
+		t.Errorf("expected a status when the sensor went down, sent %d", n)
+	}
+	if n := sent(true); n != 1 {
+		t.Errorf("expected a status on refresh, sent %d", n)
+	}
+}
+
+// a broker that acknowledges everything straight away, when it's there
+type fakeClient struct {
+	paho.Client
+	connected bool
+	published []string
+}
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	return c.connected
+}
+
+func (c *fakeClient) Publish(_ string, _ byte, _ bool, payload interface{}) paho.Token {
+	c.published = append(c.published, string(payload.([]byte)))
+	return &doneToken{}
+}
+
+type doneToken struct{}
+
+func (*doneToken) Wait() bool                     { return true }
+func (*doneToken) WaitTimeout(time.Duration) bool { return true }
+func (*doneToken) Done() <-chan struct{}          { done := make(chan struct{}); close(done); return done }
+func (*doneToken) Error() error                   { return nil }
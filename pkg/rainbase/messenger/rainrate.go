@@ -0,0 +1,65 @@
+package messenger
+
+// Work out how hard it's raining from when the gauge tipped
+
+import (
+	"time"
+)
+
+// windows the rain rate is averaged over, shortest first
+var rateWindows = [...]time.Duration{time.Minute, time.Minute * 5, time.Minute * 15} //nolint:gochecknoglobals,gomnd
+
+// rainRate keeps the recent tips of one gauge
+type rainRate struct {
+	mm       float64     // millimeters of rain per tip
+	tips     []time.Time // tips inside the longest window, oldest first
+	reported bool        // whether the last published rate was above zero
+}
+
+func newRainRate(mm float64) *rainRate {
+	return &rainRate{mm: mm, tips: make([]time.Time, 0)}
+}
+
+// record a tip, forgetting any that have aged out of every window
+func (r *rainRate) tip(now time.Time) {
+	r.tips = append(r.tips, now)
+	r.trim(now)
+}
+
+func (r *rainRate) trim(now time.Time) {
+	oldest := now.Add(-rateWindows[len(rateWindows)-1])
+	keep := 0
+	for keep < len(r.tips) && !r.tips[keep].After(oldest) {
+		keep++
+	}
+	r.tips = r.tips[keep:]
+}
+
+// rate in millimeters per hour over each of the windows
+func (r *rainRate) rates(now time.Time) [len(rateWindows)]float64 {
+	var rates [len(rateWindows)]float64
+	r.trim(now)
+	if len(r.tips) == 0 {
+		return rates
+	}
+	// once the tips stop, it can't have rained faster than one tip since the last one, so the rate
+	// decays toward zero instead of holding steady until the tips age out of the window
+	ceiling := -1.0
+	if since := now.Sub(r.tips[len(r.tips)-1]); since > 0 {
+		ceiling = r.mm / since.Hours()
+	}
+	for i, window := range rateWindows {
+		start := now.Add(-window)
+		count := 0
+		for _, tip := range r.tips {
+			if tip.After(start) {
+				count++
+			}
+		}
+		rates[i] = float64(count) * r.mm / window.Hours()
+		if ceiling >= 0 && rates[i] > ceiling {
+			rates[i] = ceiling
+		}
+	}
+	return rates
+}
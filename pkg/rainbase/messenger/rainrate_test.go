@@ -0,0 +1,46 @@
+package messenger
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// tips are averaged over each window, and the rate decays once they stop
+func TestRainRate(t *testing.T) {
+	const mm = 0.2794
+	start := time.Now()
+	rate := newRainRate(mm)
+	if rates := rate.rates(start); rates != [3]float64{} {
+		t.Errorf("expected no rain before the first tip, got %v", rates)
+	}
+
+	// a tip every 30 seconds for 10 minutes
+	for i := 1; i <= 20; i++ {
+		rate.tip(start.Add(time.Second * 30 * time.Duration(i)))
+	}
+	end := start.Add(time.Minute * 10)
+	perHour := mm * 120
+	for i, expected := range []float64{perHour, perHour, perHour * 10 / 15} {
+		if got := rate.rates(end)[i]; math.Abs(got-expected) > 1e-9 {
+			t.Errorf("window %s: expected %f mm/h, got %f", rateWindows[i], expected, got)
+		}
+	}
+
+	// two minutes after the last tip, it can't have rained faster than one tip in two minutes
+	rates := rate.rates(end.Add(time.Minute * 2))
+	if ceiling := mm * 30; rates[1] != ceiling || rates[2] != ceiling {
+		t.Errorf("expected the rate to decay to %f mm/h, got %v", ceiling, rates)
+	}
+	if rates[0] != 0 {
+		t.Errorf("expected no tips in the last minute, got %f mm/h", rates[0])
+	}
+
+	// and nothing once every tip has aged out
+	if rates := rate.rates(end.Add(time.Minute * 15)); rates != [3]float64{} {
+		t.Errorf("expected no rain, got %v", rates)
+	}
+	if len(rate.tips) != 0 {
+		t.Errorf("expected old tips to be forgotten, have %d", len(rate.tips))
+	}
+}
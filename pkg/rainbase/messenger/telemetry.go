@@ -0,0 +1,102 @@
+package messenger
+
+// Read the health of the machine the gateway runs on
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/common/mqtt"
+	"github.com/ntbloom/raincounter/pkg/config"
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// linux exposes these as plain text
+const (
+	procUptime  = "/proc/uptime"
+	procLoadavg = "/proc/loadavg"
+)
+
+// fill in a GatewayStatus with whatever the machine will tell us. Anything unavailable is left nil
+// so it shows up as null rather than a misleading zero.
+func (m *Messenger) addTelemetry(gs *GatewayStatus) {
+	uptime := time.Since(m.started).Seconds()
+	gs.Uptime = &uptime
+	reconnects := mqtt.Reconnects()
+	gs.MQTTReconnects = &reconnects
+	if broker := mqtt.ActiveBroker(); broker != "" {
+		gs.MQTTBroker = &broker
+	}
+	if expires, ok := mqtt.ClientCertExpiry(); ok {
+		gs.CertExpires = &expires
+	}
+	gs.Version = config.Version
+
+	if systemUptime, err := readSystemUptime(); err == nil {
+		gs.SystemUptime = &systemUptime
+	} else {
+		logrus.Tracef("no system uptime: %s", err)
+	}
+	if free, err := diskFree(viper.GetString(configkey.DatabaseLocalFile)); err == nil {
+		gs.DiskFree = &free
+	} else {
+		logrus.Tracef("no free disk space: %s", err)
+	}
+	if tempC, err := readCPUTempC(viper.GetString(configkey.GatewayThermalZone)); err == nil {
+		gs.CPUTempC = &tempC
+	} else {
+		logrus.Tracef("no cpu temperature: %s", err)
+	}
+	if load, err := readLoadavg(); err == nil {
+		gs.Load1, gs.Load5, gs.Load15 = &load[0], &load[1], &load[2]
+	} else {
+		logrus.Tracef("no load average: %s", err)
+	}
+}
+
+// seconds since the machine booted
+func readSystemUptime() (float64, error) {
+	fields, err := readFields(procUptime, 1)
+	if err != nil {
+		return 0, err
+	}
+	return fields[0], nil
+}
+
+// 1, 5 and 15 minute load averages
+func readLoadavg() ([]float64, error) {
+	return readFields(procLoadavg, 3) //nolint:gomnd
+}
+
+// the thermal zone reports millidegrees Celsius
+func readCPUTempC(zone string) (float64, error) {
+	fields, err := readFields(zone, 1)
+	if err != nil {
+		return 0, err
+	}
+	return fields[0] / 1000, nil //nolint:gomnd
+}
+
+// parse the first count whitespace-separated numbers in a file
+func readFields(file string, count int) ([]float64, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < count {
+		return nil, fmt.Errorf("expected %d fields in `%s`, got %d", count, file, len(fields))
+	}
+	values := make([]float64, count)
+	for i := range values {
+		if values[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return nil, fmt.Errorf("bad value in `%s`: %s", file, err)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package messenger
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// bytes available to us on the filesystem holding file
+func diskFree(file string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(file), &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package messenger
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// diskFree isn't supported off linux
+func diskFree(_ string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,44 @@
+package messenger
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// numbers come out of /proc and /sys style files, and bad files are errors rather than zeros
+func TestReadTelemetryFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	load, err := readFields(write("loadavg", "0.52 0.58 0.59 1/389 12345\n"), 3)
+	if err != nil || load[0] != 0.52 || load[1] != 0.58 || load[2] != 0.59 {
+		t.Errorf("bad load average %v: %v", load, err)
+	}
+	tempC, err := readCPUTempC(write("temp", "48312\n"))
+	if err != nil || tempC != 48.312 {
+		t.Errorf("bad cpu temperature %f: %v", tempC, err)
+	}
+	if _, err = readFields(write("short", "1.0\n"), 3); err == nil {
+		t.Error("expected an error on too few fields")
+	}
+	if _, err = readCPUTempC(write("garbage", "hot\n")); err == nil {
+		t.Error("expected an error on a non-number")
+	}
+	if _, err = readCPUTempC(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error on a missing file")
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if free, err := diskFree(filepath.Join(dir, "rainbase.db")); err != nil || free == 0 {
+		t.Errorf("expected free disk space, got %d: %v", free, err)
+	}
+}
@@ -1,6 +1,9 @@
 package rainbase
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,10 +13,14 @@ import (
 
 	"github.com/ntbloom/raincounter/pkg/common/mqtt"
 
+	"github.com/ntbloom/raincounter/pkg/config"
 	"github.com/ntbloom/raincounter/pkg/config/configkey"
 
+	"github.com/ntbloom/raincounter/pkg/rainbase/diagnostics"
 	"github.com/ntbloom/raincounter/pkg/rainbase/messenger"
 	"github.com/ntbloom/raincounter/pkg/rainbase/serial"
+	"github.com/ntbloom/raincounter/pkg/rainbase/supervisor"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 
@@ -21,85 +28,233 @@ import (
 	"github.com/spf13/viper"
 )
 
-// connect to mqtt
-func connectToMQTT() paho.Client {
-	client, err := mqtt.NewConnection()
+// connect to mqtt as the gateway for the configured station, calling onConnect after every connection
+func connectToMQTT(onConnect paho.OnConnectHandler) paho.Client {
+	station, err := config.StationID()
 	if err != nil {
 		panic(err)
 	}
-	return client
+	options, err := mqtt.NewClientOptions(mqtt.ClientID("rainbase-"+station), station)
+	if err != nil {
+		panic(err)
+	}
+	mqtt.OnConnect(options, onConnect)
+	return paho.NewClient(options)
 }
 
-// connect to the localdb postgresql
+// connect to the localdb sqlite, starting from scratch unless it's configured to persist
 func connectToDatabase() *localdb.LocalDB {
-	db, err := localdb.NewLocalDB(viper.GetString(configkey.DatabaseLocalFile), true)
+	clobber := !viper.GetBool(configkey.DatabaseLocalPersist)
+	db, err := localdb.NewLocalDB(viper.GetString(configkey.DatabaseLocalFile), clobber)
 	if err != nil {
 		panic(err)
 	}
 	return db
 }
 
-// get a serial connection
-func connectSerialPort(msgr *messenger.Messenger) *serial.Serial {
-	conn, err := serial.NewConnection(
-		viper.GetString(configkey.USBConnectionPort),
+// get the configured sensors
+func configuredSensors() []config.Sensor {
+	sensors, err := config.Sensors()
+	if err != nil {
+		panic(err)
+	}
+	return sensors
+}
+
+// get a serial connection for one sensor
+func connectSerialPort(sensor config.Sensor, msgr *messenger.Messenger) *serial.Serial {
+	return serial.NewConnection(
+		sensor,
 		viper.GetInt(configkey.USBPacketLengthMax),
 		viper.GetDuration(configkey.USBConnectionTimeout),
 		msgr,
 	)
-	if err != nil {
-		panic(err)
+}
+
+// a supervisor with the configured backoff
+func newSupervisor() *supervisor.Supervisor {
+	return supervisor.New(viper.GetDuration(configkey.SupervisorBackoffMin), viper.GetDuration(configkey.SupervisorBackoffMax))
+}
+
+// serve local diagnostics if an address is configured
+func startDiagnostics(msgr *messenger.Messenger, db *localdb.LocalDB, conns []*serial.Serial) *diagnostics.Server {
+	address := viper.GetString(configkey.DiagnosticsAddress)
+	if address == "" {
+		return nil
+	}
+	server := diagnostics.NewServer(address, func() diagnostics.Status {
+		return collectDiagnostics(msgr, db, conns)
+	})
+	server.Start()
+	return server
+}
+
+// snapshot the state of the rainbase for the diagnostics page
+func collectDiagnostics(msgr *messenger.Messenger, db *localdb.LocalDB, conns []*serial.Serial) diagnostics.Status {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	status := diagnostics.Status{
+		StationID: msgr.StationID(),
+		Version:   config.Version,
+		Uptime:    now.Sub(msgr.Started()).Seconds(),
+		MQTT: diagnostics.MQTTStatus{
+			Connected:     msgr.Connected(),
+			Broker:        mqtt.ActiveBroker(),
+			Reconnects:    mqtt.Reconnects(),
+			OutboxPending: db.OutboxPending(),
+		},
+		Sensors:   make([]diagnostics.SensorStatus, 0),
+		Timestamp: now,
+	}
+	for _, report := range msgr.SensorReports() {
+		_, err := os.Stat(report.Sensor.Port)
+		today := db.ForSensor(report.Sensor.ID)
+		tips, _ := today.TipsBetween(midnight, midnight.AddDate(0, 0, 1))
+		mm, _ := today.RainBetween(midnight, midnight.AddDate(0, 0, 1), report.Sensor.Mm)
+		sensor := diagnostics.SensorStatus{
+			ID:            report.Sensor.ID,
+			Port:          report.Sensor.Port,
+			PortOK:        err == nil,
+			State:         report.State,
+			Reason:        report.Reason,
+			LastPacketAge: report.LastPacketAge,
+			LastTag:       report.LastTag,
+			TipsToday:     tips,
+			RainTodayMm:   mm,
+		}
+		if !report.LastPacket.IsZero() {
+			last := report.LastPacket
+			sensor.LastPacket = &last
+		}
+		for _, conn := range conns {
+			if conn.SensorID() == report.Sensor.ID {
+				sensor.FramingErrors = conn.FramingErrors()
+				sensor.SequenceGaps = conn.SequenceGaps()
+			}
+		}
+		status.Sensors = append(status.Sensors, sensor)
 	}
-	return conn
+	return status
 }
 
 // Start launches program for seconds or indefinitely if duration is negative
 func Start() {
-	client := connectToMQTT()
+	// the messenger makes the first connection when it starts, so it's there for the handler
+	var msgr *messenger.Messenger
+	client := connectToMQTT(func(c paho.Client) { msgr.OnConnect(c) })
 	db := connectToDatabase()
 	msgr, err := messenger.NewMessenger(client, db)
 	if err != nil {
 		panic(err)
 	}
-	conn := connectSerialPort(msgr)
-
-	// start the listening threads
-	go msgr.Start()
-	go conn.Start()
+	conns := make([]*serial.Serial, 0)
+	for _, sensor := range configuredSensors() {
+		logrus.Infof("sensor `%s` on `%s` at %.4f mm per tip", sensor.ID, sensor.Port, sensor.Mm)
+		conns = append(conns, connectSerialPort(sensor, msgr))
+	}
 
-	// start a timer if needed
-	var loopTimer *time.Timer
-	var timerChan <-chan time.Time
+	// run until a signal, or for a while if a duration is configured
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 	duration := viper.GetDuration(configkey.MainLoopDuration)
 	if duration.Seconds() > 0 {
-		loopTimer = time.NewTimer(viper.GetDuration(configkey.MainLoopDuration))
-		timerChan = loopTimer.C
-	}
-
-	// look out for terminal input
-	terminalSignals := make(chan os.Signal, 1)
-	signal.Notify(terminalSignals, syscall.SIGINT, syscall.SIGTERM)
-
-	for {
-		select {
-		case sig := <-terminalSignals:
-			logrus.Infof("program received %s signal, exiting", sig)
-			stopProgram(msgr, conn, loopTimer)
-		case <-timerChan:
-			logrus.Infof("program exiting after %s", duration)
-			stopProgram(msgr, conn, loopTimer)
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	// the messenger has its own context so it can outlive the sensors and drain what they sent
+	msgrCtx, stopMessenger := context.WithCancel(context.Background())
+	defer stopMessenger()
+	services := newSupervisor()
+	services.Go(msgrCtx, "messenger", msgr.Start)
+	sensors := newSupervisor()
+	for _, conn := range conns {
+		sensors.Go(ctx, fmt.Sprintf("sensor `%s`", conn.SensorID()), conn.Start)
+	}
+	diag := startDiagnostics(msgr, db, conns)
+
+	<-ctx.Done()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logrus.Infof("program exiting after %s", duration)
+	} else {
+		logrus.Info("program received a signal, exiting")
+	}
+	stopProgram(stopMessenger, services, sensors, db, diag)
+}
+
+// Command asks the running rainbase to send a single named command to every sensor, or just the one named by
+// the optional second argument, e.g. to pause it for cleaning. It goes over MQTT rather than straight to the
+// port, which the rainbase already holds and which resets the sensor when it's opened.
+func Command(args []string) error {
+	if _, err := tlv.NewCommand(args[0]); err != nil {
+		return err
+	}
+	sc := &messenger.SensorCommand{Command: args[0], Timestamp: time.Now()}
+	if len(args) > 1 {
+		sc.SensorID = args[1]
+		if err := findSensor(sc.SensorID); err != nil {
+			return err
 		}
 	}
+	payload, err := sc.Process()
+	if err != nil {
+		return err
+	}
+	station, err := config.StationID()
+	if err != nil {
+		return err
+	}
+
+	// log in as the gateway, which the broker lets onto its own command topic, without announcing presence
+	viper.Set(configkey.MQTTUsername, mqtt.Username(station))
+	client, err := mqtt.NewConnection("", "")
+	if err != nil {
+		return err
+	}
+	timeout := viper.GetDuration(configkey.MQTTConnectionTimeout)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return errors.New("timed out connecting to mqtt broker")
+	}
+	if err = token.Error(); err != nil {
+		return err
+	}
+	defer client.Disconnect(uint(timeout.Milliseconds()))
+
+	topic := mqtt.StationTopic(station, mqtt.SensorCommandTopic)
+	token = client.Publish(topic, byte(viper.GetInt(configkey.MQTTQos)), false, payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out sending `%s` command", args[0])
+	}
+	if err = token.Error(); err != nil {
+		return err
+	}
+	logrus.Infof("sent `%s` command to %s", args[0], topic)
+	return nil
 }
 
-func stopProgram(msgr *messenger.Messenger, conn *serial.Serial, timer *time.Timer) {
-	if timer != nil {
-		timer.Stop()
+// make sure the sensor is one of ours before asking the rainbase to send it anything
+func findSensor(id string) error {
+	sensors, err := config.Sensors()
+	if err != nil {
+		return err
+	}
+	for _, sensor := range sensors {
+		if sensor.ID == id {
+			return nil
+		}
 	}
-	msgr.Stop()
-	conn.Stop()
+	return fmt.Errorf("no sensor `%s`", id)
+}
 
-	time.Sleep(time.Second * 1)
+// stop the sensors first so nothing new comes in, then let the messenger drain before closing the database
+func stopProgram(stopMessenger context.CancelFunc, services, sensors *supervisor.Supervisor, db *localdb.LocalDB, diag *diagnostics.Server) {
+	if diag != nil {
+		diag.Stop()
+	}
+	sensors.Wait()
+	stopMessenger()
+	services.Wait()
+	db.Close()
 	logrus.Info("Done!")
-	os.Exit(0)
 }
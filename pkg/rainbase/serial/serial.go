@@ -2,156 +2,230 @@
 package serial
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/ntbloom/raincounter/pkg/common/exitcodes"
+	"github.com/ntbloom/raincounter/pkg/config"
 
+	"github.com/ntbloom/raincounter/pkg/rainbase/filter"
 	"github.com/ntbloom/raincounter/pkg/rainbase/messenger"
 	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	readBufferLen = 64                     // how much to read from the port at a time, independent of packet boundaries
+	portPoll      = time.Millisecond * 100 // how often to look for a missing port
+)
+
 // Serial communicates with a serial port
 type Serial struct {
-	port            string               // file descriptor of port
-	maxPacketLen    int                  // how long you expect the packet to be
-	timeout         time.Duration        // how long to wait for enumration
-	data            []byte               // where the data lives
-	file            *os.File             // file descriptor for the port
-	kill            chan struct{}        // send a message to kill the serial loop
-	messageReceived chan struct{}        // channel for waiting for message on serial port
-	Messenger       *messenger.Messenger // messenger object
-	sync.Mutex
+	sensor       config.Sensor        // which sensor is on the other end
+	port         string               // file descriptor of port
+	maxPacketLen int                  // how long you expect the packet to be
+	timeout      time.Duration        // how long to wait for enumration
+	decoder      *tlv.Decoder         // splits the raw byte stream into packets
+	file         *os.File             // file descriptor for the port, nil while it's closed
+	commands     <-chan *tlv.TLV      // commands from the messenger for this sensor
+	filter       *filter.Filter       // drops or flags packets that can't be real
+	Messenger    *messenger.Messenger // messenger object
+	writeLock    sync.Mutex           // guards the file against writes, which mustn't wait on a blocking read
 }
 
-// NewConnection creates a new serial connection with a unix filename
-func NewConnection(port string, maxPacketLen int, timeout time.Duration, msgr *messenger.Messenger) (*Serial, error) {
-	checkPortStatus(port, timeout)
-	logrus.Infof("opening connection on `%s`", port)
-	var data []byte
-
-	// attempt to connect until timeout is exhausted
-
-	file, err := os.Open(port)
-	if err != nil {
-		logrus.Errorf("problem opening port `%s`: %s", port, err)
-		return nil, err
-	}
-
-	uart := &Serial{
-		port,
+// NewConnection makes a serial connection to a sensor and registers it with the messenger. The port is
+// opened by Start, so a sensor that's unplugged at boot doesn't stop the rainbase.
+func NewConnection(sensor config.Sensor, maxPacketLen int, timeout time.Duration, msgr *messenger.Messenger) *Serial {
+	return &Serial{
+		sensor,
+		sensor.Port,
 		maxPacketLen,
 		timeout,
-		data,
-		file,
-		make(chan struct{}, 1),
-		make(chan struct{}, 1),
+		tlv.NewDecoder(maxPacketLen),
+		nil,
+		msgr.Register(sensor),
+		filter.New(sensor),
 		msgr,
 		sync.Mutex{},
 	}
-
-	return uart, nil
 }
 
-// Start runs the main loop of listening on the serial port
-func (serial *Serial) Start() {
-	checkPortStatus(serial.port, serial.timeout)
+// Start listens on the serial port until ctx is cancelled. It returns an error if the port doesn't show up
+// within the timeout or the connection is lost; calling Start again reopens it.
+func (serial *Serial) Start(ctx context.Context) error {
+	if err := serial.open(ctx); err != nil {
+		return err
+	}
+	defer serial.close()
 
-	// send the first waiting command
-	go serial.waitForMessage()
+	// a blocking read can't be cancelled, so read in the background and close the port to stop it
+	reads := make(chan error, 1)
+	go func() {
+		reads <- serial.read()
+	}()
 
-	// wait for next message or the kill signal
 	for {
 		select {
-		case <-serial.kill:
+		case <-ctx.Done():
 			serial.close()
-			return
-		case <-serial.messageReceived:
-			go serial.waitForMessage()
+			<-reads
+			return nil
+		case err := <-reads:
+			return err
+		case cmd := <-serial.commands:
+			if err := serial.Send(cmd); err != nil {
+				logrus.Errorf("unable to send command to `%s`: %s", serial.port, err)
+			}
 		}
 	}
 }
 
-// Stop stops the main loop listening on the serial port
-func (serial *Serial) Stop() {
-	serial.kill <- struct{}{}
+// Send writes a TLV packet to the sensor
+func (serial *Serial) Send(packet *tlv.TLV) error {
+	serial.writeLock.Lock()
+	defer serial.writeLock.Unlock()
+	if serial.file == nil {
+		return fmt.Errorf("port `%s` is closed", serial.port)
+	}
+	return write(serial.file, packet)
 }
 
-// waits for a message, then updates the main loop when it arrives
-func (serial *Serial) waitForMessage() {
-	serial.Lock()
-	defer serial.Unlock()
+// reads packets and hands them to the messenger until the port fails or is closed
+func (serial *Serial) read() error {
+	serial.writeLock.Lock()
+	file := serial.file
+	serial.writeLock.Unlock()
 
-	logrus.Tracef("waiting to read contents of `%s`", serial.port)
-	packet := make([]byte, serial.maxPacketLen)
+	raw := make([]byte, readBufferLen)
+	for {
+		logrus.Tracef("waiting to read contents of `%s`", serial.port)
+		n, err := file.Read(raw)
+		if err != nil {
+			return fmt.Errorf("lost connection to `%s`: %w", serial.port, err)
+		}
+		logrus.Trace("serial data arrived")
+		serial.decode(raw[:n])
+	}
+}
 
-	_, err := serial.file.Read(packet)
-	if err != nil {
-		// connection to file was lost, attempt reconnection
-		logrus.Infof("connection lost, attempting reconnection")
-		checkPortStatus(serial.port, serial.timeout)
-		_ = serial.reopenConnection()
+// turn raw data into messages. The messenger outlives every serial connection, so it's safe to wait on it.
+func (serial *Serial) decode(raw []byte) {
+	for _, tlvPacket := range serial.decoder.Decode(raw) {
+		if tlvPacket.Missed > 0 {
+			serial.reportGap(tlvPacket.Missed)
+		}
+		reading := serial.filter.Apply(tlvPacket, time.Now())
+		msg, err := serial.Messenger.NewMessage(serial.sensor, reading)
+		if err != nil {
+			logrus.Errorf("bad tlv packet, ignoring: %v", err)
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+		serial.Messenger.Data <- msg
 	}
-	logrus.Trace("a serial message arrived")
-	serial.messageReceived <- struct{}{}
+}
 
-	tlvPacket, err := tlv.NewTLV(packet)
+// publish the running gap count when packets go missing between the sensor and the gateway
+func (serial *Serial) reportGap(missed int) {
+	msg, err := serial.Messenger.NewLinkStatusMessage(serial.sensor.ID, missed, serial.SequenceGaps(), serial.FramingErrors())
 	if err != nil {
-		logrus.Errorf("unexpected TLV packet: %s", err)
+		logrus.Errorf("unable to report sequence gap: %s", err)
 		return
 	}
-	msg, err := serial.Messenger.NewMessage(tlvPacket)
-	if err != nil {
-		logrus.Errorf("bad tlv packet, ignoring: %s", err)
-	}
 	serial.Messenger.Data <- msg
 }
 
-// reopens the serial connection if it gets broken
-func (serial *Serial) reopenConnection() error {
-	file, err := os.Open(serial.port)
+// SensorID is the sensor on the other end of the port
+func (serial *Serial) SensorID() string {
+	return serial.sensor.ID
+}
+
+// SequenceGaps counts v2 packets the sensor sent that never arrived
+func (serial *Serial) SequenceGaps() uint64 {
+	return serial.decoder.SequenceGaps()
+}
+
+// FramingErrors counts data from the port that couldn't be decoded into a packet
+func (serial *Serial) FramingErrors() uint64 {
+	return serial.decoder.FramingErrors()
+}
+
+// waits for the port to show up and opens it, dropping any partial packet from before
+func (serial *Serial) open(ctx context.Context) error {
+	serial.writeLock.Lock()
+	defer serial.writeLock.Unlock()
+	if serial.file != nil {
+		return nil
+	}
+	if err := checkPortStatus(ctx, serial.port, serial.timeout); err != nil {
+		return err
+	}
+	logrus.Infof("opening connection on `%s`", serial.port)
+	file, err := openPort(serial.port)
 	if err != nil {
-		logrus.Debugf("port `%s` temporarily down: %s", serial.port, err)
+		logrus.Errorf("problem opening port `%s`: %s", serial.port, err)
 		return err
 	}
 	serial.file = file
+	serial.decoder.Reset()
 	return nil
 }
 
-// closes the serial port, to be used at the end of the program
+// opens the port for reading packets and writing commands
+func openPort(port string) (*os.File, error) {
+	return os.OpenFile(port, os.O_RDWR, 0)
+}
+
+// encodes a TLV packet and writes it to the port
+func write(file *os.File, packet *tlv.TLV) error {
+	raw, err := packet.Encode()
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("writing packet %q to `%s`", raw, file.Name())
+	_, err = file.Write(raw)
+	return err
+}
+
+// closes the serial port, which also stops a read that's waiting on it
 func (serial *Serial) close() {
+	serial.writeLock.Lock()
+	defer serial.writeLock.Unlock()
+	if serial.file == nil {
+		return
+	}
 	logrus.Infof("closing serial port `%s`", serial.port)
-	err := serial.file.Close()
-	if err != nil {
+	if err := serial.file.Close(); err != nil {
 		logrus.Errorf("problem closing `%s`: %s", serial.port, err)
 	}
+	serial.file = nil
 }
 
-// make sure we can access the serial port else fail
-func checkPortStatus(port string, timeout time.Duration) {
+// wait for the serial port to exist, giving up after the timeout
+func checkPortStatus(ctx context.Context, port string, timeout time.Duration) error {
 	logrus.Debugf("checking if `%s` exists", port)
-	start := time.Now()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(portPoll)
+	defer poll.Stop()
 	for {
 		_, err := os.Stat(port)
 		if err == nil {
 			logrus.Debugf("found port `%s`", port)
-			return
+			return nil
 		}
 		logrus.Tracef("file `%s` doesn't exist on first look, re-checking for %s", port, timeout)
-		if time.Since(start).Milliseconds() > timeout.Milliseconds() {
-			handlePortFailure(port)
-			return
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("unable to locate sensor at `%s`: %w", port, err)
+		case <-poll.C:
 		}
 	}
 }
-
-// handles what to do when sensor is unresponsive
-func handlePortFailure(port string) {
-	logrus.Fatalf("unable to locate sensor at `%s`", port)
-
-	// for now...
-	os.Exit(exitcodes.SerialPortNotFound)
-}
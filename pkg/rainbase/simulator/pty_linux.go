@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package simulator
+
+// Open a pseudo-terminal without cgo or any extra dependencies
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY opens a new pseudo-terminal in raw mode, returning both ends and the path to the slave
+func openPTY() (*os.File, *os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	fd := int(master.Fd())
+
+	// unlock the slave and find out where it lives
+	if err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		_ = master.Close()
+		return nil, nil, "", fmt.Errorf("unable to unlock pty: %s", err)
+	}
+	num, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, "", fmt.Errorf("unable to get pty number: %s", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", num)
+
+	// hold the slave open so the master doesn't see EIO while the gateway reconnects
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, "", err
+	}
+	if err = makeRaw(int(slave.Fd())); err != nil {
+		_ = slave.Close()
+		_ = master.Close()
+		return nil, nil, "", fmt.Errorf("unable to put pty in raw mode: %s", err)
+	}
+	return master, slave, slavePath, nil
+}
+
+// turn off echo, line editing and newline translation, like cfmakeraw(3)
+func makeRaw(fd int) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
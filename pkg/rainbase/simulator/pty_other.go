@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package simulator
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// openPTY isn't supported off linux
+func openPTY() (*os.File, *os.File, string, error) {
+	return nil, nil, "", fmt.Errorf("pseudo-terminals aren't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,292 @@
+// Package simulator emulates a rain gauge on a pseudo-terminal so the gateway can run without hardware
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// StormStep is one stretch of a storm profile
+type StormStep struct {
+	Duration time.Duration // how long the step lasts
+	Rate     float64       // rainfall in mm/h, 0 for a dry spell
+}
+
+// Simulator sends TLV packets like the arduino would, and answers commands from the gateway
+type Simulator struct {
+	Port          string        // path to the slave end, for usb.connection.port
+	master        *os.File      // our end of the pty
+	slave         *os.File      // held open so the pty survives the gateway reconnecting
+	link          string        // optional symlink to Port
+	profile       []StormStep   // storm profile, repeated forever
+	mmPerTip      float64       // calibration of the simulated bucket
+	tempInterval  time.Duration // how often to send temperature
+	eventInterval time.Duration // how often to pause, unpause or reset on our own
+	tempC         float64       // current simulated temperature
+	framing       int           // TLV framing version, 1 or 2
+	sequence      uint16        // next v2 sequence number
+	paused        bool          // whether rain and temperature are suppressed
+	commands      chan *tlv.TLV // commands received from the gateway
+	kill          chan struct{} // send a message to kill the main loop
+	rand          *rand.Rand    // source of jitter
+	sync.Mutex                  // guards writes to the pty
+}
+
+// NewSimulator opens a pty and configures the simulator from viper
+func NewSimulator() (*Simulator, error) {
+	var profile []StormStep
+	if err := viper.UnmarshalKey(configkey.SimulateStormProfile, &profile); err != nil {
+		return nil, fmt.Errorf("bad storm profile: %s", err)
+	}
+	if len(profile) == 0 {
+		return nil, fmt.Errorf("storm profile `%s` is empty", configkey.SimulateStormProfile)
+	}
+	for _, step := range profile {
+		if step.Duration <= 0 || step.Rate < 0 {
+			return nil, fmt.Errorf("bad storm profile step %+v", step)
+		}
+	}
+	framing := viper.GetInt(configkey.SimulateFraming)
+	if framing != 1 && framing != 2 {
+		return nil, fmt.Errorf("unsupported TLV framing version %d", framing)
+	}
+
+	master, slave, port, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	sim := &Simulator{
+		Port:          port,
+		master:        master,
+		slave:         slave,
+		link:          viper.GetString(configkey.SimulateLink),
+		profile:       profile,
+		mmPerTip:      viper.GetFloat64(configkey.SensorRainMm),
+		tempInterval:  viper.GetDuration(configkey.SimulateTemperatureInterval),
+		eventInterval: viper.GetDuration(configkey.SimulateEventInterval),
+		tempC:         viper.GetFloat64(configkey.SimulateTemperatureBase),
+		framing:       framing,
+		commands:      make(chan *tlv.TLV, 1),
+		kill:          make(chan struct{}, 1),
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+	}
+	if sim.link != "" {
+		_ = os.Remove(sim.link)
+		if err = os.Symlink(port, sim.link); err != nil {
+			sim.close()
+			return nil, err
+		}
+	}
+	return sim, nil
+}
+
+// Start runs the main loop of sending packets until Stop is called
+func (s *Simulator) Start() {
+	defer s.close()
+	go s.listen()
+
+	// the arduino announces itself after boot
+	s.send(tlv.HardReset, 1)
+
+	step := 0
+	stepTimer := time.NewTimer(s.profile[step].Duration)
+	tipTimer, tipChan := s.nextTip(step)
+	tempTicker := time.NewTicker(s.tempInterval)
+	eventChan, eventTicker := s.eventTicker()
+	events := []int{tlv.Pause, tlv.Unpause, tlv.SoftReset}
+	event := 0
+	defer func() {
+		stepTimer.Stop()
+		tempTicker.Stop()
+		if eventTicker != nil {
+			eventTicker.Stop()
+		}
+		if tipTimer != nil {
+			tipTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-s.kill:
+			return
+		case <-stepTimer.C:
+			step = (step + 1) % len(s.profile)
+			logrus.Infof("storm profile now at %.2f mm/h for %s", s.profile[step].Rate, s.profile[step].Duration)
+			stepTimer.Reset(s.profile[step].Duration)
+			if tipTimer != nil {
+				tipTimer.Stop()
+			}
+			tipTimer, tipChan = s.nextTip(step)
+		case <-tipChan:
+			if !s.paused {
+				s.send(tlv.Rain, 1)
+			}
+			tipTimer, tipChan = s.nextTip(step)
+		case <-tempTicker.C:
+			if !s.paused {
+				s.sendTemperature()
+			}
+		case <-eventChan:
+			s.handle(events[event])
+			event = (event + 1) % len(events)
+		case cmd := <-s.commands:
+			logrus.Infof("received command with tag %d from the gateway", cmd.Tag)
+			s.handle(cmd.Tag)
+		}
+	}
+}
+
+// Stop kills the main loop and closes the pty
+func (s *Simulator) Stop() {
+	logrus.Info("stopping the simulator")
+	s.kill <- struct{}{}
+}
+
+// act on an event, whether it was our idea or the gateway's
+func (s *Simulator) handle(tag int) {
+	switch tag {
+	case tlv.Pause:
+		s.paused = true
+		s.send(tlv.Pause, 1)
+	case tlv.Unpause:
+		s.paused = false
+		s.send(tlv.Unpause, 1)
+	case tlv.SoftReset:
+		s.send(tlv.SoftReset, 1)
+	case tlv.Temperature:
+		s.sendTemperature()
+	default:
+		logrus.Warnf("simulator ignoring tag %d", tag)
+	}
+}
+
+// schedule the next rain tip for a step, with exponentially distributed gaps like real rain
+func (s *Simulator) nextTip(step int) (*time.Timer, <-chan time.Time) {
+	rate := s.profile[step].Rate
+	if rate == 0 {
+		return nil, nil
+	}
+	meanSeconds := s.mmPerTip / rate * time.Hour.Seconds()
+	wait := time.Duration(s.rand.ExpFloat64() * meanSeconds * float64(time.Second))
+	timer := time.NewTimer(wait)
+	return timer, timer.C
+}
+
+// a nil channel never fires, which disables automatic events
+func (s *Simulator) eventTicker() (<-chan time.Time, *time.Ticker) {
+	if s.eventInterval <= 0 {
+		return nil, nil
+	}
+	ticker := time.NewTicker(s.eventInterval)
+	return ticker.C, ticker
+}
+
+// wander the temperature a little and send it
+func (s *Simulator) sendTemperature() {
+	s.tempC += s.rand.NormFloat64() * 0.5 //nolint:gomnd
+	s.send(tlv.Temperature, int(math.Round(s.tempC)))
+}
+
+// encode and write a packet to the pty
+func (s *Simulator) send(tag, value int) {
+	s.Lock()
+	defer s.Unlock()
+
+	length := 1
+	if tag == tlv.Temperature {
+		length = 4
+	}
+	packet := &tlv.TLV{Tag: tag, Length: length, Value: value}
+	var raw []byte
+	var err error
+	if s.framing == 2 { //nolint:gomnd
+		raw, err = packet.EncodeV2(s.sequence)
+		s.sequence++
+	} else {
+		raw, err = packet.Encode()
+	}
+	if err != nil {
+		logrus.Errorf("unable to encode packet: %s", err)
+		return
+	}
+	logrus.Debugf("simulator sending %q", raw)
+	if _, err = s.master.Write(raw); err != nil {
+		logrus.Errorf("problem writing to pty: %s", err)
+	}
+}
+
+// read commands from the gateway until the pty closes
+func (s *Simulator) listen() {
+	decoder := tlv.NewDecoder(viper.GetInt(configkey.USBPacketLengthMax))
+	raw := make([]byte, 64) //nolint:gomnd
+	for {
+		n, err := s.master.Read(raw)
+		if err != nil {
+			logrus.Debugf("simulator no longer listening: %s", err)
+			return
+		}
+		for _, cmd := range decoder.Decode(raw[:n]) {
+			s.commands <- cmd
+		}
+	}
+}
+
+// close both ends of the pty and remove the symlink
+func (s *Simulator) close() {
+	if s.link != "" {
+		_ = os.Remove(s.link)
+	}
+	for _, f := range []*os.File{s.slave, s.master} {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("problem closing `%s`: %s", f.Name(), err)
+		}
+	}
+}
+
+// Start launches a simulated rain gauge for seconds or indefinitely if duration is negative
+func Start() {
+	sim, err := NewSimulator()
+	if err != nil {
+		panic(err)
+	}
+	if sim.link != "" {
+		logrus.Infof("simulating a rain gauge at `%s` (linked from `%s`)", sim.Port, sim.link)
+	} else {
+		logrus.Infof("simulating a rain gauge at `%s`", sim.Port)
+	}
+	go sim.Start()
+
+	// start a timer if needed
+	var timerChan <-chan time.Time
+	duration := viper.GetDuration(configkey.MainLoopDuration)
+	if duration.Seconds() > 0 {
+		timerChan = time.After(duration)
+	}
+
+	// look out for terminal input
+	terminalSignals := make(chan os.Signal, 1)
+	signal.Notify(terminalSignals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case sig := <-terminalSignals:
+		logrus.Infof("program received %s signal, exiting", sig)
+	case <-timerChan:
+		logrus.Infof("program exiting after %s", duration)
+	}
+	sim.Stop()
+	time.Sleep(time.Millisecond * 100) //nolint:gomnd
+	logrus.Info("Done!")
+}
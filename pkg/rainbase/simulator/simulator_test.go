@@ -0,0 +1,111 @@
+package simulator_test
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/config/configkey"
+	"github.com/ntbloom/raincounter/pkg/rainbase/simulator"
+	"github.com/ntbloom/raincounter/pkg/rainbase/tlv"
+
+	"github.com/spf13/viper"
+)
+
+// a fast simulator that rains hard and reports temperature constantly
+func simulatorFixture(t *testing.T, framing int, rate float64) *simulator.Simulator {
+	if runtime.GOOS != "linux" {
+		t.Skip("pseudo-terminals are only supported on linux")
+	}
+	viper.Set(configkey.USBPacketLengthMax, 15)
+	viper.Set(configkey.SensorRainMm, 0.2794)
+	viper.Set(configkey.SimulateFraming, framing)
+	viper.Set(configkey.SimulateStormProfile, []map[string]interface{}{{"duration": "1m", "rate": rate}})
+	viper.Set(configkey.SimulateTemperatureInterval, time.Millisecond*50)
+	viper.Set(configkey.SimulateTemperatureBase, 20)
+	viper.Set(configkey.SimulateEventInterval, 0)
+	sim, err := simulator.NewSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+// read packets off the slave end of the pty like the gateway would, until count arrive or one has the until tag
+func readPackets(t *testing.T, port *os.File, count int, until int) []*tlv.TLV {
+	decoder := tlv.NewDecoder(15)
+	packets := make([]*tlv.TLV, 0)
+	raw := make([]byte, 64)
+	if err := port.SetReadDeadline(time.Now().Add(time.Second * 5)); err != nil {
+		t.Fatal(err)
+	}
+	for len(packets) < count {
+		n, err := port.Read(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := decoder.Decode(raw[:n])
+		packets = append(packets, decoded...)
+		for _, packet := range decoded {
+			if packet.Tag == until {
+				return packets
+			}
+		}
+	}
+	if decoder.FramingErrors() != 0 || decoder.SequenceGaps() != 0 {
+		t.Errorf("framing errors=%d, sequence gaps=%d", decoder.FramingErrors(), decoder.SequenceGaps())
+	}
+	return packets
+}
+
+// the simulator boots like the arduino then sends rain and temperature
+func TestSimulatorSendsPackets(t *testing.T) {
+	for _, framing := range []int{1, 2} {
+		sim := simulatorFixture(t, framing, 10000)
+		port, err := os.OpenFile(sim.Port, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sim.Start()
+
+		packets := readPackets(t, port, 20, -1)
+		if len(packets) < 20 {
+			t.Fatalf("only received %d packets", len(packets))
+		}
+		if packets[0].Tag != tlv.HardReset || packets[0].Version != framing {
+			t.Errorf("expected a v%d hard reset first, got %+v", framing, packets[0])
+		}
+		tags := make(map[int]int)
+		for _, packet := range packets {
+			tags[packet.Tag]++
+		}
+		if tags[tlv.Rain] == 0 || tags[tlv.Temperature] == 0 {
+			t.Errorf("expected rain and temperature, got %v", tags)
+		}
+		sim.Stop()
+		_ = port.Close()
+	}
+}
+
+// the simulator answers commands sent by the gateway
+func TestSimulatorAnswersCommands(t *testing.T) {
+	sim := simulatorFixture(t, 1, 0)
+	port, err := os.OpenFile(sim.Port, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = port.Close() }()
+	go sim.Start()
+	defer sim.Stop()
+
+	cmd, _ := tlv.NewCommand("pause")
+	raw, _ := cmd.Encode()
+	if _, err = port.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	packets := readPackets(t, port, 10, tlv.Pause)
+	if last := packets[len(packets)-1]; last.Tag != tlv.Pause {
+		t.Fatal("simulator never acknowledged the pause command")
+	}
+}
@@ -0,0 +1,80 @@
+// Package supervisor keeps the long-running parts of the rainbase going, restarting them when they fail
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Component runs until its context is cancelled, returning an error if it can't carry on
+type Component func(ctx context.Context) error
+
+// Supervisor restarts failed components with exponential backoff
+type Supervisor struct {
+	min time.Duration // wait before the first restart
+	max time.Duration // longest wait between restarts, and how long a component has to run to be healthy again
+	wg  sync.WaitGroup
+}
+
+// New makes a Supervisor that backs off from min up to max between restarts
+func New(min, max time.Duration) *Supervisor {
+	return &Supervisor{min: min, max: max}
+}
+
+// Go runs a component in the background until ctx is cancelled. A component that returns an error, returns
+// early or panics is restarted after a backoff.
+func (s *Supervisor) Go(ctx context.Context, name string, run Component) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		backoff := s.min
+		for {
+			started := time.Now()
+			err := protect(ctx, run)
+			if ctx.Err() != nil {
+				if err != nil && !errors.Is(err, ctx.Err()) {
+					logrus.Errorf("%s stopped with an error: %s", name, err)
+				}
+				logrus.Debugf("%s stopped", name)
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("returned before it was told to stop")
+			}
+
+			// a component that ran a good while before failing starts over with a short wait
+			if time.Since(started) > s.max {
+				backoff = s.min
+			}
+			logrus.Errorf("%s failed, restarting in %s: %s", name, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > s.max {
+				backoff = s.max
+			}
+		}
+	}()
+}
+
+// Wait blocks until every component has stopped
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// run a component, turning a panic into an error so one bad packet can't take down the rainbase
+func protect(ctx context.Context, run Component) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(ctx)
+}
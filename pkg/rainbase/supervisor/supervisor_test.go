@@ -0,0 +1,68 @@
+package supervisor_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ntbloom/raincounter/pkg/rainbase/supervisor"
+)
+
+// a failing component is restarted until it's told to stop, and a panic counts as a failure
+func TestRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var runs int32
+	healthy := make(chan struct{})
+	sup := supervisor.New(time.Millisecond, time.Millisecond*10)
+	sup.Go(ctx, "flaky", func(ctx context.Context) error {
+		switch atomic.AddInt32(&runs, 1) {
+		case 1:
+			return errors.New("port is gone")
+		case 2:
+			panic("bad packet")
+		case 3:
+			return nil
+		}
+		close(healthy)
+		<-ctx.Done()
+		return nil
+	})
+
+	select {
+	case <-healthy:
+	case <-time.After(time.Second):
+		t.Fatalf("component wasn't restarted, ran %d times", atomic.LoadInt32(&runs))
+	}
+	cancel()
+	sup.Wait()
+	if runs := atomic.LoadInt32(&runs); runs != 4 {
+		t.Errorf("expected 4 runs, got %d", runs)
+	}
+}
+
+// cancelling stops the backoff too, so shutdown doesn't wait on a restart
+func TestStopDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := make(chan struct{})
+	sup := supervisor.New(time.Hour, time.Hour)
+	sup.Go(ctx, "broken", func(ctx context.Context) error {
+		close(failed)
+		return errors.New("broken")
+	})
+	<-failed
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		sup.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("supervisor kept waiting to restart after it was cancelled")
+	}
+}
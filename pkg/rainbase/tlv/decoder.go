@@ -0,0 +1,128 @@
+package tlv
+
+// Split a raw byte stream from the serial port into TLV packets
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Decoder buffers bytes from the serial port and splits them into packets on the newline terminator.
+// Reads don't need to line up with packets: a packet can arrive across several reads or share a read
+// with others. Anything that doesn't decode is counted as a framing error and skipped up to the next
+// newline, so the stream resyncs after garbage. v1 and v2 frames are told apart automatically, and
+// skips in v2 sequence numbers are counted as gaps.
+type Decoder struct {
+	maxPacketLen  int    // longest packet we expect, newline excluded
+	buf           []byte // bytes received since the last newline
+	overflow      bool   // current line is already too long, discard it at the next newline
+	framingErrors uint64 // count of lines that didn't decode
+	sequenceGaps  uint64 // count of v2 packets that never arrived
+	lastSequence  uint16 // sequence number of the last v2 packet
+	sequenced     bool   // whether lastSequence has been set yet
+}
+
+// NewDecoder makes a Decoder for packets up to maxPacketLen bytes long
+func NewDecoder(maxPacketLen int) *Decoder {
+	return &Decoder{
+		maxPacketLen: maxPacketLen,
+		buf:          make([]byte, 0, maxPacketLen),
+	}
+}
+
+// Decode consumes raw bytes and returns every complete packet in them
+func (d *Decoder) Decode(raw []byte) []*TLV {
+	packets := make([]*TLV, 0)
+	for len(raw) > 0 {
+		idx := bytes.IndexByte(raw, newline)
+		if idx < 0 {
+			d.buffer(raw)
+			break
+		}
+		d.buffer(raw[:idx])
+		raw = raw[idx+1:]
+		if packet := d.frame(); packet != nil {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+// FramingErrors is how many lines have been rejected since the Decoder was made
+func (d *Decoder) FramingErrors() uint64 {
+	return atomic.LoadUint64(&d.framingErrors)
+}
+
+// SequenceGaps is how many v2 packets were skipped since the Decoder was made
+func (d *Decoder) SequenceGaps() uint64 {
+	return atomic.LoadUint64(&d.sequenceGaps)
+}
+
+// Reset drops any partial packet, e.g. after the port is reopened
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.overflow = false
+}
+
+// add bytes to the current line, giving up on it if it grows past the longest packet
+func (d *Decoder) buffer(raw []byte) {
+	if d.overflow {
+		return
+	}
+	if len(d.buf)+len(raw) > d.maxPacketLen {
+		d.overflow = true
+		d.buf = d.buf[:0]
+		return
+	}
+	d.buf = append(d.buf, raw...)
+}
+
+// decode the current line and start a new one
+func (d *Decoder) frame() *TLV {
+	defer d.Reset()
+	if d.overflow {
+		d.framingError("line longer than %d bytes", d.maxPacketLen)
+		return nil
+	}
+	line := bytes.TrimSuffix(d.buf, []byte{'\r'})
+	if len(line) == 0 {
+		return nil
+	}
+	packet, err := NewTLV(line)
+	if err != nil {
+		d.framingError("%s", err)
+		return nil
+	}
+	if packet.Version == 2 { //nolint:gomnd
+		d.sequence(packet)
+	}
+	return packet
+}
+
+// check a v2 packet's sequence number against the last one
+func (d *Decoder) sequence(packet *TLV) {
+	defer func() {
+		d.lastSequence = packet.Sequence
+		d.sequenced = true
+	}()
+	// a hard reset means the arduino rebooted and started counting over
+	if !d.sequenced || packet.Tag == HardReset {
+		return
+	}
+	missed := missedBetween(d.lastSequence, packet.Sequence)
+	switch {
+	case missed < 0:
+		logrus.Warnf("sequence went from %d to %d, restarting count", d.lastSequence, packet.Sequence)
+	case missed > 0:
+		packet.Missed = missed
+		total := atomic.AddUint64(&d.sequenceGaps, uint64(missed))
+		logrus.Warnf("missed %d packets between sequence %d and %d, %d total", missed, d.lastSequence, packet.Sequence, total)
+	}
+}
+
+func (d *Decoder) framingError(format string, args ...interface{}) {
+	count := atomic.AddUint64(&d.framingErrors, 1)
+	logrus.Warnf("framing error #%d, skipping to next packet: "+format, append([]interface{}{count}, args...)...)
+}
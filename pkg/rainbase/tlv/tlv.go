@@ -3,15 +3,19 @@ package tlv
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/sirupsen/logrus"
 )
 
 // TLV: tag, length, value encoding for binary packets received over serial
 type TLV struct {
-	Tag    int
-	Length int
-	Value  int
+	Tag      int
+	Length   int
+	Value    int
+	Version  int    // framing version, 1 or 2
+	Sequence uint16 // sequence number, v2 frames only
+	Missed   int    // v2 packets lost just before this one, filled in by a Decoder
 }
 
 // tags for TLV packets
@@ -41,35 +45,44 @@ const (
 
 const maxInt = 65535
 
-// decode from ascii representation of the byte
-func asciiToInt(b byte) int {
-	// use a hash table for faster lookups than other conversion
-	dict := map[byte]int{
-		48: 0,
-		49: 1,
-		50: 2,
-		51: 3,
-		52: 4,
-		53: 5,
-		54: 6,
-		55: 7,
-		56: 8,
-		57: 9,
-		65: 10,
-		66: 11,
-		67: 12,
-		68: 13,
-		69: 14,
-		70: 15,
+// packet terminator, sent after every packet in either direction
+const newline = '\n'
+
+// commands the arduino accepts over serial, mapped to the tag it expects
+var commands = map[string]int{ //nolint:gochecknoglobals
+	"pause":       Pause,
+	"unpause":     Unpause,
+	"reset":       SoftReset,
+	"temperature": Temperature,
+}
+
+// decode from ascii representation of the byte, false if it isn't an uppercase hex digit
+func asciiToInt(b byte) (int, bool) {
+	switch {
+	case b >= '0' && b <= '9':
+		return int(b - '0'), true
+	case b >= 'A' && b <= 'F':
+		return int(b-'A') + 10, true //nolint:gomnd
+	default:
+		return 0, false
 	}
-	return dict[b]
 }
 
-//  concatenate a 4-byte array into its integer equivalent
-func concatenateBytesToInt(b []byte) int {
+// encode an integer 0-15 as the ascii representation of its hex digit
+func intToASCII(i int) byte {
+	const hex = "0123456789ABCDEF"
+	return hex[i&0xF]
+}
+
+// concatenate a 4-byte array into its integer equivalent
+func concatenateBytesToInt(b []byte) (int, error) {
 	asNums := make([]int, 4)
 	for idx, val := range b {
-		asNums[idx] = asciiToInt(val)
+		num, ok := asciiToInt(val)
+		if !ok {
+			return 0, fmt.Errorf("non-hex byte %q in value", val)
+		}
+		asNums[idx] = num
 	}
 	value := asNums[0] << 12
 	value |= asNums[1] << 8
@@ -80,26 +93,53 @@ func concatenateBytesToInt(b []byte) int {
 	if asNums[0] > 0 {
 		value -= maxInt
 	}
-	return value
+	return value, nil
 }
 
-// NewTLV makes a new TLV packet
+// NewTLV makes a new TLV packet from a v1 or v2 frame, with or without its trailing newline
 func NewTLV(packet []byte) (*TLV, error) {
-	rawTag := packet[0]
-	tag := asciiToInt(rawTag)
+	if len(packet) > 0 && packet[len(packet)-1] == newline {
+		packet = packet[:len(packet)-1]
+	}
+	if len(packet) > 0 && packet[0] == v2Marker {
+		return decodeV2(packet)
+	}
+	return decodeV1(packet)
+}
+
+// decode a v1 packet without its newline
+func decodeV1(packet []byte) (*TLV, error) {
+	if len(packet) < 2 {
+		return nil, fmt.Errorf("packet %q too short", packet)
+	}
 
-	rawLength := packet[1]
-	length := asciiToInt(rawLength)
+	tag, ok := asciiToInt(packet[0])
+	if !ok || tag > Unpause {
+		return nil, fmt.Errorf("unsupported tag %q in packet %q", packet[0], packet)
+	}
+	length, ok := asciiToInt(packet[1])
+	if !ok {
+		return nil, fmt.Errorf("non-hex length %q in packet %q", packet[1], packet)
+	}
+	if len(packet) != length+2 {
+		return nil, fmt.Errorf("packet %q doesn't match its length %d", packet, length)
+	}
 
 	var value int
+	var err error
 	switch length {
 	case constant:
-		// static value, doesn't matter
+		// static value, doesn't matter as long as it's valid
+		if _, ok = asciiToInt(packet[2]); !ok {
+			return nil, fmt.Errorf("non-hex value %q in packet %q", packet[2], packet)
+		}
 		value = 1
 	case variable:
 		// convert it to an integer
-		rawValue := packet[2:6] // packet[6] is newline
-		value = concatenateBytesToInt(rawValue)
+		rawValue := packet[2:6]
+		if value, err = concatenateBytesToInt(rawValue); err != nil {
+			return nil, fmt.Errorf("packet %q: %s", packet, err)
+		}
 	default:
 		err := fmt.Errorf("unsupported tag/length/value: %d/%d/%d", tag, length, value)
 		return nil, err
@@ -110,9 +150,58 @@ func NewTLV(packet []byte) (*TLV, error) {
 	logrus.Tracef("Length=%d", length)
 	logrus.Tracef("Value=%d", value)
 	tlv := &TLV{
-		tag,
-		length,
-		value,
+		Tag:     tag,
+		Length:  length,
+		Value:   value,
+		Version: 1,
 	}
 	return tlv, nil
 }
+
+// NewCommand makes a TLV packet for a named command to send to the arduino
+func NewCommand(name string) (*TLV, error) {
+	tag, ok := commands[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported command `%s`, expected one of %v", name, CommandNames())
+	}
+	return &TLV{
+		Tag:     tag,
+		Length:  constant,
+		Value:   1,
+		Version: 1,
+	}, nil
+}
+
+// CommandNames lists the commands the arduino accepts
+func CommandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Encode turns a TLV into the ascii packet sent over serial, including the newline
+func (t *TLV) Encode() ([]byte, error) {
+	packet := []byte{intToASCII(t.Tag), intToASCII(t.Length)}
+	switch t.Length {
+	case constant:
+		packet = append(packet, intToASCII(t.Value))
+	case variable:
+		value := t.Value
+		// mirror the negative number handling in concatenateBytesToInt
+		if value < 0 {
+			value += maxInt
+		}
+		packet = append(packet,
+			intToASCII(value>>12),
+			intToASCII(value>>8),
+			intToASCII(value>>4),
+			intToASCII(value),
+		)
+	default:
+		return nil, fmt.Errorf("unsupported tag/length/value: %d/%d/%d", t.Tag, t.Length, t.Value)
+	}
+	return append(packet, newline), nil
+}
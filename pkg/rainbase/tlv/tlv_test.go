@@ -83,3 +83,209 @@ func verifyValToInt(raw []byte, expected int) bool {
 	}
 	return true
 }
+
+// Test that encoding and decoding are inverses
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, temp := range []int{-24, -1, 0, 18, 25, 26} {
+		packet, err := (&tlv.TLV{Tag: tlv.Temperature, Length: 4, Value: temp}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !verifyValToInt(packet, temp) {
+			t.Fail()
+		}
+	}
+}
+
+// Test command packets match what the arduino sends for the same tag
+func TestCommands(t *testing.T) {
+	expected := map[string][]byte{
+		"pause":       {52, 49, 49, 10},
+		"unpause":     {53, 49, 49, 10},
+		"reset":       {50, 49, 49, 10},
+		"temperature": {49, 49, 49, 10},
+	}
+	for name, exp := range expected {
+		cmd, err := tlv.NewCommand(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := cmd.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != string(exp) {
+			fmt.Printf("command=%s, expected=%q, actual=%q\n", name, exp, actual)
+			t.Fail()
+		}
+	}
+	if _, err := tlv.NewCommand("explode"); err == nil {
+		t.Fail()
+	}
+}
+
+// Test that non-hex and truncated packets are rejected instead of decoding as a rain event
+func TestRejectBadPackets(t *testing.T) {
+	for _, packet := range [][]byte{
+		{},
+		{48},
+		{48, 49},
+		{48, 49, 120, 10},
+		{49, 52, 48, 48, 10},
+		{49, 52, 48, 48, 49, 103, 10},
+		{54, 49, 49, 10},
+		{120, 49, 49, 10},
+	} {
+		if res, err := tlv.NewTLV(packet); err == nil {
+			fmt.Printf("packet %q should have failed, got %+v\n", packet, res)
+			t.Fail()
+		}
+	}
+}
+
+// Test packets split across reads and merged within a read
+func TestDecoderSplitAndMerged(t *testing.T) {
+	decoder := tlv.NewDecoder(6)
+	if packets := decoder.Decode([]byte("011\n14")); len(packets) != 1 || packets[0].Tag != tlv.Rain {
+		t.Fatalf("expected one rain packet, got %+v", packets)
+	}
+	if packets := decoder.Decode([]byte("00")); len(packets) != 0 {
+		t.Fatalf("expected no packets from a partial read, got %+v", packets)
+	}
+	packets := decoder.Decode([]byte("12\n411\n511\n"))
+	if len(packets) != 3 {
+		t.Fatalf("expected three packets, got %+v", packets)
+	}
+	if packets[0].Tag != tlv.Temperature || packets[0].Value != 18 {
+		t.Fail()
+	}
+	if packets[1].Tag != tlv.Pause || packets[2].Tag != tlv.Unpause {
+		t.Fail()
+	}
+	if decoder.FramingErrors() != 0 {
+		t.Fail()
+	}
+}
+
+// Test the decoder skips garbage and resyncs on the next newline
+func TestDecoderResync(t *testing.T) {
+	decoder := tlv.NewDecoder(6)
+	packets := decoder.Decode([]byte("\x00\xffgarbage that goes on and on\n01"))
+	packets = append(packets, decoder.Decode([]byte("1\n0Z1\n1\n311\r\n"))...)
+	if len(packets) != 2 {
+		t.Fatalf("expected two packets, got %+v", packets)
+	}
+	if packets[0].Tag != tlv.Rain || packets[1].Tag != tlv.HardReset {
+		t.Fail()
+	}
+	if errs := decoder.FramingErrors(); errs != 3 {
+		t.Fatalf("expected 3 framing errors, got %d", errs)
+	}
+
+	// a partial packet from before a reconnect doesn't leak into the next one
+	decoder.Decode([]byte("14FF"))
+	decoder.Reset()
+	if packets = decoder.Decode([]byte("011\n")); len(packets) != 1 || packets[0].Tag != tlv.Rain {
+		t.Fatalf("expected one rain packet after reset, got %+v", packets)
+	}
+}
+
+// Test v2 frames decode the same as v1 and carry their sequence number
+func TestV2RoundTrip(t *testing.T) {
+	for _, packet := range []*tlv.TLV{
+		{Tag: tlv.Rain, Length: 1, Value: 1},
+		{Tag: tlv.Temperature, Length: 4, Value: -24},
+		{Tag: tlv.Temperature, Length: 4, Value: 26},
+	} {
+		frame, err := packet.EncodeV2(0xBEEF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := tlv.NewTLV(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.Version != 2 || actual.Sequence != 0xBEEF || actual.Tag != packet.Tag || actual.Value != packet.Value {
+			fmt.Printf("frame=%q, expected=%+v, actual=%+v\n", frame, packet, actual)
+			t.Fail()
+		}
+	}
+}
+
+// Test corrupted v2 frames fail the checksum
+func TestV2Checksum(t *testing.T) {
+	frame, err := (&tlv.TLV{Tag: tlv.Temperature, Length: 4, Value: 18}).EncodeV2(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte{}, frame...)
+	corrupt[9] = 'A'
+	if _, err = tlv.NewTLV(corrupt); err == nil {
+		t.Fail()
+	}
+	if _, err = tlv.NewTLV(frame[:len(frame)-3]); err == nil {
+		t.Fail()
+	}
+}
+
+// Test a v2 frame wrapping another v2 frame is rejected, even with a good checksum
+func TestV2RejectsNestedFrame(t *testing.T) {
+	inner, err := (&tlv.TLV{Tag: tlv.Rain, Length: 1, Value: 1}).EncodeV2(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append([]byte("0002"), inner[:len(inner)-1]...)
+	frame := append([]byte{'~'}, body...)
+	frame = append(frame, []byte(fmt.Sprintf("%04X\n", crc16(body)))...)
+	if actual, err := tlv.NewTLV(frame); err == nil {
+		fmt.Printf("frame=%q, actual=%+v\n", frame, actual)
+		t.Fail()
+	}
+}
+
+// Test the decoder handles mixed v1/v2 streams and counts skipped sequence numbers
+func TestDecoderSequenceGaps(t *testing.T) {
+	rain := &tlv.TLV{Tag: tlv.Rain, Length: 1, Value: 1}
+	reset := &tlv.TLV{Tag: tlv.HardReset, Length: 1, Value: 1}
+	stream := make([]byte, 0)
+	for _, seq := range []uint16{65534, 65535, 0, 3} {
+		frame, _ := rain.EncodeV2(seq)
+		stream = append(stream, frame...)
+	}
+	stream = append(stream, []byte("011\n")...)
+	frame, _ := reset.EncodeV2(0)
+	stream = append(stream, frame...)
+	frame, _ = rain.EncodeV2(2)
+	stream = append(stream, frame...)
+
+	decoder := tlv.NewDecoder(15)
+	packets := decoder.Decode(stream)
+	if len(packets) != 7 {
+		t.Fatalf("expected 7 packets, got %d", len(packets))
+	}
+	if packets[3].Missed != 2 || packets[4].Version != 1 || packets[6].Missed != 1 {
+		t.Fail()
+	}
+	if gaps := decoder.SequenceGaps(); gaps != 3 {
+		t.Fatalf("expected 3 missing packets, got %d", gaps)
+	}
+	if decoder.FramingErrors() != 0 {
+		t.Fail()
+	}
+}
+
+// CRC-16/CCITT-FALSE, for building frames the encoder won't
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
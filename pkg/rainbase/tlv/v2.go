@@ -0,0 +1,111 @@
+package tlv
+
+// v2 framing: a v1 packet wrapped with a sequence number and a checksum
+//
+//   ~ SSSS <v1 packet> CCCC \n
+//
+// SSSS is a 16-bit sequence number and CCCC is a CRC-16/CCITT-FALSE over the sequence number and
+// packet, all as uppercase ascii hex. The leading `~` can never start a v1 packet, which is how the
+// decoder tells the two apart.
+
+import (
+	"fmt"
+)
+
+const (
+	v2Marker    = '~'
+	v2SeqLen    = 4
+	v2CRCLen    = 4
+	v2Overhead  = 1 + v2SeqLen + v2CRCLen
+	crcInit     = 0xFFFF
+	crcPoly     = 0x1021
+	halfSeqSpan = 1 << 15
+)
+
+// EncodeV2 turns a TLV into a v2 frame with the given sequence number, including the newline
+func (t *TLV) EncodeV2(sequence uint16) ([]byte, error) {
+	packet, err := t.Encode()
+	if err != nil {
+		return nil, err
+	}
+	body := append(hex16(sequence), packet[:len(packet)-1]...)
+	frame := append([]byte{v2Marker}, body...)
+	frame = append(frame, hex16(crc16(body))...)
+	return append(frame, newline), nil
+}
+
+// decode a v2 frame without its newline
+func decodeV2(frame []byte) (*TLV, error) {
+	if len(frame) <= v2Overhead {
+		return nil, fmt.Errorf("v2 frame %q too short", frame)
+	}
+	body := frame[1 : len(frame)-v2CRCLen]
+	expected, err := parseHex16(frame[len(frame)-v2CRCLen:])
+	if err != nil {
+		return nil, fmt.Errorf("v2 frame %q: bad checksum: %s", frame, err)
+	}
+	if actual := crc16(body); actual != expected {
+		return nil, fmt.Errorf("v2 frame %q: checksum mismatch, expected %04X, got %04X", frame, expected, actual)
+	}
+	sequence, err := parseHex16(body[:v2SeqLen])
+	if err != nil {
+		return nil, fmt.Errorf("v2 frame %q: bad sequence: %s", frame, err)
+	}
+	// only ever a v1 packet inside, never another frame
+	packet, err := decodeV1(body[v2SeqLen:])
+	if err != nil {
+		return nil, err
+	}
+	packet.Version = 2
+	packet.Sequence = sequence
+	return packet, nil
+}
+
+// CRC-16/CCITT-FALSE, cheap enough to compute on the arduino
+func crc16(data []byte) uint16 {
+	crc := uint16(crcInit)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ crcPoly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encode a 16-bit number as 4 ascii hex digits
+func hex16(n uint16) []byte {
+	return []byte{
+		intToASCII(int(n >> 12)),
+		intToASCII(int(n >> 8)),
+		intToASCII(int(n >> 4)),
+		intToASCII(int(n)),
+	}
+}
+
+// decode 4 ascii hex digits into a 16-bit number
+func parseHex16(b []byte) (uint16, error) {
+	var n uint16
+	for _, c := range b {
+		digit, ok := asciiToInt(c)
+		if !ok {
+			return 0, fmt.Errorf("non-hex byte %q", c)
+		}
+		n = n<<4 | uint16(digit)
+	}
+	return n, nil
+}
+
+// how many packets were skipped going from one sequence number to the next, or -1 if next
+// doesn't follow last at all (a repeat, or the sender restarting its count)
+func missedBetween(last, next uint16) int {
+	diff := next - last - 1
+	if diff >= halfSeqSpan {
+		return -1
+	}
+	return int(diff)
+}
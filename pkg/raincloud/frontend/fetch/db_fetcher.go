@@ -12,19 +12,22 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/ntbloom/raincounter/pkg/raincloud/webdb"
+	"github.com/spf13/viper"
 )
 
 type DataFetcher struct {
-	query webdb.DBQuery
-	data  templates.WeatherData
+	query   webdb.DBQuery
+	station string // station to show, or all of them if empty
+	data    templates.WeatherData
 	sync.Mutex
 }
 
 func NewDataFetcher() *DataFetcher {
 	return &DataFetcher{
-		query: webdb.NewPGConnector(),
-		data:  templates.BaseWeatherData,
-		Mutex: sync.Mutex{},
+		query:   webdb.NewPGConnector(),
+		station: viper.GetString(configkey.WebStation),
+		data:    templates.BaseWeatherData,
+		Mutex:   sync.Mutex{},
 	}
 }
 
@@ -58,6 +61,7 @@ func (d *DataFetcher) Fetch() interface{} {
 	for _, v := range []callable{
 		d.getCurrentTemp,
 		d.getLastRain,
+		d.getRainRate,
 		d.getSensorStatus,
 		d.getGatewayStatus,
 	} {
@@ -87,7 +91,7 @@ func formatFloatFromDatabase(val float64, err error) (std string, metric string)
 }
 
 func (d *DataFetcher) getRainSince(now time.Time, duration time.Duration) (std string, metric string) {
-	val, err := d.query.TotalRainMMFrom(now.Add(duration), now)
+	val, err := d.query.TotalRainMMFrom(d.station, now.Add(duration), now)
 	return formatFloatFromDatabase(val, err)
 }
 
@@ -130,14 +134,14 @@ func (d *DataFetcher) getThirtyDayRain(now time.Time) {
 }
 
 func (d *DataFetcher) getYearTotalRain(now time.Time) {
-	val, err := d.query.TotalRainMMFrom(time.Date(now.Year(), 0, 0, 0, 0, 0, 0, time.UTC), now)
+	val, err := d.query.TotalRainMMFrom(d.station, time.Date(now.Year(), 0, 0, 0, 0, 0, 0, time.UTC), now)
 	std, met := formatFloatFromDatabase(val, err)
 	d.data.YearlyRainIn = std
 	d.data.YearlyRainMm = met
 }
 
 func (d *DataFetcher) getCurrentTemp() {
-	tempC, err := d.query.GetLastTempC()
+	tempC, err := d.query.GetLastTempC(d.station)
 	if err != nil {
 		logrus.Errorf("error getting current temp: %s", err)
 		return
@@ -149,7 +153,7 @@ func (d *DataFetcher) getCurrentTemp() {
 }
 
 func (d *DataFetcher) getLastRain() {
-	date, err := d.query.GetLastRainTime()
+	date, err := d.query.GetLastRainTime(d.station)
 	if err != nil {
 		logrus.Errorf("error getting last rain: %s", err)
 		return
@@ -157,11 +161,25 @@ func (d *DataFetcher) getLastRain() {
 	d.data.LastRain = date.Format(configkey.PrettyTimeFormat)
 }
 
-type callable func(time.Duration) (bool, error)
+func (d *DataFetcher) getRainRate() {
+	// the gateway sends the rate every minute while it's raining
+	rate, err := d.query.GetRainRate(d.station, time.Minute*5)
+	if err != nil {
+		logrus.Errorf("error getting rain rate: %s", err)
+		return
+	}
+	d.data.Raining = rate != nil
+	if rate == nil {
+		return
+	}
+	d.data.RainRateIn, d.data.RainRateMm = formatFloatFromDatabase(rate.MmPerHour5, nil)
+}
+
+type callable func(string, time.Duration) (bool, error)
 
 func (d *DataFetcher) getStatus(c callable) (string, error) {
 	since := time.Since(time.Now().Add(time.Minute * -5))
-	up, err := c(since)
+	up, err := c(d.station, since)
 	if err != nil {
 		return "", err
 	}
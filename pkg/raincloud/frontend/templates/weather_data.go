@@ -26,6 +26,11 @@ type WeatherData struct {
 	ThirtyDayRainMm      string
 	YearlyRainMm         string
 
+	// current rain rate, averaged over the last 5 minutes
+	Raining    bool
+	RainRateIn string
+	RainRateMm string
+
 	// various database lookups
 	TempF         int
 	TempC         int
@@ -67,6 +72,9 @@ var BaseWeatherData = WeatherData{
 	ThirtyDayRainMm:      ErrorFloatString,
 	YearlyRainMm:         ErrorFloatString,
 
+	RainRateIn: ErrorFloatString,
+	RainRateMm: ErrorFloatString,
+
 	TempF:         ErrorInt,
 	TempC:         ErrorInt,
 	LastRain:      ErrorTimestamp,
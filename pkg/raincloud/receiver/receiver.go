@@ -2,6 +2,7 @@ package receiver
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/spf13/viper"
@@ -14,6 +15,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// client ID the broker keeps the receiver's session under, unless mqtt.client.id says otherwise
+const defaultClientID = "raincloud-receiver"
+
 type Receiver struct {
 	client paho.Client
 	db     webdb.DBEntry
@@ -21,31 +25,71 @@ type Receiver struct {
 }
 
 // NewReceiver creates a new Receiver struct
-// The mqtt connection is created automatically and must be closed
+// The mqtt connection is created automatically and must be closed. The broker keeps the receiver's session
+// while it's down, so qos 1 messages published in the meantime are delivered when it comes back.
 func NewReceiver() (*Receiver, error) {
-	client, err := mqtt.NewConnection()
+	options, err := mqtt.NewClientOptions(mqtt.ClientID(defaultClientID), "")
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
 	}
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	recv := Receiver{
+		db:    webdb.NewPGConnector(),
+		state: make(chan int),
+	}
+
+	// keep trying until the broker is up, and subscribe again every time we connect in case the broker lost
+	// our session
+	options.SetConnectRetry(true)
+	mqtt.OnConnect(options, recv.subscribe)
+
+	// hand messages over one at a time, in the order they arrive. Most handlers carry on in the background;
+	// presence doesn't, so it's stored in order.
+	options.SetOrderMatters(true)
+	recv.client = paho.NewClient(options)
+
+	// messages the broker kept for us arrive as soon as we connect, before we've subscribed again
+	for topic, handler := range recv.handlers() {
+		recv.client.AddRoute(topic, handler)
+	}
+	token := recv.client.Connect()
+	if !token.WaitTimeout(viper.GetDuration(configkey.MQTTConnectionTimeout)) {
+		logrus.Warning("unable to connect to MQTT yet, still trying")
+	} else if token.Error() != nil {
 		logrus.Errorf("unable to connect to MQTT: %s", token.Error())
 	}
-	db := webdb.NewPGConnector()
-	state := make(chan int)
-	recv := Receiver{
-		client: client,
-		db:     db,
-		state:  state,
+	return &recv, nil
+}
+
+// listen to every station
+func (r *Receiver) handlers() map[string]paho.MessageHandler {
+	return map[string]paho.MessageHandler{
+		mqtt.AllStations(mqtt.RainTopic):          r.handleRainTopic,
+		mqtt.AllStations(mqtt.RainRateTopic):      r.handleRainRateTopic,
+		mqtt.AllStations(mqtt.TemperatureTopic):   r.handleTemperatureTopic,
+		mqtt.AllStations(mqtt.GatewayStatusTopic): r.handleGatewayStatusMessage,
+		mqtt.AllStations(mqtt.PresenceTopic):      r.handlePresence,
+		mqtt.AllStations(mqtt.SensorStatusTopic):  r.handleSensorStatusMessage,
+		mqtt.AllStations(mqtt.SensorEventTopic):   r.handleSensorEvent,
 	}
+}
 
+// subscribe to everything the receiver handles. Runs on every connection, from paho's goroutine, so it
+// doesn't wait on the result.
+func (r *Receiver) subscribe(client paho.Client) {
 	qos := byte(viper.GetUint(configkey.MQTTQos))
-	recv.client.Subscribe(mqtt.RainTopic, qos, recv.handleRainTopic)
-	recv.client.Subscribe(mqtt.TemperatureTopic, qos, recv.handleTemperatureTopic)
-	recv.client.Subscribe(mqtt.GatewayStatusTopic, qos, recv.handleGatewayStatusMessage)
-	recv.client.Subscribe(mqtt.SensorStatusTopic, qos, recv.handleSensorStatusMessage)
-	recv.client.Subscribe(mqtt.SensorEventTopic, qos, recv.handleSensorEvent)
-	return &recv, nil
+	filters := make(map[string]byte)
+	for topic := range r.handlers() {
+		filters[topic] = qos
+	}
+	token := client.SubscribeMultiple(filters, nil)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			logrus.Errorf("unable to subscribe: %s", token.Error())
+			return
+		}
+		logrus.Info("receiver subscribed to every station")
+	}()
 }
 
 // Start runs the main loop, basically just waiting to be told to stop
@@ -69,16 +113,8 @@ func (r *Receiver) Stop() {
 	r.state <- configkey.Kill
 }
 
-// Close closes the connection
+// Close closes the connection. The subscriptions stay, so the broker keeps messages for the next receiver.
 func (r *Receiver) Close() {
-	topics := []string{
-		mqtt.RainTopic,
-		mqtt.TemperatureTopic,
-		mqtt.GatewayStatusTopic,
-		mqtt.SensorStatusTopic,
-		mqtt.SensorEventTopic,
-	}
-	r.client.Unsubscribe(topics...)
 	logrus.Info("disconnecting Receiver from mqtt")
 	r.client.Disconnect(viper.GetUint(configkey.MQTTQuiescence))
 	logrus.Info("disconnecting Receiver from the database")
@@ -93,37 +129,97 @@ func (r *Receiver) IsConnected() bool {
 
 func (r *Receiver) handleGatewayStatusMessage(_ paho.Client, message paho.Message) {
 	go func() {
-		r.processStatusMessage(message, configkey.GatewayStatus)
+		// gateways that send telemetry announce their presence too, so their heartbeats don't need a row in
+		// status_log. Older gateways only have the heartbeat to say they're up.
+		if !r.processTelemetry(message) {
+			r.processStatusMessage(message, configkey.GatewayStatus)
+		}
 	}()
 }
 
+// a gateway came online or went offline, maybe by its last will. Handled right away rather than in the
+// background, so presence is stored in the order it arrived and a will and the next announcement can't swap
+// places.
+func (r *Receiver) handlePresence(_ paho.Client, message paho.Message) {
+	station, stamp, _, err := parseMessage(message)
+	if err != nil {
+		return
+	}
+	var presence mqtt.Presence
+	if err = json.Unmarshal(message.Payload(), &presence); err != nil {
+		logrus.Errorf("skipping presence on %s: %s", message.Topic(), err)
+		return
+	}
+	if stamp.IsZero() {
+		// the last will doesn't know when the broker sent it
+		stamp = time.Now()
+	}
+	err = r.db.AddPresence(station, presence.Online, stamp)
+	switch {
+	case err == nil:
+		logrus.Infof("gateway %s online: %t", station, presence.Online)
+	case errors.Is(err, webdb.ErrDuplicate):
+		logrus.Debugf("gateway %s online: %t is old news", station, presence.Online)
+	default:
+		logrus.Error(err)
+	}
+}
+
 func (r *Receiver) handleSensorStatusMessage(_ paho.Client, message paho.Message) {
 	go func() {
-		r.processStatusMessage(message, configkey.SensorStatus)
+		station, stamp, readable, err := parseMessage(message)
+		if err != nil {
+			return
+		}
+		health := sensorHealth(readable)
+		err = r.db.AddSensorStatus(station, health, stamp)
+		switch {
+		case err == nil:
+			logrus.Infof("sensor %s on %s is %s", health.SensorID, station, health.State)
+		case errors.Is(err, webdb.ErrDuplicate):
+			logrus.Tracef("sensor %s on %s is still %s", health.SensorID, station, health.State)
+		default:
+			logrus.Error(err)
+		}
 	}()
 }
 
 func (r *Receiver) handleTemperatureTopic(_ paho.Client, message paho.Message) {
 	go func() {
-		stamp, readable, err := parseMessage(message)
+		station, stamp, readable, err := parseMessage(message)
 		if err != nil {
 			return
 		}
 		temp := int(readable["TempC"].(float64))
-		if err := r.db.AddTempCValue(temp, stamp); err != nil {
-			logrus.Error(err)
-		}
+		msg := messageID(readable)
+		logInsert(message, msg, r.db.AddTempCValue(station, sensorID(readable), temp, stamp, msg))
 	}()
 }
 
 func (r *Receiver) handleRainTopic(_ paho.Client, message paho.Message) {
 	go func() {
-		stamp, readable, err := parseMessage(message)
+		station, stamp, readable, err := parseMessage(message)
 		if err != nil {
 			return
 		}
 		mm := readable["Millimeters"].(float64)
-		if err := r.db.AddRainMMEvent(mm, stamp); err != nil {
+		msg := messageID(readable)
+		logInsert(message, msg, r.db.AddRainMMEvent(station, sensorID(readable), mm, stamp, msg))
+	}()
+}
+
+func (r *Receiver) handleRainRateTopic(_ paho.Client, message paho.Message) {
+	go func() {
+		station, stamp, _, err := parseMessage(message)
+		if err != nil {
+			return
+		}
+		var rate webdb.RainRate
+		if err = json.Unmarshal(message.Payload(), &rate); err != nil {
+			logrus.Errorf("skipping rain rate on %s: %s", message.Topic(), err)
+			return
+		}
+		if err = r.db.AddRainRate(station, rate, stamp); err != nil {
 			logrus.Error(err)
 		}
 	}()
@@ -131,15 +227,14 @@ func (r *Receiver) handleRainTopic(_ paho.Client, message paho.Message) {
 
 func (r *Receiver) handleSensorEvent(_ paho.Client, message paho.Message) {
 	go func() {
-		stamp, readable, err := parseMessage(message)
+		station, stamp, readable, err := parseMessage(message)
 		if err != nil {
 			return
 		}
 		tag := int(readable["Tag"].(float64))
 		value := int(readable["Value"].(float64))
-		if err := r.db.AddTagValue(tag, value, stamp); err != nil {
-			return
-		}
+		msg := messageID(readable)
+		logInsert(message, msg, r.db.AddTagValue(station, sensorID(readable), tag, value, stamp, msg))
 	}()
 }
 
@@ -147,27 +242,98 @@ func (r *Receiver) handleSensorEvent(_ paho.Client, message paho.Message) {
 
 // send a sensor or gateway status message
 func (r *Receiver) processStatusMessage(msg paho.Message, asset int) {
-	stamp, _, err := parseMessage(msg)
+	station, stamp, _, err := parseMessage(msg)
 	if err != nil {
 		return
 	}
-	if err := r.db.AddStatusUpdate(asset, stamp); err != nil {
+	if err := r.db.AddStatusUpdate(station, asset, stamp); err != nil {
 		logrus.Error(err)
 		return
 	}
 }
 
-// parse the messages and have unified error logging for all topics
-func parseMessage(msg paho.Message) (time.Time, map[string]interface{}, error) {
+// store the telemetry that comes with a gateway status message, returning whether it had any
+func (r *Receiver) processTelemetry(msg paho.Message) bool {
+	station, stamp, _, err := parseMessage(msg)
+	if err != nil {
+		return false
+	}
+	var telemetry webdb.GatewayTelemetry
+	if err = json.Unmarshal(msg.Payload(), &telemetry); err != nil {
+		logrus.Errorf("skipping telemetry on %s: %s", msg.Topic(), err)
+		return false
+	}
+	// gateways from before telemetry only sent OK
+	if telemetry.Version == nil {
+		return false
+	}
+	if err = r.db.AddGatewayTelemetry(station, telemetry, stamp); err != nil {
+		logrus.Error(err)
+	}
+	return true
+}
+
+// the sensor a measurement or event came from, empty for gateways that only ever had one
+func sensorID(readable map[string]interface{}) string {
+	id, _ := readable["SensorID"].(string)
+	return id
+}
+
+// the gateway's ID for a measurement or event message, empty from gateways that don't send one
+func messageID(readable map[string]interface{}) webdb.MessageID {
+	var msg webdb.MessageID
+	msg.ID, _ = readable["MessageID"].(string)
+	if sequence, ok := readable["Sequence"].(float64); ok {
+		msg.Sequence = uint64(sequence)
+	}
+	return msg
+}
+
+// log what happened to a message we tried to store. Duplicates are expected, since the broker redelivers
+// with qos 1 and the gateway replays its outbox.
+func logInsert(message paho.Message, msg webdb.MessageID, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, webdb.ErrDuplicate):
+		logrus.Debugf("skipping duplicate message %s on %s", msg.ID, message.Topic())
+	default:
+		logrus.Error(err)
+	}
+}
+
+// read the gateway's opinion of the sensor. Older gateways only sent OK, meaning the port existed.
+func sensorHealth(readable map[string]interface{}) webdb.SensorHealth {
+	health := webdb.SensorHealth{State: webdb.SensorDown, LastPacketAge: -1}
+	if ok, _ := readable["OK"].(bool); ok {
+		health.State = webdb.SensorUp
+	}
+	if state, ok := readable["State"].(string); ok && state != "" {
+		health.State = state
+	}
+	if age, ok := readable["LastPacketAge"].(float64); ok {
+		health.LastPacketAge = age
+	}
+	health.SensorID, _ = readable["SensorID"].(string)
+	health.Reason, _ = readable["Reason"].(string)
+	return health
+}
+
+// parse the messages and have unified error logging for all topics. The station comes from the topic.
+func parseMessage(msg paho.Message) (string, time.Time, map[string]interface{}, error) {
+	station, _, err := mqtt.ParseStationTopic(msg.Topic())
+	if err != nil {
+		logrus.Errorf("skipping message: %s", err)
+		return "", time.Time{}, nil, err
+	}
 	var readable map[string]interface{}
 	if err := json.Unmarshal(msg.Payload(), &readable); err != nil {
 		logrus.Errorf("skipping message on %s: %s", msg.Topic(), err)
-		return time.Time{}, nil, err
+		return "", time.Time{}, nil, err
 	}
 	stamp, err := time.Parse(configkey.TimestampFormat, readable["Timestamp"].(string))
 	if err != nil {
 		logrus.Errorf("skipping message on %s: %s", msg.Topic(), err)
-		return time.Time{}, nil, err
+		return "", time.Time{}, nil, err
 	}
-	return stamp, readable, nil
+	return station, stamp, readable, nil
 }
@@ -12,6 +12,7 @@ import (
 	"github.com/spf13/viper"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jackc/pgx/v4"
 	"github.com/sirupsen/logrus"
 
 	"github.com/ntbloom/raincounter/pkg/common/mqtt"
@@ -40,7 +41,7 @@ func (suite *ReceiverTest) SetupSuite() {
 	config.Configure()
 
 	// connect to the docker container without auth
-	client, err := mqtt.NewConnection()
+	client, err := mqtt.NewConnection("", "")
 	if err != nil {
 		suite.Fail("unable to connect to mqtt", err)
 	}
@@ -84,6 +85,9 @@ func (suite *ReceiverTest) SetupTest() {
 		"DELETE FROM rain;",
 		"DELETE FROM event_log;",
 		"DELETE FROM status_log;",
+		"DELETE FROM telemetry;",
+		"DELETE FROM rain_rate;",
+		"DELETE FROM presence;",
 	} {
 		// `Select` can still execute arbitrary SQL
 		err := suite.entry.Insert(sql)
@@ -104,7 +108,7 @@ func (suite *ReceiverTest) TestReceiveRainMessage() {
 	time.Sleep(time.Second * 1)
 
 	// verify the last rain matches what we put in the database
-	lastRain, err := suite.query.GetLastRainTime()
+	lastRain, err := suite.query.GetLastRainTime(station())
 	if err != nil {
 		suite.Fail("last rain error", err)
 	}
@@ -114,6 +118,46 @@ func (suite *ReceiverTest) TestReceiveRainMessage() {
 	}
 	logrus.Infof("timeDiff:%s, stamp:%s, lastRain:%s", timeDiff, stamp, lastRain)
 	assert.True(suite.T(), timeDiff < time.Minute*2, "time mismatch on rain message")
+
+	// and which gauge it came from
+	rain, err := suite.query.GetRainMMSince(station(), stamp.Add(-time.Minute))
+	if err != nil {
+		suite.Fail("rain entries error", err)
+	}
+	if assert.Len(suite.T(), *rain, 1) {
+		assert.Equal(suite.T(), msg.Msg["SensorID"], (*rain)[0].SensorID)
+	}
+}
+
+// publish the same rain message twice, as if the broker redelivered it, and make sure it only counts once
+func (suite *ReceiverTest) TestReceiveDuplicateRainMessage() {
+	stamp := time.Now().Add(time.Minute * -1)
+	msg := mqtt.SampleRain(stamp)
+	suite.client.Publish(process(msg))
+	suite.client.Publish(process(msg))
+	// wait for both to make it to the broker
+	time.Sleep(time.Second * 1)
+
+	total, err := suite.query.TotalRainMMSince(station(), stamp.Add(-time.Minute))
+	if err != nil {
+		suite.Fail("total rain error", err)
+	}
+	assert.Equal(suite.T(), msg.Msg["Millimeters"], total, "redelivered rain was counted twice")
+}
+
+// publish a rain rate, make sure it's the current one
+func (suite *ReceiverTest) TestReceiveRainRateMessage() {
+	msg := mqtt.SampleRainRate(time.Now().Add(time.Second * -10))
+	suite.client.Publish(process(msg))
+	// wait for it
+	time.Sleep(time.Second)
+
+	rate, err := suite.query.GetRainRate(station(), time.Minute)
+	if err != nil {
+		suite.Fail("rain rate error", err)
+	}
+	assert.NotNil(suite.T(), rate)
+	assert.Equal(suite.T(), msg.Msg["MmPerHour5"], rate.MmPerHour5)
 }
 
 func (suite *ReceiverTest) TestReceiveTemperatureMessage() {
@@ -122,7 +166,7 @@ func (suite *ReceiverTest) TestReceiveTemperatureMessage() {
 	// wait for it
 	time.Sleep(time.Second)
 
-	lastTemp, err := suite.query.GetLastTempC()
+	lastTemp, err := suite.query.GetLastTempC(station())
 	if err != nil {
 		suite.Fail("last temperature error", err)
 	}
@@ -135,11 +179,11 @@ func (suite *ReceiverTest) TestStatusMessages() {
 	now := time.Now()
 
 	// assert that the sensor and gateway are not up
-	gwUp, err := suite.query.IsGatewayUp(duration)
+	gwUp, err := suite.query.IsGatewayUp(station(), duration)
 	if err != nil {
 		suite.Fail("unhandled error on empty IsGatewayUp", err)
 	}
-	sensorUp, err := suite.query.IsSensorUp(duration)
+	sensorUp, err := suite.query.IsSensorUp(station(), duration)
 	if err != nil {
 		suite.Fail("unhandled error on empty IsSensorUp", err)
 	}
@@ -149,14 +193,15 @@ func (suite *ReceiverTest) TestStatusMessages() {
 	// publish the messages and wait for a second
 	suite.client.Publish(process(mqtt.SampleSensorStatus(now)))
 	suite.client.Publish(process(mqtt.SampleGatewayStatus(now)))
+	suite.client.Publish(process(mqtt.SamplePresence(true, now)))
 	time.Sleep(time.Second)
 
 	// verify the items were put into the database
-	gwUp, err = suite.query.IsGatewayUp(duration)
+	gwUp, err = suite.query.IsGatewayUp(station(), duration)
 	if err != nil {
 		suite.Fail("error querying gateway is up", err)
 	}
-	sensorUp, err = suite.query.IsSensorUp(duration)
+	sensorUp, err = suite.query.IsSensorUp(station(), duration)
 	if err != nil {
 		suite.Fail("error querying sensor is up", err)
 	}
@@ -164,6 +209,40 @@ func (suite *ReceiverTest) TestStatusMessages() {
 	assert.True(suite.T(), sensorUp, "sensor should be reporting as up")
 }
 
+// the gateway comes and goes, and redelivered presence doesn't count as a change
+func (suite *ReceiverTest) TestPresence() {
+	// the gateway's clock is an hour fast, then the last will comes with no time, then the clock is an hour slow
+	now := time.Now()
+	for _, presence := range []mqtt.SampleMessage{
+		mqtt.SamplePresence(true, now.Add(time.Hour)),
+		mqtt.SamplePresence(true, now.Add(time.Hour)),
+		mqtt.SamplePresence(false, time.Time{}),
+		mqtt.SamplePresence(true, now.Add(-time.Hour)),
+		mqtt.SamplePresence(false, now.Add(-time.Hour)),
+	} {
+		suite.client.Publish(process(presence))
+	}
+	time.Sleep(time.Second)
+	up, err := suite.query.IsGatewayUp(station(), time.Minute)
+	if err != nil {
+		suite.Fail("error querying gateway is up", err)
+	}
+	assert.False(suite.T(), up, "gateway should have gone offline")
+
+	val, err := suite.query.Select(`SELECT count(*) FROM presence;`)
+	if err != nil {
+		suite.Fail("unable to query presence table", err)
+	}
+	rows := val.(pgx.Rows)
+	defer rows.Close()
+	var changes int64
+	rows.Next()
+	if err = rows.Scan(&changes); err != nil {
+		suite.Fail("unable to count presence changes", err)
+	}
+	assert.Equal(suite.T(), int64(4), changes)
+}
+
 // make sure we can handle a sensor event
 func (suite *ReceiverTest) TestSensorEvent() {
 	testEvent := tlv.SoftReset
@@ -173,7 +252,7 @@ func (suite *ReceiverTest) TestSensorEvent() {
 
 	// verify there aren't any events yet
 	longTime := time.Now().Add(time.Hour * 24 * 365 * -100)
-	res, err := suite.query.GetEventMessagesSince(testEvent, longTime)
+	res, err := suite.query.GetEventMessagesSince(station(), testEvent, longTime)
 	if err != nil {
 		suite.Fail("problem querying empty event messages", err)
 	}
@@ -184,7 +263,7 @@ func (suite *ReceiverTest) TestSensorEvent() {
 	time.Sleep(time.Second)
 
 	// verify it's in the database
-	res, err = suite.query.GetEventMessagesSince(testEvent, longTime)
+	res, err = suite.query.GetEventMessagesSince(station(), testEvent, longTime)
 	if err != nil {
 		suite.Fail("problem querying event messages", err)
 	}
@@ -211,11 +290,17 @@ func (suite *ReceiverTest) TestNoPanics() {
 		mqtt.SampleSensorHardReset(now),
 		mqtt.SampleSensorStatus(now),
 		mqtt.SampleGatewayStatus(now),
+		mqtt.SamplePresence(true, now),
 	} {
 		suite.client.Publish(process(message))
 	}
 }
 
+// the station the sample messages are published under
+func station() string {
+	return viper.GetString(configkey.StationID)
+}
+
 // publish a bunch of stuff to the broker
 func process(msg mqtt.SampleMessage) (string, byte, bool, []byte) {
 	payload, err := json.Marshal(msg.Msg)
@@ -27,6 +27,12 @@ import (
 
 var errTime = time.Unix(0, 0)
 
+// matches rows for one station, or every station when the station ID is empty. Queries pass the
+// station ID as the parameter number given.
+func stationFilter(table string, param int) string {
+	return fmt.Sprintf("($%d = '' OR %s.station_id = $%d)", param, table, param)
+}
+
 type PGConnector struct {
 	pool *pgxpool.Pool
 }
@@ -66,8 +72,8 @@ func (pg *PGConnector) Close() {
 
 /* INSERTING DATA */
 
-func (pg *PGConnector) Insert(cmd string) error {
-	res, err := pg.genericQuery(cmd)
+func (pg *PGConnector) Insert(cmd string, args ...interface{}) error {
+	res, err := pg.genericQuery(cmd, args...)
 	if err != nil {
 		logrus.Error(err)
 	}
@@ -75,7 +81,31 @@ func (pg *PGConnector) Insert(cmd string) error {
 	return err
 }
 
-func (pg *PGConnector) AddTagValue(tag int, value int, gwTimestamp time.Time) error {
+// insert a message from the gateway, unless a message with the same ID is stored already
+func (pg *PGConnector) upsert(cmd string, args ...interface{}) error {
+	logrus.Debugf("pgsql: %s %v", cmd, args)
+	res, err := pg.pool.Exec(context.Background(), cmd, args...)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+// the message ID columns, NULL for gateways that don't send an ID
+func (msg MessageID) columns() (*string, *int64) {
+	if msg.ID == "" {
+		return nil, nil
+	}
+	id, sequence := msg.ID, int64(msg.Sequence)
+	return &id, &sequence
+}
+
+func (pg *PGConnector) AddTagValue(stationID, sensorID string, tag int, value int, gwTimestamp time.Time,
+	msg MessageID) error {
 	switch tag {
 	// don't use these methods
 	case tlv.Rain:
@@ -83,32 +113,80 @@ func (pg *PGConnector) AddTagValue(tag int, value int, gwTimestamp time.Time) er
 	case tlv.Temperature:
 		return fmt.Errorf("temperature events not supported in AddTagValue")
 	default:
-		sql := fmt.Sprintf(
-			`INSERT INTO event_log (gw_timestamp, server_timestamp, tag, value) VALUES ('%s','%s',%d,%d);`,
-			gwTimestamp.Format(configkey.TimestampFormat), time.Now().Format(configkey.TimestampFormat), tag, value,
-		)
-		return pg.Insert(sql)
+		sql := `
+INSERT INTO event_log (station_id, sensor_id, gw_timestamp, server_timestamp, tag, value, message_id, sequence)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+ON CONFLICT (station_id, message_id) DO NOTHING;`
+		id, sequence := msg.columns()
+		return pg.upsert(sql, stationID, sensorID, gwTimestamp, time.Now(), tag, value, id, sequence)
 	}
 }
 
-func (pg *PGConnector) AddStatusUpdate(asset int, gwTimestamp time.Time) error {
-	sql := fmt.Sprintf(`INSERT INTO status_log (gw_timestamp, server_timestamp, asset) VALUES ('%s','%s',%d);`,
-		gwTimestamp.Format(configkey.TimestampFormat), time.Now().Format(configkey.TimestampFormat), asset)
-	return pg.Insert(sql)
+func (pg *PGConnector) AddStatusUpdate(stationID string, asset int, gwTimestamp time.Time) error {
+	sql := `INSERT INTO status_log (station_id, gw_timestamp, server_timestamp, asset) VALUES ($1,$2,$3,$4);`
+	return pg.Insert(sql, stationID, gwTimestamp, time.Now(), asset)
+}
+
+func (pg *PGConnector) AddSensorStatus(stationID string, health SensorHealth, gwTimestamp time.Time) error {
+	// the gateway repeats itself every so often, so only keep the changes
+	sql := `
+INSERT INTO status_log (station_id, gw_timestamp, server_timestamp, asset, sensor_id, state, reason, last_packet_age)
+SELECT $1::text, $2::timestamptz, $3::timestamptz, $4::integer, $5::text, $6::text, $7::text, $8::float
+WHERE $6::text IS DISTINCT FROM (
+    SELECT state FROM status_log WHERE station_id = $1::text AND asset = $4::integer AND sensor_id = $5::text
+    ORDER BY gw_timestamp DESC, id DESC LIMIT 1
+);`
+	return pg.upsert(sql, stationID, gwTimestamp, time.Now(), configkey.SensorStatus,
+		health.SensorID, health.State, health.Reason, health.LastPacketAge)
+}
+
+func (pg *PGConnector) AddPresence(stationID string, online bool, gwTimestamp time.Time) error {
+	// the receiver gets the retained presence again every time it reconnects, so only keep the changes. The
+	// gateway's clock and the server's can't be compared, and the last will only has the server's, so
+	// presence is in the order the server heard it.
+	sql := `
+INSERT INTO presence (station_id, gw_timestamp, server_timestamp, online)
+SELECT $1::text, $2::timestamptz, $3::timestamptz, $4::boolean
+WHERE $4::boolean IS DISTINCT FROM (
+    SELECT online FROM presence WHERE station_id = $1::text ORDER BY server_timestamp DESC, id DESC LIMIT 1
+);`
+	return pg.upsert(sql, stationID, gwTimestamp, time.Now(), online)
+}
+
+func (pg *PGConnector) AddGatewayTelemetry(stationID string, t GatewayTelemetry, gwTimestamp time.Time) error {
+	sql := `
+INSERT INTO telemetry (station_id, gw_timestamp, server_timestamp, uptime, system_uptime, disk_free, cpu_temp_c,
+                       load_1, load_5, load_15, mqtt_reconnects, mqtt_broker, cert_expires, version)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14);`
+	return pg.Insert(sql, stationID, gwTimestamp, time.Now(), t.Uptime, t.SystemUptime, t.DiskFree, t.CPUTempC,
+		t.Load1, t.Load5, t.Load15, t.MQTTReconnects, t.MQTTBroker, t.CertExpires, t.Version)
+}
+
+func (pg *PGConnector) AddTempCValue(stationID, sensorID string, tempC int, gwTimestamp time.Time, msg MessageID) error {
+	sql := `
+INSERT INTO temperature (station_id, sensor_id, gw_timestamp, server_timestamp, value, message_id, sequence)
+VALUES ($1,$2,$3,$4,$5,$6,$7)
+ON CONFLICT (station_id, message_id) DO NOTHING;`
+	id, sequence := msg.columns()
+	return pg.upsert(sql, stationID, sensorID, gwTimestamp, time.Now(), tempC, id, sequence)
 }
 
-func (pg *PGConnector) AddTempCValue(tempC int, gwTimestamp time.Time) error {
-	sql := fmt.Sprintf(
-		`INSERT INTO temperature (gw_timestamp, server_timestamp, value) VALUES ('%s','%s',%d);`,
-		gwTimestamp.Format(configkey.TimestampFormat), time.Now().Format(configkey.TimestampFormat), tempC)
-	return pg.Insert(sql)
+func (pg *PGConnector) AddRainMMEvent(stationID, sensorID string, amount float64, gwTimestamp time.Time,
+	msg MessageID) error {
+	sql := `
+INSERT INTO rain (station_id, sensor_id, gw_timestamp, server_timestamp, amount, message_id, sequence)
+VALUES ($1,$2,$3,$4,$5,$6,$7)
+ON CONFLICT (station_id, message_id) DO NOTHING;`
+	id, sequence := msg.columns()
+	return pg.upsert(sql, stationID, sensorID, gwTimestamp, time.Now(), amount, id, sequence)
 }
 
-func (pg *PGConnector) AddRainMMEvent(amount float64, gwTimestamp time.Time) error {
-	sql := fmt.Sprintf(
-		`INSERT INTO rain (gw_timestamp, server_timestamp, amount ) VALUES ('%s','%s','%f');`,
-		gwTimestamp.Format(configkey.TimestampFormat), time.Now().Format(configkey.TimestampFormat), amount)
-	return pg.Insert(sql)
+func (pg *PGConnector) AddRainRate(stationID string, rate RainRate, gwTimestamp time.Time) error {
+	sql := `
+INSERT INTO rain_rate (station_id, gw_timestamp, server_timestamp, sensor_id, mm_per_hour_1, mm_per_hour_5, mm_per_hour_15)
+VALUES ($1,$2,$3,$4,$5,$6,$7);`
+	return pg.Insert(sql, stationID, gwTimestamp, time.Now(), rate.SensorID,
+		rate.MmPerHour1, rate.MmPerHour5, rate.MmPerHour15)
 }
 
 /* QUERYING RAIN */
@@ -117,14 +195,26 @@ func (pg *PGConnector) Select(cmd string) (interface{}, error) {
 	return pg.genericQuery(cmd)
 }
 
-func (pg *PGConnector) TotalRainMMSince(since time.Time) (float64, error) {
-	return pg.TotalRainMMFrom(since, time.Now())
+func (pg *PGConnector) TotalRainMMSince(stationID string, since time.Time) (float64, error) {
+	return pg.TotalRainMMFrom(stationID, since, time.Now())
 }
 
-func (pg *PGConnector) TotalRainMMFrom(from, to time.Time) (float64, error) {
-	sql := fmt.Sprintf(`SELECT sum(amount) FROM rain WHERE gw_timestamp BETWEEN '%s' and '%s';`,
-		from.Format(configkey.TimestampFormat), to.Format(configkey.TimestampFormat))
-	row, err := pg.genericQuery(sql)
+func (pg *PGConnector) TotalRainMMFrom(stationID string, from, to time.Time) (float64, error) {
+	// gauges at the same station catch the same rain, so count the one that caught the most rather than
+	// adding them up. A gauge only ever misses rain, e.g. when it's clogged or paused for cleaning.
+	sql := fmt.Sprintf(`
+SELECT sum(amount) FROM (
+    SELECT station_id, max(amount) AS amount FROM (
+        SELECT station_id, sensor_id, sum(amount) AS amount
+        FROM rain
+        WHERE gw_timestamp BETWEEN $1 and $2
+        AND %s
+        GROUP BY station_id, sensor_id
+    ) AS gauges
+    GROUP BY station_id
+) AS stations
+;`, stationFilter("rain", 3))
+	row, err := pg.genericQuery(sql, from, to, stationID)
 	if err != nil {
 		logrus.Error(err)
 		return configkey.FloatErrVal, err
@@ -140,19 +230,20 @@ func (pg *PGConnector) TotalRainMMFrom(from, to time.Time) (float64, error) {
 	return total, nil
 }
 
-func (pg *PGConnector) GetRainMMSince(since time.Time) (*RainEntriesMm, error) {
-	return pg.GetRainMMFrom(since, time.Now())
+func (pg *PGConnector) GetRainMMSince(stationID string, since time.Time) (*RainEntriesMm, error) {
+	return pg.GetRainMMFrom(stationID, since, time.Now())
 }
 
-func (pg *PGConnector) GetRainMMFrom(from, to time.Time) (*RainEntriesMm, error) {
+func (pg *PGConnector) GetRainMMFrom(stationID string, from, to time.Time) (*RainEntriesMm, error) {
 	sql := fmt.Sprintf(`
-		SELECT gw_timestamp, amount 
+		SELECT gw_timestamp, sensor_id, amount
 		FROM rain 
-		WHERE gw_timestamp BETWEEN '%s' and '%s'
+		WHERE gw_timestamp BETWEEN $1 and $2
+		AND %s
 		ORDER BY gw_timestamp
 		;
-	`, from.Format(configkey.TimestampFormat), to.Format(configkey.TimestampFormat))
-	rows, err := pg.genericQuery(sql)
+	`, stationFilter("rain", 3))
+	rows, err := pg.genericQuery(sql, from, to, stationID)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
@@ -162,22 +253,25 @@ func (pg *PGConnector) GetRainMMFrom(from, to time.Time) (*RainEntriesMm, error)
 	for rows.Next() {
 		var amt float64
 		var stamp time.Time
-		err = rows.Scan(&stamp, &amt)
+		var sensor string
+		err = rows.Scan(&stamp, &sensor, &amt)
 		if err != nil {
 			logrus.Error(err)
 			return nil, err
 		}
 		rain = append(rain, RainEntryMm{
 			Timestamp:   stamp,
+			SensorID:    sensor,
 			Millimeters: amt,
 		})
 	}
 	return &rain, nil
 }
 
-func (pg *PGConnector) GetLastRainTime() (time.Time, error) {
-	sql := `SELECT gw_timestamp FROM rain ORDER BY gw_timestamp DESC LIMIT 1;`
-	row, err := pg.genericQuery(sql)
+func (pg *PGConnector) GetLastRainTime(stationID string) (time.Time, error) {
+	sql := fmt.Sprintf(`SELECT gw_timestamp FROM rain WHERE %s ORDER BY gw_timestamp DESC LIMIT 1;`,
+		stationFilter("rain", 1))
+	row, err := pg.genericQuery(sql, stationID)
 	if err != nil {
 		return errTime, err
 	}
@@ -192,21 +286,52 @@ func (pg *PGConnector) GetLastRainTime() (time.Time, error) {
 	return stamp, nil
 }
 
+func (pg *PGConnector) GetRainRate(stationID string, since time.Duration) (*RainRate, error) {
+	sql := fmt.Sprintf(`
+SELECT gw_timestamp, sensor_id, mm_per_hour_1, mm_per_hour_5, mm_per_hour_15
+FROM rain_rate
+WHERE gw_timestamp > $1
+AND %s
+ORDER BY gw_timestamp DESC
+LIMIT 1
+;`, stationFilter("rain_rate", 2))
+	row, err := pg.genericQuery(sql, time.Now().Add(-since), stationID)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer row.Close()
+	if !row.Next() {
+		return nil, row.Err()
+	}
+	var r RainRate
+	if err = row.Scan(&r.Timestamp, &r.SensorID, &r.MmPerHour1, &r.MmPerHour5, &r.MmPerHour15); err != nil {
+		logrus.Errorf("failed to scan row for rain rate: %s", err)
+		return nil, err
+	}
+	// the gateway sends one last zero rate when the rain stops
+	if r.MmPerHour15 == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
 /* QUERYING TEMPERATURE */
 
-func (pg *PGConnector) GetTempDataCSince(since time.Time) (*TempEntriesC, error) {
-	return pg.GetTempDataCFrom(since, time.Now())
+func (pg *PGConnector) GetTempDataCSince(stationID string, since time.Time) (*TempEntriesC, error) {
+	return pg.GetTempDataCFrom(stationID, since, time.Now())
 }
 
-func (pg *PGConnector) GetTempDataCFrom(from time.Time, to time.Time) (*TempEntriesC, error) {
+func (pg *PGConnector) GetTempDataCFrom(stationID string, from time.Time, to time.Time) (*TempEntriesC, error) {
 	sql := fmt.Sprintf(`
-		SELECT gw_timestamp, value
+		SELECT gw_timestamp, sensor_id, value
 		FROM temperature
-		WHERE gw_timestamp BETWEEN '%s' and '%s'
+		WHERE gw_timestamp BETWEEN $1 and $2
+		AND %s
 		ORDER BY gw_timestamp
 		;
-	`, from.Format(configkey.TimestampFormat), to.Format(configkey.TimestampFormat))
-	rows, err := pg.genericQuery(sql)
+	`, stationFilter("temperature", 3))
+	rows, err := pg.genericQuery(sql, from, to, stationID)
 	if err != nil {
 		logrus.Errorf("bad query: `%s`", sql)
 		return nil, err
@@ -216,23 +341,26 @@ func (pg *PGConnector) GetTempDataCFrom(from time.Time, to time.Time) (*TempEntr
 	var temps TempEntriesC
 	for rows.Next() {
 		var timestamp time.Time
+		var sensor string
 		var tempC int
-		err := rows.Scan(&timestamp, &tempC)
+		err := rows.Scan(&timestamp, &sensor, &tempC)
 		if err != nil {
 			logrus.Errorf("cannot retrieve timestamp/tempC row: %s", err)
 			return nil, err
 		}
 		temps = append(temps, TempEntryC{
 			timestamp,
+			sensor,
 			tempC,
 		})
 	}
 	return &temps, nil
 }
 
-func (pg *PGConnector) GetLastTempC() (int, error) {
-	sql := `SELECT value FROM temperature ORDER BY gw_timestamp DESC LIMIT 1;`
-	row, err := pg.genericQuery(sql)
+func (pg *PGConnector) GetLastTempC(stationID string) (int, error) {
+	sql := fmt.Sprintf(`SELECT value FROM temperature WHERE %s ORDER BY gw_timestamp DESC LIMIT 1;`,
+		stationFilter("temperature", 1))
+	row, err := pg.genericQuery(sql, stationID)
 	if err != nil {
 		logrus.Error(err)
 		return configkey.IntErrVal, err
@@ -248,44 +376,114 @@ func (pg *PGConnector) GetLastTempC() (int, error) {
 	return tempC, nil
 }
 
-func (pg *PGConnector) IsGatewayUp(since time.Duration) (bool, error) {
-	return pg.getLastStatusMessage(since, "gateway")
+func (pg *PGConnector) IsGatewayUp(stationID string, since time.Duration) (bool, error) {
+	announced, online, err := pg.getPresence(stationID)
+	if err != nil || announced {
+		return online, err
+	}
+	// gateways from before presence only have their heartbeat
+	return pg.getLastStatusMessage(stationID, since, "gateway")
 }
 
-func (pg *PGConnector) IsSensorUp(since time.Duration) (bool, error) {
-	return pg.getLastStatusMessage(since, "sensor")
+func (pg *PGConnector) IsSensorUp(stationID string, since time.Duration) (bool, error) {
+	// latest status for each sensor. Only changes are stored, so a state holds until the next one. Status
+	// messages from before the gateway tracked liveness have no state, and only meant the port existed as
+	// long as they kept coming.
+	sql := fmt.Sprintf(`
+SELECT DISTINCT ON (station_id, sensor_id) COALESCE(state, '%s')
+FROM status_log
+WHERE asset = $1
+AND (state IS NOT NULL OR gw_timestamp > $2)
+AND %s
+ORDER BY station_id, sensor_id, gw_timestamp DESC
+;`, SensorUp, stationFilter("status_log", 3))
+	rows, err := pg.genericQuery(sql, configkey.SensorStatus, time.Now().Add(-since), stationID)
+	if err != nil {
+		logrus.Error(err)
+		return false, err
+	}
+	defer rows.Close()
+
+	reported := false
+	for rows.Next() {
+		var state string
+		if err = rows.Scan(&state); err != nil {
+			logrus.Error(err)
+			return false, err
+		}
+		if state != SensorUp {
+			return false, nil
+		}
+		reported = true
+	}
+	return reported, nil
 }
 
-func (pg *PGConnector) GetEventMessagesSince(tag int, since time.Time) (*EventEntries, error) {
-	return pg.GetEventMessagesFrom(tag, since, time.Now())
+func (pg *PGConnector) GetLastGatewayTelemetry(stationID string) (*GatewayTelemetry, error) {
+	sql := fmt.Sprintf(`
+SELECT gw_timestamp, uptime, system_uptime, disk_free, cpu_temp_c, load_1, load_5, load_15, mqtt_reconnects,
+       mqtt_broker, cert_expires, version
+FROM telemetry
+WHERE %s
+ORDER BY gw_timestamp DESC
+LIMIT 1
+;`, stationFilter("telemetry", 1))
+	row, err := pg.genericQuery(sql, stationID)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer row.Close()
+	if !row.Next() {
+		return nil, row.Err()
+	}
+	var t GatewayTelemetry
+	var diskFree, reconnects *int64
+	err = row.Scan(&t.Timestamp, &t.Uptime, &t.SystemUptime, &diskFree, &t.CPUTempC,
+		&t.Load1, &t.Load5, &t.Load15, &reconnects, &t.MQTTBroker, &t.CertExpires, &t.Version)
+	if err != nil {
+		logrus.Errorf("failed to scan row for telemetry: %s", err)
+		return nil, err
+	}
+	t.DiskFree = toUnsigned(diskFree)
+	t.MQTTReconnects = toUnsigned(reconnects)
+	return &t, nil
 }
 
-func (pg *PGConnector) GetEventMessagesFrom(tag int, from, to time.Time) (*EventEntries, error) {
+func (pg *PGConnector) GetEventMessagesSince(stationID string, tag int, since time.Time) (*EventEntries, error) {
+	return pg.GetEventMessagesFrom(stationID, tag, since, time.Now())
+}
+
+func (pg *PGConnector) GetEventMessagesFrom(stationID string, tag int, from, to time.Time) (*EventEntries, error) {
 	sqlAll := fmt.Sprintf(`
-SELECT mappings.longname, event_log.gw_timestamp, event_log.tag, event_log.value
+SELECT mappings.longname, event_log.gw_timestamp, event_log.sensor_id, event_log.tag, event_log.value
 FROM event_log
 LEFT JOIN mappings on event_log.tag = mappings.id
-WHERE gw_timestamp BETWEEN '%s' and '%s'
+WHERE gw_timestamp BETWEEN $1 and $2
+AND %s
 ORDER BY gw_timestamp DESC
-;`, from.Format(configkey.TimestampFormat), to.Format(configkey.TimestampFormat))
+;`, stationFilter("event_log", 3))
 	sqlTag := fmt.Sprintf(`
-SELECT mappings.longname, event_log.gw_timestamp, event_log.tag, event_log.value
+SELECT mappings.longname, event_log.gw_timestamp, event_log.sensor_id, event_log.tag, event_log.value
 FROM event_log
 LEFT JOIN mappings on event_log.tag = mappings.id
-WHERE event_log.tag = %d
-AND gw_timestamp BETWEEN '%s' and '%s'
+WHERE gw_timestamp BETWEEN $1 and $2
+AND %s
+AND event_log.tag = $4
 ORDER BY gw_timestamp DESC
-`, tag, from.Format(configkey.TimestampFormat), to.Format(configkey.TimestampFormat))
+`, stationFilter("event_log", 3))
 
 	var query string
+	args := []interface{}{from, to, stationID}
 	if tag >= 2 && tag <= 5 {
 		query = sqlTag
+		args = append(args, tag)
 	} else if tag == -1 {
 		query = sqlAll
 	} else {
 		return nil, fmt.Errorf("illegal tag %d", tag)
 	}
-	rows, err := pg.genericQuery(query)
+	rows, err := pg.genericQuery(query, args...)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
@@ -298,13 +496,15 @@ ORDER BY gw_timestamp DESC
 		var timestamp time.Time
 		var tag int
 		var value int
-		err = rows.Scan(&longname, &timestamp, &tag, &value)
+		var sensor string
+		err = rows.Scan(&longname, &timestamp, &sensor, &tag, &value)
 		if err != nil {
 			logrus.Error(err)
 			return nil, err
 		}
 		entry := EventEntry{
 			Timestamp: timestamp,
+			SensorID:  sensor,
 			Tag:       tag,
 			Value:     value,
 			Longname:  longname,
@@ -317,22 +517,58 @@ ORDER BY gw_timestamp DESC
 
 /* RANDOM HELPER FUNCTIONS */
 
+// postgresql has no unsigned integers, so counts come back signed
+func toUnsigned(val *int64) *uint64 {
+	if val == nil {
+		return nil
+	}
+	unsigned := uint64(*val)
+	return &unsigned
+}
+
 // executes arbitrary sql. we need to close the connection after each value, either for
-func (pg *PGConnector) genericQuery(cmd string) (pgx.Rows, error) {
-	logrus.Debugf("pgsql: %s", cmd)
-	return pg.pool.Query(context.Background(), cmd)
+func (pg *PGConnector) genericQuery(cmd string, args ...interface{}) (pgx.Rows, error) {
+	logrus.Debugf("pgsql: %s %v", cmd, args)
+	return pg.pool.Query(context.Background(), cmd, args...)
+}
+
+// whether any gateway has announced its presence, and whether any of those is online now
+func (pg *PGConnector) getPresence(stationID string) (announced bool, online bool, err error) {
+	sql := fmt.Sprintf(`
+SELECT DISTINCT ON (station_id) online
+FROM presence
+WHERE %s
+ORDER BY station_id, server_timestamp DESC, id DESC
+;`, stationFilter("presence", 1))
+	rows, err := pg.genericQuery(sql, stationID)
+	if err != nil {
+		logrus.Error(err)
+		return false, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var up bool
+		if err = rows.Scan(&up); err != nil {
+			logrus.Error(err)
+			return false, false, err
+		}
+		announced = true
+		online = online || up
+	}
+	return announced, online, rows.Err()
 }
 
-func (pg *PGConnector) getLastStatusMessage(since time.Duration, asset string) (bool, error) {
+func (pg *PGConnector) getLastStatusMessage(stationID string, since time.Duration, asset string) (bool, error) {
 	sql := fmt.Sprintf(`
 SELECT gw_timestamp 
 FROM status_log 
 LEFT JOIN status_codes on status_log.asset = status_codes.id 
-WHERE status_codes.asset = '%s'
+WHERE status_codes.asset = $1
+AND %s
 ORDER BY gw_timestamp DESC
 LIMIT 1
-;`, asset)
-	row, err := pg.genericQuery(sql)
+;`, stationFilter("status_log", 2))
+	row, err := pg.genericQuery(sql, asset, stationID)
 	if err != nil {
 		logrus.Error(err)
 		return false, err
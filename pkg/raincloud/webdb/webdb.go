@@ -1,99 +1,177 @@
 package webdb
 
 import (
+	"errors"
 	"time"
 )
 
-// DBEntry enters data into the database
+// ErrDuplicate is returned when a message has already been stored, e.g. the broker redelivered it or the
+// gateway replayed it from its outbox
+var ErrDuplicate = errors.New("message already stored")
+
+// DBEntry enters data into the database, recording which station it came from
 type DBEntry interface {
-	// Insert runs arbitrary sql INSERT commands
-	Insert(cmd string) error
+	// Insert runs arbitrary sql INSERT commands, with optional positional arguments
+	Insert(cmd string, args ...interface{}) error
 
-	// AddTagValue puts a single tag and value in the database
-	AddTagValue(tag int, value int, gwTimestamp time.Time) error
+	// AddTagValue puts a single tag and value from a sensor in the database, or returns ErrDuplicate if the
+	// message is there already
+	AddTagValue(stationID, sensorID string, tag int, value int, gwTimestamp time.Time, msg MessageID) error
 
-	// AddTempCValue puts a Celsius temperature value in the database
-	AddTempCValue(tempC int, gwTimestamp time.Time) error
+	// AddTempCValue puts a Celsius temperature value from a sensor in the database, or returns ErrDuplicate if
+	// the message is there already
+	AddTempCValue(stationID, sensorID string, tempC int, gwTimestamp time.Time, msg MessageID) error
 
 	// AddStatusUpdate adds a status message for an asset with an integer ID
-	AddStatusUpdate(asset int, gwTimeamp time.Time) error
-
-	// AddRainMMEvent puts a rain event with a timestamp from the sensor
-	AddRainMMEvent(amount float64, gwTimestamp time.Time) error
+	AddStatusUpdate(stationID string, asset int, gwTimeamp time.Time) error
+	// AddSensorStatus adds a sensor status message with the gateway's opinion of the sensor's health, or
+	// returns ErrDuplicate if the state hasn't changed
+	AddSensorStatus(stationID string, health SensorHealth, gwTimestamp time.Time) error
+	// AddPresence records a gateway coming online or going offline, in the order the server hears about it,
+	// or returns ErrDuplicate if that's what we thought already
+	AddPresence(stationID string, online bool, gwTimestamp time.Time) error
+
+	// AddGatewayTelemetry puts the gateway's report on its own health in the database
+	AddGatewayTelemetry(stationID string, telemetry GatewayTelemetry, gwTimestamp time.Time) error
+	// AddRainMMEvent puts a rain event with a timestamp from the sensor, or returns ErrDuplicate if the message
+	// is there already
+	AddRainMMEvent(stationID, sensorID string, amount float64, gwTimestamp time.Time, msg MessageID) error
+	// AddRainRate puts the rolling rain rate at a sensor in the database
+	AddRainRate(stationID string, rate RainRate, gwTimestamp time.Time) error
 
 	// Close closes the connection with the database. Necessary for pooled connections
 	Close()
 }
 
-// DBQuery retreives data from the database
+// DBQuery retreives data from the database. Every query takes the station ID to read from, or an empty
+// string to combine all stations
 type DBQuery interface {
 	// Select runs arbitary sql SELECT commands
 	Select(cmd string) (interface{}, error)
 
 	// TotalRainMMSince gets total rain from a time in the past to present
-	TotalRainMMSince(since time.Time) (float64, error)
+	TotalRainMMSince(stationID string, since time.Time) (float64, error)
 
-	// TotalRainMMFrom gets total rain between two timestamps
-	TotalRainMMFrom(from time.Time, to time.Time) (float64, error)
+	// TotalRainMMFrom gets total rain between two timestamps. Where a station has more than one gauge, it's
+	// the total from the gauge that caught the most.
+	TotalRainMMFrom(stationID string, from time.Time, to time.Time) (float64, error)
 
 	// GetRainMMSince gets a RainEntriesMm from a time in the past to present
-	GetRainMMSince(since time.Time) (*RainEntriesMm, error)
+	GetRainMMSince(stationID string, since time.Time) (*RainEntriesMm, error)
 
 	// GetRainMMFrom gets a RainEntriesMm between two timestamps
-	GetRainMMFrom(from time.Time, to time.Time) (*RainEntriesMm, error)
+	GetRainMMFrom(stationID string, from time.Time, to time.Time) (*RainEntriesMm, error)
 
 	// GetLastRainTime shows the date of the last rain
-	GetLastRainTime() (time.Time, error)
+	GetLastRainTime(stationID string) (time.Time, error)
+
+	// GetRainRate gets the most recent rain rate reported in a certain time, or nil if it isn't raining
+	GetRainRate(stationID string, since time.Duration) (*RainRate, error)
 
 	// GetTempDataCSince gets a TempEntriesC from a time in the past to the present
-	GetTempDataCSince(since time.Time) (*TempEntriesC, error)
+	GetTempDataCSince(stationID string, since time.Time) (*TempEntriesC, error)
 
 	// GetTempDataCFrom gets a TempEntriesC between two timestamps
-	GetTempDataCFrom(from time.Time, to time.Time) (*TempEntriesC, error)
+	GetTempDataCFrom(stationID string, from time.Time, to time.Time) (*TempEntriesC, error)
 
 	// GetLastTempC shows the most recent temperature
-	GetLastTempC() (int, error)
+	GetLastTempC(stationID string) (int, error)
 
-	// IsGatewayUp tells whether the gateway has published a status message in a certain time
-	IsGatewayUp(since time.Duration) (bool, error)
+	// IsGatewayUp tells whether the gateway last said it was online, or for gateways that don't announce
+	// their presence, whether it has published a status message in a certain time
+	IsGatewayUp(stationID string, since time.Duration) (bool, error)
 
-	// IsSensorUp tells whether the sensor has published a status message in a certain time
-	IsSensorUp(since time.Duration) (bool, error)
+	// IsSensorUp tells whether every sensor was last reported as up, counting sensors from gateways that don't
+	// report a state only if they reported in a certain time
+	IsSensorUp(stationID string, since time.Duration) (bool, error)
 
+	// GetLastGatewayTelemetry gets the most recent telemetry from the gateway, or nil if there isn't any
+	GetLastGatewayTelemetry(stationID string) (*GatewayTelemetry, error)
 	// GetEventMessagesSince gets an EventEntries from a time in the past to present. Specify tag or -1 for all tags
-	GetEventMessagesSince(tag int, since time.Time) (*EventEntries, error)
+	GetEventMessagesSince(stationID string, tag int, since time.Time) (*EventEntries, error)
 
 	// GetEventMessagesFrom gets an EventEntries between two timestamps. Specify tag or -1 for all tags
-	GetEventMessagesFrom(tag int, from time.Time, to time.Time) (*EventEntries, error)
+	GetEventMessagesFrom(stationID string, tag int, from time.Time, to time.Time) (*EventEntries, error)
 
 	// Close closes the connection with the database. Necessary for pooled connections
 	Close()
 }
 
+// MessageID is how the gateway identifies a measurement or event message. The zero value is for gateways that
+// don't send IDs, and is never a duplicate.
+type MessageID struct {
+	ID       string // unique to the message at its station
+	Sequence uint64 // counts up from 1 each time the gateway starts
+}
+
 // RainEntriesMm is a simple array of RainEntryMm values
 type RainEntriesMm []RainEntryMm
 
 // RainEntryMm is a single timestamp/mm of rain entry
 type RainEntryMm struct {
 	Timestamp   time.Time // timestamp on the gateway that the event was recorded
+	SensorID    string    // which gauge caught it, empty for gateways from before there could be several
 	Millimeters float64   // amount of rain in millimeters
 }
 
+// RainRate is how hard it's raining at a sensor, averaged over the last 1, 5 and 15 minutes. Field names
+// match the rain rate payload.
+type RainRate struct {
+	Timestamp   time.Time // timestamp on the gateway that the rate was calculated
+	SensorID    string    // which sensor measured the rain
+	MmPerHour1  float64   // millimeters per hour over the last minute
+	MmPerHour5  float64   // millimeters per hour over the last 5 minutes
+	MmPerHour15 float64   // millimeters per hour over the last 15 minutes
+}
+
 // TempEntriesC is an ordered slice of TempEntryC values
 type TempEntriesC []TempEntryC
 
 // TempEntryC is a single temperature/timestamp entry
 type TempEntryC struct {
 	Timestamp time.Time // timestamp on the gateway that the measurement was recorded
+	SensorID  string    // which sensor measured it
 	TempC     int       // temperature value in Celsius
 }
 
+// SensorHealth is how the gateway sees a sensor, sent in the sensor status message
+type SensorHealth struct {
+	SensorID      string  // which sensor at the station
+	State         string  // up, stale or down
+	Reason        string  // why the sensor is in that state
+	LastPacketAge float64 // seconds since the gateway last heard from the sensor, -1 if never
+}
+
+// GatewayTelemetry is the gateway's report on the machine it runs on. Field names match the gateway status
+// payload, and anything the gateway couldn't measure is nil.
+type GatewayTelemetry struct {
+	Timestamp      time.Time  // timestamp on the gateway that the telemetry was recorded
+	Uptime         *float64   // seconds the rainbase has been running
+	SystemUptime   *float64   // seconds since the gateway booted
+	DiskFree       *uint64    // bytes free on the filesystem holding the local database
+	CPUTempC       *float64   // CPU temperature in Celsius
+	Load1          *float64   // 1 minute load average
+	Load5          *float64   // 5 minute load average
+	Load15         *float64   // 15 minute load average
+	MQTTReconnects *uint64    // times the gateway has reconnected to the broker
+	MQTTBroker     *string    // broker the gateway was connected to
+	CertExpires    *time.Time // when the gateway's mqtt client certificate expires
+	Version        *string    // software version on the gateway
+}
+
+// sensor health states
+const (
+	SensorUp   = "up"
+	SensorDown = "down"
+)
+
 // EventEntries is a slice of EventEntry structs
 type EventEntries []EventEntry
 
 // EventEntry is a single sensor event
 type EventEntry struct {
 	Timestamp time.Time // timestamp on the gateway that the event was recorded
+	SensorID  string    // which sensor it happened to
 	Tag       int       // type of event
 	Value     int       // value of the event, basically 1 for all events
 	Longname  string    // human-comprehensible name, matches 1-to-1 with Tag
@@ -1,6 +1,7 @@
 package webdb_test
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"sort"
@@ -25,6 +26,8 @@ import (
 
 const (
 	secondsInYear = 60 * 60 * 24 * 365
+	station       = "test"
+	sensor        = "raingauge"
 )
 
 var yearAgo = time.Now().Add(time.Second * -secondsInYear) //nolint:gochecknoglobals
@@ -68,6 +71,9 @@ func (suite *WebDBTest) SetupTest() {
 		"DELETE FROM rain;",
 		"DELETE FROM event_log;",
 		"DELETE FROM status_log;",
+		"DELETE FROM telemetry;",
+		"DELETE FROM rain_rate;",
+		"DELETE FROM presence;",
 	} {
 		err := suite.entry.Insert(sql)
 		if err != nil {
@@ -133,13 +139,13 @@ func (suite *WebDBTest) TestInsertSelectTemperatureData() {
 	size := 100
 	expected := generateRandomTempEntriesC(size)
 	for _, entry := range expected {
-		err := suite.entry.AddTempCValue(entry.TempC, entry.Timestamp)
+		err := suite.entry.AddTempCValue(station, sensor, entry.TempC, entry.Timestamp, webdb.MessageID{})
 		if err != nil {
 			suite.Fail("error inserting temperature into database", err)
 		}
 	}
 	since := yearAgo
-	actual, err := suite.query.GetTempDataCSince(since)
+	actual, err := suite.query.GetTempDataCSince(station, since)
 	if err != nil {
 		suite.Fail("error getting temp data", err)
 	}
@@ -175,7 +181,7 @@ func (suite *WebDBTest) TestInsertSelectSpecificTemperatureRange() {
 		entry := webdb.TempEntryC{Timestamp: timestamp, TempC: temp}
 
 		// enter everything into the database
-		err := suite.entry.AddTempCValue(temp, timestamp)
+		err := suite.entry.AddTempCValue(station, sensor, temp, timestamp, webdb.MessageID{})
 		if err != nil {
 			suite.Fail("unable to add temp data", err)
 		}
@@ -187,7 +193,7 @@ func (suite *WebDBTest) TestInsertSelectSpecificTemperatureRange() {
 		temp++
 	}
 	// verify the query
-	actual, err := suite.query.GetTempDataCFrom(beginning, finish)
+	actual, err := suite.query.GetTempDataCFrom(station, beginning, finish)
 	if err != nil {
 		suite.Fail("error getting temperature data", err)
 	}
@@ -218,12 +224,12 @@ func (suite *WebDBTest) TestGetLastTempC() {
 			maxDate = stamp
 			maxTemp = temp
 		}
-		err := suite.entry.AddTempCValue(temp, stamp)
+		err := suite.entry.AddTempCValue(station, sensor, temp, stamp, webdb.MessageID{})
 		if err != nil {
 			suite.Fail("error inserting temp data", err)
 		}
 	}
-	actual, err := suite.query.GetLastTempC()
+	actual, err := suite.query.GetLastTempC(station)
 	if err != nil {
 		suite.Fail("error getting last temp", err)
 	}
@@ -260,13 +266,13 @@ func (suite *WebDBTest) TestEnterAndRetrieveRainAllData() {
 	data := generateRandomRainEntriesMM(100)
 	var expTotalRain float64 = 0.0
 	for _, entry := range data {
-		err := suite.entry.AddRainMMEvent(entry.Millimeters, entry.Timestamp)
+		err := suite.entry.AddRainMMEvent(station, sensor, entry.Millimeters, entry.Timestamp, webdb.MessageID{})
 		expTotalRain += entry.Millimeters
 		if err != nil {
 			suite.Fail("failed to add rain amount", err)
 		}
 	}
-	actual, err := suite.query.GetRainMMSince(yearAgo)
+	actual, err := suite.query.GetRainMMSince(station, yearAgo)
 	if err != nil {
 		suite.Fail("error getting rain MM since", err)
 	}
@@ -284,6 +290,33 @@ func (suite *WebDBTest) TestEnterAndRetrieveRainAllData() {
 	assert.Equal(suite.T(), expTotalRain, actTotalRain, "actual and total rain are not equal")
 }
 
+// a redelivered message is reported and doesn't count twice, but messages without an ID are always stored
+func (suite *WebDBTest) TestDuplicateMessages() {
+	amt := viper.GetFloat64(configkey.SensorRainMm)
+	stamp := time.Now().Add(time.Minute * -1)
+	msg := webdb.MessageID{ID: "0a1b2c3d-1", Sequence: 1}
+	if err := suite.entry.AddRainMMEvent(station, sensor, amt, stamp, msg); err != nil {
+		suite.Fail("failed to add rain amount", err)
+	}
+	err := suite.entry.AddRainMMEvent(station, sensor, amt, stamp, msg)
+	assert.True(suite.T(), errors.Is(err, webdb.ErrDuplicate), "expected a duplicate, got %v", err)
+	err = suite.entry.AddTempCValue(station, sensor, 20, stamp, msg)
+	assert.Nil(suite.T(), err, "IDs only need to be unique within a table")
+	err = suite.entry.AddRainMMEvent("other", sensor, amt, stamp, msg)
+	assert.Nil(suite.T(), err, "IDs only need to be unique within a station")
+	for i := 0; i < 2; i++ {
+		if err = suite.entry.AddRainMMEvent(station, sensor, amt, stamp, webdb.MessageID{}); err != nil {
+			suite.Fail("failed to add rain amount without an ID", err)
+		}
+	}
+
+	total, err := suite.query.TotalRainMMSince(station, stamp.Add(-time.Minute))
+	if err != nil {
+		suite.Fail("error getting total rain", err)
+	}
+	assert.InDelta(suite.T(), amt*3, total, 1e-9)
+}
+
 // test all the rain values on a selected range
 func (suite *WebDBTest) TestEnterAndRetrieveRainDataWithinRange() {
 	amt := viper.GetFloat64(configkey.SensorRainMm)
@@ -303,7 +336,7 @@ func (suite *WebDBTest) TestEnterAndRetrieveRainDataWithinRange() {
 		entry := webdb.RainEntryMm{Timestamp: timestamp, Millimeters: amt}
 
 		// enter everything into the database
-		err := suite.entry.AddRainMMEvent(amt, timestamp)
+		err := suite.entry.AddRainMMEvent(station, sensor, amt, timestamp, webdb.MessageID{})
 		if err != nil {
 			suite.Fail("unable to add rain data", err)
 		}
@@ -314,7 +347,7 @@ func (suite *WebDBTest) TestEnterAndRetrieveRainDataWithinRange() {
 			expTotal += amt
 		}
 	}
-	actual, err := suite.query.GetRainMMFrom(beginning, finish)
+	actual, err := suite.query.GetRainMMFrom(station, beginning, finish)
 	if err != nil {
 		suite.Fail("error getting rain mm from", err)
 	}
@@ -332,7 +365,7 @@ func (suite *WebDBTest) TestEnterAndRetrieveRainDataWithinRange() {
 	assert.Equal(suite.T(), expTotal, actTotal, "total amounts are unequal")
 
 	// also verify the tallying function
-	queriedTotal, err := suite.query.TotalRainMMFrom(beginning, finish)
+	queriedTotal, err := suite.query.TotalRainMMFrom(station, beginning, finish)
 	if err != nil {
 		suite.Fail("error getting total rain mm from", err)
 	}
@@ -346,13 +379,13 @@ func (suite *WebDBTest) TestGetLastRainTime() {
 	twoHoursAgo := time.Now().Add(time.Hour * -2)
 	oneHourAgo := time.Now().Add(time.Hour * -1)
 	for _, stamp := range []time.Time{twoHoursAgo, oneHourAgo} {
-		err := suite.entry.AddRainMMEvent(amt, stamp)
+		err := suite.entry.AddRainMMEvent(station, sensor, amt, stamp, webdb.MessageID{})
 		if err != nil {
 			suite.Fail("failed to enter value", err)
 		}
 	}
 	//
-	lastRainTime, err := suite.query.GetLastRainTime()
+	lastRainTime, err := suite.query.GetLastRainTime(station)
 	if err != nil {
 		suite.Fail("error getting last rain time", err)
 	}
@@ -367,20 +400,20 @@ func (suite *WebDBTest) TestGetLastRainTime() {
 //func (suite *WebDBTest) TestGenerateLotsOfData() {
 //	n := 500
 //	for _, v := range generateRandomRainEntriesMM(n) {
-//		if err := suite.entry.AddRainMMEvent(v.Millimeters, v.Timestamp); err != nil {
+//		if err := suite.entry.AddRainMMEvent(station, v.Millimeters, v.Timestamp); err != nil {
 //			suite.Fail("unable to enter rain", err)
 //		}
 //	}
 //	for _, v := range generateRandomTempEntriesC(n) {
-//		if err := suite.entry.AddTempCValue(v.TempC, v.Timestamp); err != nil {
+//		if err := suite.entry.AddTempCValue(station, v.TempC, v.Timestamp); err != nil {
 //			suite.Fail("unable to enter temp", err)
 //		}
 //	}
 //	for _, v := range *generateOrderedTimestamps(n) {
-//		if err := suite.entry.AddStatusUpdate(configkey.SensorStatus, v); err != nil {
+//		if err := suite.entry.AddStatusUpdate(station, configkey.SensorStatus, v); err != nil {
 //			suite.Fail("failure to add sensor status", err)
 //		}
-//		if err := suite.entry.AddStatusUpdate(configkey.GatewayStatus, v); err != nil {
+//		if err := suite.entry.AddStatusUpdate(station, configkey.GatewayStatus, v); err != nil {
 //			suite.Fail("failure to add gw status", err)
 //		}
 //	}
@@ -403,13 +436,13 @@ func generateRandomRainEntriesMM(n int) webdb.RainEntriesMm {
 // make sure we don't error on event/status messages
 func (suite *WebDBTest) TestEventAndStatusMessagesDontError() {
 	for _, asset := range []int{configkey.SensorStatus, configkey.GatewayStatus} {
-		err := suite.entry.AddStatusUpdate(asset, time.Now())
+		err := suite.entry.AddStatusUpdate(station, asset, time.Now())
 		if err != nil {
 			suite.Fail("unable to add status message", err)
 		}
 	}
 	for _, tag := range []int{tlv.SoftReset, tlv.HardReset, tlv.Pause, tlv.Unpause} {
-		err := suite.entry.AddTagValue(tag, 1, time.Now())
+		err := suite.entry.AddTagValue(station, sensor, tag, 1, time.Now(), webdb.MessageID{})
 		if err != nil {
 			suite.Fail("unable to add tag", err)
 		}
@@ -444,19 +477,19 @@ func (suite *WebDBTest) TestEventAndStatusMessagesDontError() {
 func (suite *WebDBTest) TestEmptyResultsDontError() {
 	// test assumes all rows are empty
 
-	rainSince, err := suite.query.GetRainMMSince(time.Now())
+	rainSince, err := suite.query.GetRainMMSince(station, time.Now())
 	if err != nil {
 		suite.Fail("rain since errors on zero", err)
 	}
 	assert.Zero(suite.T(), len(*rainSince), "expected an empty struct")
 
-	rainBetween, err := suite.query.TotalRainMMFrom(time.Now(), time.Now())
+	rainBetween, err := suite.query.TotalRainMMFrom(station, time.Now(), time.Now())
 	if err != nil {
 		suite.Fail("rain from errors on zero", err)
 	}
 	assert.Zero(suite.T(), rainBetween, "function should return 0.0 when no matches")
 
-	tempSince, err := suite.query.GetTempDataCSince(time.Now())
+	tempSince, err := suite.query.GetTempDataCSince(station, time.Now())
 	if err != nil {
 		suite.Fail("temp since errors on zero", err)
 	}
@@ -471,7 +504,7 @@ func (suite *WebDBTest) TestLastStatusMessage() {
 		time.Now().Add(time.Minute * -7),
 	} {
 		for _, v := range []int{configkey.GatewayStatus, configkey.SensorStatus} {
-			err := suite.entry.AddStatusUpdate(v, timestamp)
+			err := suite.entry.AddStatusUpdate(station, v, timestamp)
 			if err != nil {
 				suite.Fail("unable to add sensor status message", err)
 			}
@@ -480,11 +513,11 @@ func (suite *WebDBTest) TestLastStatusMessage() {
 
 	// will match the 5-minute but not 7-minute message
 	good := time.Minute * 6
-	gwTrue, err := suite.query.IsGatewayUp(good)
+	gwTrue, err := suite.query.IsGatewayUp(station, good)
 	if err != nil {
 		suite.Fail("problem querying gw status", err)
 	}
-	sensorTrue, err := suite.query.IsSensorUp(good)
+	sensorTrue, err := suite.query.IsSensorUp(station, good)
 	if err != nil {
 		suite.Fail("problem querying sensor status", err)
 	}
@@ -493,11 +526,11 @@ func (suite *WebDBTest) TestLastStatusMessage() {
 
 	// shouldn't match either message
 	bad := time.Minute * 4
-	gwFalse, err := suite.query.IsGatewayUp(bad)
+	gwFalse, err := suite.query.IsGatewayUp(station, bad)
 	if err != nil {
 		suite.Fail("problem querying gw status", err)
 	}
-	sensorFalse, err := suite.query.IsSensorUp(bad)
+	sensorFalse, err := suite.query.IsSensorUp(station, bad)
 	if err != nil {
 		suite.Fail("problem querying sensor status", err)
 	}
@@ -505,6 +538,155 @@ func (suite *WebDBTest) TestLastStatusMessage() {
 	assert.False(suite.T(), sensorFalse)
 }
 
+// presence only records changes, in the order the server hears them, and wins over the heartbeat once a
+// gateway has announced itself
+func (suite *WebDBTest) TestPresence() {
+	now := time.Now()
+	if err := suite.entry.AddStatusUpdate(station, configkey.GatewayStatus, now); err != nil {
+		suite.Fail("unable to add gateway status message", err)
+	}
+	// the gateway's clock is an hour fast, then an hour slow, and the last will has the server's
+	for _, change := range []struct {
+		online bool
+		stamp  time.Time
+	}{
+		{true, now.Add(time.Hour)},
+		{false, now},
+		{true, now.Add(-time.Hour)},
+	} {
+		if err := suite.entry.AddPresence(station, change.online, change.stamp); err != nil {
+			suite.Fail("unable to add presence", err)
+		}
+		err := suite.entry.AddPresence(station, change.online, change.stamp)
+		assert.True(suite.T(), errors.Is(err, webdb.ErrDuplicate), "expected a duplicate, got %v", err)
+		up, err := suite.query.IsGatewayUp(station, time.Minute)
+		if err != nil {
+			suite.Fail("problem querying gw status", err)
+		}
+		assert.Equal(suite.T(), change.online, up)
+	}
+
+	val, err := suite.query.Select(`SELECT count(*) FROM presence;`)
+	if err != nil {
+		suite.Fail("unable to query presence table", err)
+	}
+	changes, err := unwrap(val)
+	if err != nil {
+		suite.Fail("unable to unwrap presence", err)
+	}
+	assert.Equal(suite.T(), int64(3), changes)
+}
+
+// telemetry comes back out the way it went in, including what the gateway couldn't measure
+func (suite *WebDBTest) TestGatewayTelemetry() {
+	empty, err := suite.query.GetLastGatewayTelemetry(station)
+	if err != nil {
+		suite.Fail("problem querying empty telemetry", err)
+	}
+	assert.Nil(suite.T(), empty)
+
+	uptime, diskFree, reconnects, version := 3600.0, uint64(8<<30), uint64(2), "dev"
+	expires := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	broker := "ssl://fallback.local:8883"
+	expected := webdb.GatewayTelemetry{
+		Uptime:         &uptime,
+		DiskFree:       &diskFree,
+		MQTTReconnects: &reconnects,
+		MQTTBroker:     &broker,
+		CertExpires:    &expires,
+		Version:        &version,
+	}
+	stamp := time.Now().Add(time.Minute * -1)
+	if err = suite.entry.AddGatewayTelemetry(station, expected, stamp); err != nil {
+		suite.Fail("unable to add telemetry", err)
+	}
+	actual, err := suite.query.GetLastGatewayTelemetry(station)
+	if err != nil {
+		suite.Fail("problem querying telemetry", err)
+	}
+	assert.NotNil(suite.T(), actual)
+	assert.Equal(suite.T(), uptime, *actual.Uptime)
+	assert.Equal(suite.T(), diskFree, *actual.DiskFree)
+	assert.Equal(suite.T(), reconnects, *actual.MQTTReconnects)
+	assert.Equal(suite.T(), version, *actual.Version)
+	assert.True(suite.T(), expires.Equal(*actual.CertExpires))
+	assert.Equal(suite.T(), broker, *actual.MQTTBroker)
+	assert.Nil(suite.T(), actual.CPUTempC, "cpu temperature wasn't measured")
+	assert.Nil(suite.T(), actual.Load1, "load wasn't measured")
+}
+
+// the latest rain rate is the current one, until the gateway reports the rain has stopped
+func (suite *WebDBTest) TestRainRate() {
+	empty, err := suite.query.GetRainRate(station, time.Minute*5)
+	if err != nil {
+		suite.Fail("problem querying empty rain rate", err)
+	}
+	assert.Nil(suite.T(), empty)
+
+	now := time.Now()
+	for i, rate := range []webdb.RainRate{
+		{SensorID: "north", MmPerHour1: 16.8, MmPerHour5: 10.1, MmPerHour15: 6.7},
+		{SensorID: "north", MmPerHour1: 0, MmPerHour5: 3.4, MmPerHour15: 4.5},
+	} {
+		if err = suite.entry.AddRainRate(station, rate, now.Add(time.Minute*time.Duration(i-2))); err != nil {
+			suite.Fail("unable to add rain rate", err)
+		}
+	}
+	current, err := suite.query.GetRainRate(station, time.Minute*5)
+	if err != nil {
+		suite.Fail("problem querying rain rate", err)
+	}
+	assert.NotNil(suite.T(), current)
+	assert.Equal(suite.T(), 3.4, current.MmPerHour5)
+
+	stopped := webdb.RainRate{SensorID: "north"}
+	if err = suite.entry.AddRainRate(station, stopped, now); err != nil {
+		suite.Fail("unable to add rain rate", err)
+	}
+	current, err = suite.query.GetRainRate(station, time.Minute*5)
+	if err != nil {
+		suite.Fail("problem querying rain rate", err)
+	}
+	assert.Nil(suite.T(), current, "it stopped raining")
+}
+
+// a stale or down sensor isn't up, even if it reported recently
+func (suite *WebDBTest) TestSensorHealth() {
+	now := time.Now()
+	north := webdb.SensorHealth{SensorID: "north", State: webdb.SensorUp, LastPacketAge: 1}
+	south := webdb.SensorHealth{SensorID: "south", State: "stale", Reason: "no packets for 12s", LastPacketAge: 12}
+	for _, health := range []webdb.SensorHealth{north, south} {
+		if err := suite.entry.AddSensorStatus(station, health, now.Add(time.Minute*-2)); err != nil {
+			suite.Fail("unable to add sensor status", err)
+		}
+	}
+	up, err := suite.query.IsSensorUp(station, time.Minute*5)
+	if err != nil {
+		suite.Fail("problem querying sensor status", err)
+	}
+	assert.False(suite.T(), up, "one of the sensors is stale")
+
+	// the newest status for each sensor is the one that counts
+	south.State = webdb.SensorUp
+	if err = suite.entry.AddSensorStatus(station, south, now.Add(time.Minute*-1)); err != nil {
+		suite.Fail("unable to add sensor status", err)
+	}
+	up, err = suite.query.IsSensorUp(station, time.Minute*5)
+	if err != nil {
+		suite.Fail("problem querying sensor status", err)
+	}
+	assert.True(suite.T(), up, "both sensors are up")
+
+	// only changes are stored, and a state holds until the next one
+	err = suite.entry.AddSensorStatus(station, north, now)
+	assert.True(suite.T(), errors.Is(err, webdb.ErrDuplicate), "expected a duplicate, got %v", err)
+	up, err = suite.query.IsSensorUp(station, time.Second)
+	if err != nil {
+		suite.Fail("problem querying sensor status", err)
+	}
+	assert.True(suite.T(), up, "both sensors are still up")
+}
+
 // make sure we can query event messages
 func (suite *WebDBTest) TestEventMessages() {
 	// enter one of each kind of int at 2 different intervals
@@ -519,7 +701,7 @@ func (suite *WebDBTest) TestEventMessages() {
 			tlv.SoftReset: tlv.SoftResetValue,
 			tlv.HardReset: tlv.HardResetValue,
 		} {
-			err := suite.entry.AddTagValue(tag, int(value), stamp)
+			err := suite.entry.AddTagValue(station, sensor, tag, int(value), stamp, webdb.MessageID{})
 			if err != nil {
 				suite.Fail("failed to add tagged event", err)
 			}
@@ -529,7 +711,7 @@ func (suite *WebDBTest) TestEventMessages() {
 	// query to find just the 10- and 11-minute messages
 	target := tlv.Pause // just pick one, should be good enough
 	targetVal := tlv.PauseValue
-	res, err := suite.query.GetEventMessagesFrom(target, time.Now().Add(time.Minute*-12), time.Now().Add(time.Minute*-9))
+	res, err := suite.query.GetEventMessagesFrom(station, target, time.Now().Add(time.Minute*-12), time.Now().Add(time.Minute*-9))
 	if err != nil {
 		suite.Fail("problem querying event message range", err)
 	}
@@ -546,7 +728,7 @@ func (suite *WebDBTest) TestEventMessages() {
 	}
 
 	// repeat with all of the entries
-	res, err = suite.query.GetEventMessagesFrom(-1, time.Now().Add(time.Minute*-12), time.Now().Add(time.Minute*-9))
+	res, err = suite.query.GetEventMessagesFrom(station, -1, time.Now().Add(time.Minute*-12), time.Now().Add(time.Minute*-9))
 	if err != nil {
 		suite.Fail("problem querying all entries with -1", err)
 	}
@@ -561,6 +743,88 @@ func (suite *WebDBTest) TestEventMessages() {
 	assert.Equal(suite.T(), expectedSum, actualSum, "not all tags were represented")
 }
 
+// gauges at the same station are told apart, and their rain isn't added up
+func (suite *WebDBTest) TestSensorsAtAStation() {
+	amt := viper.GetFloat64(configkey.SensorRainMm)
+	now := time.Now()
+	for i, gauge := range []string{"north", "north", "north", "south", "south"} {
+		if err := suite.entry.AddRainMMEvent(station, gauge, amt, now.Add(time.Minute*time.Duration(-i-1)), webdb.MessageID{}); err != nil {
+			suite.Fail("unable to add rain", err)
+		}
+		if err := suite.entry.AddTempCValue(station, gauge, i, now.Add(time.Minute*time.Duration(-i-1)), webdb.MessageID{}); err != nil {
+			suite.Fail("unable to add temperature", err)
+		}
+	}
+	if err := suite.entry.AddRainMMEvent("elsewhere", sensor, amt, now, webdb.MessageID{}); err != nil {
+		suite.Fail("unable to add rain", err)
+	}
+
+	total, err := suite.query.TotalRainMMSince(station, yearAgo)
+	if err != nil {
+		suite.Fail("error getting station rain", err)
+	}
+	assert.InDelta(suite.T(), 3*amt, total, 0.0001, "expected the rain from the gauge that caught the most")
+	everyone, err := suite.query.TotalRainMMSince("", yearAgo)
+	if err != nil {
+		suite.Fail("error getting rain for all stations", err)
+	}
+	assert.InDelta(suite.T(), 4*amt, everyone, 0.0001, "expected each station's rain to be added up")
+
+	rain, err := suite.query.GetRainMMSince(station, yearAgo)
+	if err != nil {
+		suite.Fail("error getting rain entries", err)
+	}
+	temps, err := suite.query.GetTempDataCSince(station, yearAgo)
+	if err != nil {
+		suite.Fail("error getting temperature entries", err)
+	}
+	// both come back oldest first
+	assert.Equal(suite.T(), "south", (*rain)[0].SensorID)
+	assert.Equal(suite.T(), "north", (*rain)[4].SensorID)
+	assert.Equal(suite.T(), "south", (*temps)[0].SensorID)
+	assert.Equal(suite.T(), 4, (*temps)[0].TempC)
+}
+
+// data from one station doesn't show up in another's queries, but does when querying every station
+func (suite *WebDBTest) TestStationsAreSeparate() {
+	amt := viper.GetFloat64(configkey.SensorRainMm)
+	now := time.Now()
+	for i, other := range []string{station, station, "elsewhere"} {
+		if err := suite.entry.AddRainMMEvent(other, sensor, amt, now.Add(time.Minute*time.Duration(-i-1)), webdb.MessageID{}); err != nil {
+			suite.Fail("unable to add rain", err)
+		}
+		if err := suite.entry.AddTempCValue(other, sensor, i, now.Add(time.Minute*time.Duration(-i-1)), webdb.MessageID{}); err != nil {
+			suite.Fail("unable to add temperature", err)
+		}
+	}
+	if err := suite.entry.AddStatusUpdate("elsewhere", configkey.GatewayStatus, now); err != nil {
+		suite.Fail("unable to add status message", err)
+	}
+
+	ours, err := suite.query.TotalRainMMSince(station, yearAgo)
+	if err != nil {
+		suite.Fail("error getting station rain", err)
+	}
+	assert.InDelta(suite.T(), 2*amt, ours, 0.0001, "rain from another station was counted")
+	everyone, err := suite.query.TotalRainMMSince("", yearAgo)
+	if err != nil {
+		suite.Fail("error getting rain for all stations", err)
+	}
+	assert.InDelta(suite.T(), 3*amt, everyone, 0.0001, "rain from every station wasn't counted")
+
+	lastTemp, err := suite.query.GetLastTempC("elsewhere")
+	if err != nil {
+		suite.Fail("error getting station temperature", err)
+	}
+	assert.Equal(suite.T(), 2, lastTemp)
+
+	up, err := suite.query.IsGatewayUp(station, time.Minute)
+	if err != nil {
+		suite.Fail("error getting gateway status", err)
+	}
+	assert.False(suite.T(), up, "another station's gateway status was counted")
+}
+
 /* HELPER FUNCTIONS */
 
 // unwrap a single value
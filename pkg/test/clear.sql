@@ -3,4 +3,7 @@ DELETE FROM rain;
 DELETE FROM temperature;
 DELETE FROM status_log;
 DELETE FROM event_log;
+DELETE FROM telemetry;
+DELETE FROM rain_rate;
+DELETE FROM presence;
 COMMIT;
\ No newline at end of file
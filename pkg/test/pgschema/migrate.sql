@@ -0,0 +1,107 @@
+/* migrate.sql
+   brings an existing production database up to schema.sql without dropping
+   any rows. schema.sql only runs when the database is first created, so
+   apply this by hand after upgrading raincloud:
+
+       psql -h <host> -U <user> -d <database> -f migrate.sql
+
+   every statement checks before it changes anything, so it is safe to run
+   against a database that is already partly or fully migrated. rows stored
+   before stations and sensors existed are given the 'default' station and
+   an empty sensor, the same as a gateway that doesn't send them.
+ */
+
+BEGIN;
+ALTER TABLE rain
+    ADD COLUMN IF NOT EXISTS station_id TEXT   NOT NULL DEFAULT 'default',
+    ADD COLUMN IF NOT EXISTS sensor_id  TEXT   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS message_id TEXT   NULL,
+    ADD COLUMN IF NOT EXISTS sequence   BIGINT NULL;
+CREATE INDEX IF NOT EXISTS rain_station ON rain (station_id, gw_timestamp);
+
+ALTER TABLE temperature
+    ADD COLUMN IF NOT EXISTS station_id TEXT   NOT NULL DEFAULT 'default',
+    ADD COLUMN IF NOT EXISTS sensor_id  TEXT   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS message_id TEXT   NULL,
+    ADD COLUMN IF NOT EXISTS sequence   BIGINT NULL;
+CREATE INDEX IF NOT EXISTS temperature_station ON temperature (station_id, gw_timestamp);
+
+ALTER TABLE event_log
+    ADD COLUMN IF NOT EXISTS station_id TEXT   NOT NULL DEFAULT 'default',
+    ADD COLUMN IF NOT EXISTS sensor_id  TEXT   NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS message_id TEXT   NULL,
+    ADD COLUMN IF NOT EXISTS sequence   BIGINT NULL;
+
+ALTER TABLE status_log
+    ADD COLUMN IF NOT EXISTS station_id      TEXT  NOT NULL DEFAULT 'default',
+    ADD COLUMN IF NOT EXISTS sensor_id       TEXT  NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS state           TEXT  NULL,
+    ADD COLUMN IF NOT EXISTS reason          TEXT  NULL,
+    ADD COLUMN IF NOT EXISTS last_packet_age FLOAT NULL;
+
+-- ADD CONSTRAINT has no IF NOT EXISTS, so look for the name postgres gives
+-- the UNIQUE constraints in schema.sql
+DO
+$$
+    DECLARE
+        t TEXT;
+    BEGIN
+        FOREACH t IN ARRAY ARRAY ['rain', 'temperature', 'event_log']
+            LOOP
+                IF NOT EXISTS(SELECT 1
+                              FROM pg_constraint
+                              WHERE conname = t || '_station_id_message_id_key') THEN
+                    EXECUTE format('ALTER TABLE %I ADD CONSTRAINT %I UNIQUE (station_id, message_id)',
+                                   t, t || '_station_id_message_id_key');
+                END IF;
+            END LOOP;
+    END
+$$;
+
+CREATE TABLE IF NOT EXISTS telemetry
+(
+    id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
+    gw_timestamp     TIMESTAMPTZ NOT NULL,
+    server_timestamp TIMESTAMPTZ NOT NULL,
+    uptime           FLOAT       NULL,
+    system_uptime    FLOAT       NULL,
+    disk_free        BIGINT      NULL,
+    cpu_temp_c       FLOAT       NULL,
+    load_1           FLOAT       NULL,
+    load_5           FLOAT       NULL,
+    load_15          FLOAT       NULL,
+    mqtt_reconnects  BIGINT      NULL,
+    version          TEXT        NULL
+);
+-- added after the table itself
+ALTER TABLE telemetry
+    ADD COLUMN IF NOT EXISTS mqtt_broker  TEXT        NULL,
+    ADD COLUMN IF NOT EXISTS cert_expires TIMESTAMPTZ NULL;
+CREATE INDEX IF NOT EXISTS telemetry_station ON telemetry (station_id, gw_timestamp);
+
+CREATE TABLE IF NOT EXISTS rain_rate
+(
+    id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
+    gw_timestamp     TIMESTAMPTZ NOT NULL,
+    server_timestamp TIMESTAMPTZ NOT NULL,
+    sensor_id        TEXT        NOT NULL DEFAULT '',
+    mm_per_hour_1    FLOAT       NOT NULL,
+    mm_per_hour_5    FLOAT       NOT NULL,
+    mm_per_hour_15   FLOAT       NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rain_rate_station ON rain_rate (station_id, gw_timestamp);
+
+CREATE TABLE IF NOT EXISTS presence
+(
+    id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
+    gw_timestamp     TIMESTAMPTZ NOT NULL,
+    server_timestamp TIMESTAMPTZ NOT NULL,
+    online           BOOLEAN     NOT NULL
+);
+-- presence used to be indexed by the gateway's clock, which no longer orders it
+DROP INDEX IF EXISTS presence_station;
+CREATE INDEX presence_station ON presence (station_id, server_timestamp);
+COMMIT;
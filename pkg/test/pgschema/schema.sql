@@ -7,19 +7,31 @@ DROP TABLE IF EXISTS rain CASCADE;
 CREATE TABLE rain
 (
     id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
     gw_timestamp     TIMESTAMPTZ NOT NULL,
     server_timestamp TIMESTAMPTZ NOT NULL,
-    amount           FLOAT       NOT NULL
+    sensor_id        TEXT        NOT NULL DEFAULT '', -- which gauge at the station, empty for gateways from before
+    amount           FLOAT       NOT NULL,
+    message_id       TEXT        NULL, -- gateway's ID for the message, so redeliveries are only stored once
+    sequence         BIGINT      NULL,
+    UNIQUE (station_id, message_id)
 );
+CREATE INDEX rain_station ON rain (station_id, gw_timestamp);
 
 DROP TABLE IF EXISTS temperature CASCADE;
 CREATE TABLE temperature
 (
     id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
     gw_timestamp     TIMESTAMPTZ NOT NULL,
     server_timestamp TIMESTAMPTZ NOT NULL,
-    value            INTEGER     NOT NULL
+    sensor_id        TEXT        NOT NULL DEFAULT '',
+    value            INTEGER     NOT NULL,
+    message_id       TEXT        NULL,
+    sequence         BIGINT      NULL,
+    UNIQUE (station_id, message_id)
 );
+CREATE INDEX temperature_station ON temperature (station_id, gw_timestamp);
 
 DROP TABLE IF EXISTS mappings CASCADE;
 CREATE TABLE mappings
@@ -44,13 +56,64 @@ DROP TABLE IF EXISTS status_log CASCADE;
 CREATE TABLE status_log
 (
     id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
     gw_timestamp     TIMESTAMPTZ NOT NULL,
     server_timestamp TIMESTAMPTZ NOT NULL,
     asset            INTEGER     NOT NULL,
+    sensor_id        TEXT        NOT NULL DEFAULT '',
+    state            TEXT        NULL, -- up, stale or down, for sensors only
+    reason           TEXT        NULL,
+    last_packet_age  FLOAT       NULL, -- seconds since the gateway heard from the sensor
     FOREIGN KEY (asset) REFERENCES status_codes (id)
 
 );
 
+DROP TABLE IF EXISTS telemetry CASCADE;
+CREATE TABLE telemetry
+(
+    id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
+    gw_timestamp     TIMESTAMPTZ NOT NULL,
+    server_timestamp TIMESTAMPTZ NOT NULL,
+    uptime           FLOAT       NULL, -- seconds the rainbase has been running
+    system_uptime    FLOAT       NULL, -- seconds since the gateway booted
+    disk_free        BIGINT      NULL, -- bytes free for the local database
+    cpu_temp_c       FLOAT       NULL,
+    load_1           FLOAT       NULL,
+    load_5           FLOAT       NULL,
+    load_15          FLOAT       NULL,
+    mqtt_reconnects  BIGINT      NULL,
+    mqtt_broker      TEXT        NULL, -- broker the gateway was connected to
+    cert_expires     TIMESTAMPTZ NULL, -- when the mqtt client certificate expires
+    version          TEXT        NULL
+);
+CREATE INDEX telemetry_station ON telemetry (station_id, gw_timestamp);
+
+DROP TABLE IF EXISTS rain_rate CASCADE;
+CREATE TABLE rain_rate
+(
+    id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
+    gw_timestamp     TIMESTAMPTZ NOT NULL,
+    server_timestamp TIMESTAMPTZ NOT NULL,
+    sensor_id        TEXT        NOT NULL DEFAULT '',
+    mm_per_hour_1    FLOAT       NOT NULL, -- rolling rain rate over 1, 5 and 15 minutes
+    mm_per_hour_5    FLOAT       NOT NULL,
+    mm_per_hour_15   FLOAT       NOT NULL
+);
+CREATE INDEX rain_rate_station ON rain_rate (station_id, gw_timestamp);
+
+DROP TABLE IF EXISTS presence CASCADE;
+CREATE TABLE presence
+(
+    id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
+    gw_timestamp     TIMESTAMPTZ NOT NULL, -- for the last will, when the server heard it
+    server_timestamp TIMESTAMPTZ NOT NULL, -- when the server heard about the change, which orders them
+    online           BOOLEAN     NOT NULL
+);
+CREATE INDEX presence_station ON presence (station_id, server_timestamp);
+
 INSERT INTO mappings (id, longname)
 VALUES (2, 'soft reset'),
        (3, 'hard reset'),
@@ -64,10 +127,15 @@ DROP TABLE IF EXISTS event_log CASCADE;
 CREATE TABLE event_log
 (
     id               SERIAL PRIMARY KEY,
+    station_id       TEXT        NOT NULL DEFAULT 'default',
     gw_timestamp     TIMESTAMPTZ NOT NULL,
     server_timestamp TIMESTAMPTZ NOT NULL,
+    sensor_id        TEXT        NOT NULL DEFAULT '',
     tag              INTEGER     NOT NULL,
     value            INTEGER     NOT NULL,
+    message_id       TEXT        NULL,
+    sequence         BIGINT      NULL,
+    UNIQUE (station_id, message_id),
     FOREIGN KEY (tag) REFERENCES mappings (id)
 );
 COMMIT;
\ No newline at end of file
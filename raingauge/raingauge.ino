@@ -8,6 +8,7 @@
 #include "src/config.hpp"
 #include "src/led_manager.hpp"
 #include "src/raingauge.hpp"
+#include "src/serial/serial_command.hpp"
 #include "src/serial/stateless_serial_tlv.hpp"
 #include "src/temp36.hpp"
 #include "src/timer.hpp"
@@ -22,6 +23,7 @@ static components::Raingauge raingauge(RAIN_PIN, RAINGAUGE_DEBOUNCE_MS, RAINGAUG
 
 /* Serial line */
 tlv::StatelessSerialTLV *serialTLV = new tlv::StatelessSerialTLV();
+static tlv::SerialCommand serialCommand;
 
 /* Pause button */
 static components::Button pauseButton(PAUSE_PIN, BUTTON_DEBOUNCE_MS, HIGH);
@@ -79,8 +81,45 @@ void handlePause(void)
     }
 }
 
+/* reset the rain counter */
+void handleSoftReset(void)
+{
+    raingauge.resetCount();
+    serialTLV->sendSoftReset();
+}
+
+/* act on a command sent by the host computer */
+void handleCommand(int command)
+{
+    switch (command)
+    {
+    case CMD_PAUSE:
+        if (!PAUSED)
+        {
+            handlePause();
+        }
+        break;
+    case CMD_UNPAUSE:
+        if (PAUSED)
+        {
+            handlePause();
+        }
+        break;
+    case CMD_SOFT_RESET:
+        handleSoftReset();
+        break;
+    case CMD_TEMPERATURE:
+        handleMeasureTemp();
+        break;
+    default:
+        break;
+    }
+}
+
 void setup()
 {
+    Serial.begin(BAUD);
+
     // wait a bit for serial port to pick up, blink lights in the meantime
     for (int i = 0; i < 3; i++)
     {
@@ -114,4 +153,6 @@ void loop()
     {
         handlePause();
     }
+
+    handleCommand(serialCommand.read());
 }
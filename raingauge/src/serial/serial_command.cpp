@@ -0,0 +1,68 @@
+#include "serial_command.hpp"
+
+using namespace tlv;
+
+SerialCommand::SerialCommand()
+{
+    _idx = 0;
+}
+
+/* read whatever is waiting on the serial port, return the tag of a complete command or CMD_NONE */
+int SerialCommand::read()
+{
+    while (Serial.available() > 0)
+    {
+        char c = Serial.read();
+        if (c == '\n')
+        {
+            int tag = _parse();
+            _idx = 0;
+            if (tag != CMD_NONE)
+            {
+                return tag;
+            }
+            continue;
+        }
+        if (_idx >= CMD_MAXLEN)
+        {
+            // garbage on the line, drop it and wait for the next newline
+            continue;
+        }
+        _buffer[_idx++] = c;
+    }
+    return CMD_NONE;
+}
+
+/* commands are static packets: tag, length of 1, value of 1 */
+int SerialCommand::_parse()
+{
+    if (_idx != 3 || _hexToInt(_buffer[1]) != 1 || _hexToInt(_buffer[2]) != 1)
+    {
+        return CMD_NONE;
+    }
+    int tag = _hexToInt(_buffer[0]);
+    switch (tag)
+    {
+    case CMD_TEMPERATURE:
+    case CMD_SOFT_RESET:
+    case CMD_PAUSE:
+    case CMD_UNPAUSE:
+        return tag;
+    default:
+        return CMD_NONE;
+    }
+}
+
+/* decode an ascii hex digit */
+int SerialCommand::_hexToInt(char c)
+{
+    if (c >= '0' && c <= '9')
+    {
+        return c - '0';
+    }
+    if (c >= 'A' && c <= 'F')
+    {
+        return c - 'A' + 10;
+    }
+    return CMD_NONE;
+}
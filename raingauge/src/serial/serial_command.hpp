@@ -0,0 +1,30 @@
+#ifndef _SERIAL_COMMAND_HPP_
+#define _SERIAL_COMMAND_HPP_
+
+#include "Arduino.h"
+
+#define CMD_NONE -1
+#define CMD_TEMPERATURE 1
+#define CMD_SOFT_RESET 2
+#define CMD_PAUSE 4
+#define CMD_UNPAUSE 5
+
+#define CMD_MAXLEN 8
+
+namespace tlv
+{
+/* Read TLV command packets sent by the host computer */
+class SerialCommand
+{
+  private:
+    char _buffer[CMD_MAXLEN];
+    unsigned char _idx;
+    int _hexToInt(char c);
+    int _parse();
+
+  public:
+    SerialCommand();
+    int read();
+};
+}; // namespace tlv
+#endif